@@ -0,0 +1,73 @@
+package permissions
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// SetCaseSensitive can be used for matching paths in a case-sensitive way,
+// by giving true. By default, paths are matched in a case-insensitive way,
+// because some operating systems uses case-insensitive filesystems.
+func (perm *Permissions) SetCaseSensitive(caseSensitive bool) {
+	perm.update(func(rules *ruleSet) {
+		rules.caseSensitive = caseSensitive
+	})
+}
+
+// canonicalPath returns the path that the rules are checked against, and
+// false if the path is ambiguous, so that the request must be rejected.
+//
+// The given path should be the decoded URL.Path. Trailing dots and spaces
+// are removed from every segment, since Windows ignores them, and then the
+// path is cleaned just like net/http does it: "//", "/./" and "/../" are
+// resolved and a trailing slash is kept. Only "." and ".." are dot segments.
+// Segments that would become "." or ".." when they are trimmed, like ".. "
+// or "...", are ambiguous, since routers treat them as ordinary segments.
+func canonicalPath(p string) (string, bool) {
+	if p == "" {
+		return "/", true
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		if segment == "." || segment == ".." {
+			continue
+		}
+		if segment != "" && strings.Trim(segment, ". ") == "" {
+			return "", false
+		}
+		segments[i] = strings.TrimRight(segment, ". ")
+	}
+	np := path.Clean(strings.Join(segments, "/"))
+	// path.Clean removes the trailing slash, but it should be kept
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np, true
+}
+
+// requestPath returns the canonical path of the given URL, and false if the
+// path is ambiguous. A percent-encoded "/" or "\" next to a dot segment, like
+// "/admin/..%2F", is ambiguous, since routers like http.ServeMux do not treat
+// "%2F" as a separator, so "/admin/..%2F" is served by the handler for
+// "/admin/", while the decoded path is "/".
+func requestPath(u *url.URL) (string, bool) {
+	for _, segment := range strings.Split(u.EscapedPath(), "/") {
+		if !strings.Contains(segment, "%") {
+			continue
+		}
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", false
+		}
+		for _, part := range strings.FieldsFunc(decoded, func(r rune) bool { return r == '/' || r == '\\' }) {
+			if part != decoded && strings.Trim(part, ". ") == "" {
+				return "", false
+			}
+		}
+	}
+	return canonicalPath(u.Path)
+}
@@ -0,0 +1,136 @@
+package permissions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, canonical string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"//admin", "/admin"},
+		{"/./admin", "/admin"},
+		{"/public/../admin", "/admin"},
+		{"/public/../../admin/", "/admin/"},
+		{"/admin.", "/admin"},
+		{"/admin. /users", "/admin/users"},
+		{"/data/", "/data/"},
+		{"admin", "/admin"},
+	} {
+		if got, ok := canonicalPath(tc.path); got != tc.canonical || !ok {
+			t.Errorf("Error, the canonical path for %q should be %q, got %q", tc.path, tc.canonical, got)
+		}
+	}
+
+	// Segments that only become dot segments when they are trimmed are ambiguous
+	for _, p := range []string{"/a/.../b", "/public/.. /admin", "/admin/.. ", "/admin/. /x", "/admin/.. /login"} {
+		if got, ok := canonicalPath(p); ok {
+			t.Errorf("Error, %q should be ambiguous, got %q", p, got)
+		}
+	}
+}
+
+func TestCanonicalPathDecide(t *testing.T) {
+	perm := New()
+	for _, target := range []string{"//admin", "/./admin", "/public/../admin", "/admin.", "/ADMIN"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL = u
+		if d := perm.Decide(req); d.Allowed || d.Rule != "admin" {
+			t.Errorf("Error, %q should be checked as an admin page: %s", target, d)
+		}
+	}
+
+	// Paths that routers may see differently are rejected
+	for _, target := range []string{
+		"/public/..%2Fadmin", "/admin/..%2F", "/admin/x%2F..%2F..%2Flogin", "/admin/..%5C",
+		"/admin/..%20", "/admin/..%20/login", "/public/..%20/admin",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL = u
+		if d := perm.Decide(req); d.Allowed || d.Rule != "path" {
+			t.Errorf("Error, %q should be rejected as an ambiguous path: %s", target, d)
+		}
+	}
+	if d := perm.Decide(httptest.NewRequest(http.MethodGet, "/login/a%2Fb", nil)); !d.Allowed {
+		t.Errorf("Error, an encoded slash without dot segments should be allowed: %s", d)
+	}
+}
+
+func TestCaseSensitive(t *testing.T) {
+	perm := New()
+	perm.SetCaseSensitive(true)
+	perm.AddAdminPath("/Secret")
+	if d := perm.Decide(httptest.NewRequest(http.MethodGet, "/Secret/x", nil)); d.Allowed {
+		t.Errorf("Error, /Secret should be an admin page: %s", d)
+	}
+	if d := perm.Decide(httptest.NewRequest(http.MethodGet, "/secret/x", nil)); !d.Allowed {
+		t.Errorf("Error, /secret should be public when matching is case-sensitive: %s", d)
+	}
+}
+
+// isAdminPath checks if the given URL would be an admin page for a router that
+// decodes the raw path and cleans it, independently of canonicalPath
+func isAdminPath(u *url.URL) bool {
+	decoded, err := url.PathUnescape(u.EscapedPath())
+	if err != nil {
+		decoded = u.Path
+	}
+	for _, p := range []string{u.Path, decoded} {
+		first, _, _ := strings.Cut(strings.TrimPrefix(path.Clean("/"+p), "/"), "/")
+		if strings.TrimRight(strings.ToLower(first), ". ") == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzAdminPath(f *testing.F) {
+	for _, seed := range []string{
+		"/admin", "//admin", "/./admin", "/public/../admin", "/admin.", "/admin./users",
+		"/ADMIN", "/public/..%2Fadmin", "/%2e%2e/admin", "/%2Fadmin", "/js/../../admin/", "/admin%20",
+		"/public/.. /admin", "/public/.../admin", "/public/..%20/admin",
+		"/admin/..%2F", "/admin/x%2F..%2F..%2Flogin", "/admin/..%20", "/admin/..%20/login",
+	} {
+		f.Add(seed)
+	}
+	perm := New()
+	reached := false
+	mux := http.NewServeMux()
+	admin := func(http.ResponseWriter, *http.Request) { reached = true }
+	mux.HandleFunc("/admin", admin)
+	mux.HandleFunc("/admin/", admin)
+	mux.HandleFunc("/", func(http.ResponseWriter, *http.Request) {})
+	handler := perm.Middleware(mux)
+
+	f.Fuzz(func(t *testing.T, target string) {
+		u, err := url.ParseRequestURI(target)
+		if err != nil || !strings.HasPrefix(u.Path, "/") {
+			return
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL, req.RequestURI = u, target
+		reached = false
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if reached {
+			t.Fatalf("Error, %q reached the admin handler", target)
+		}
+		if isAdminPath(u) && perm.Decide(req).Allowed {
+			t.Fatalf("Error, %q should be checked as an admin page", target)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/xyproto/permissions2/v2"
+	"github.com/xyproto/permissions2/v2/handlers"
+)
+
+func main() {
+	mux := http.NewServeMux()
+
+	// New permissions middleware
+	perm, err := permissions.New2()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Get the userstate, used in the handlers below
+	userstate := perm.UserState().(*permissions.UserState)
+
+	// Write e-mails to stdout instead of sending them, and use this site for the links
+	userstate.SetMailer(permissions.NewLogMailer(os.Stdout))
+	userstate.SetSite("Example", "http://localhost:3000")
+
+	// Add the /register, /login, /logout, /confirm, /reset and /magic handlers
+	handlers.New(userstate).Mount(mux)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "Username stored in cookies (or blank): %s\n", userstate.Username(req))
+		fmt.Fprintf(w, "Current user is logged in, has a valid cookie and *user rights*: %v\n", userstate.UserRights(req))
+		fmt.Fprintf(w, "\nTry: /register, /login, /logout, /reset, /magic and /data\n")
+	})
+
+	mux.HandleFunc("/data", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "user page that only logged in users must see!")
+	})
+
+	log.Println("Listening for requests on port 3000")
+
+	// Start listening
+	log.Fatal(http.ListenAndServe(":3000", perm.Middleware(mux)))
+}
@@ -0,0 +1,438 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// The methods that end with Context take a context.Context, that can cancel
+// the Redis commands or give them a deadline, and return every error. This
+// is the API that new code should use. The other methods call these, and
+// keep the behavior that pinterface.IUserState expects, where errors are
+// mostly treated as a missing user or field.
+
+// The Redis keys for the users
+const (
+	usersKey       = "users"       // a hash for each user, "users:" + username
+	usernamesKey   = "usernames"   // a set of all usernames
+	unconfirmedKey = "unconfirmed" // a set of the usernames of unconfirmed users
+)
+
+// userKey returns the Redis key for the hash of the given user
+func userKey(username string) string {
+	return usersKey + ":" + username
+}
+
+// command is a Redis command, for running several commands at once with exec
+type command struct {
+	name string
+	args []any
+}
+
+// cmd returns a Redis command with the given name and arguments
+func cmd(name string, args ...any) command {
+	return command{name, args}
+}
+
+// conn gets a Redis connection from the pool, with the database selected
+func (state *UserState) conn(ctx context.Context) (redis.Conn, error) {
+	conn, err := (*redis.Pool)(state.pool).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if state.dbindex != 0 {
+		if _, err := redis.DoContext(conn, ctx, "SELECT", state.dbindex); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// do runs one Redis command
+func (state *UserState) do(ctx context.Context, name string, args ...any) (any, error) {
+	conn, err := state.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return redis.DoContext(conn, ctx, name, args...)
+}
+
+// exec runs the given Redis commands in one transaction, with MULTI and
+// EXEC, in one round trip. Returns the replies of the commands.
+func (state *UserState) exec(ctx context.Context, commands ...command) ([]any, error) {
+	conn, err := state.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, c := range commands {
+		if err := conn.Send(c.name, c.args...); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := redis.Values(redis.DoContext(conn, ctx, "EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// field returns a field of the given user, or ErrNotFound if the user does not have it
+func (state *UserState) field(ctx context.Context, username, fieldname string) (string, error) {
+	value, err := redis.String(state.do(ctx, "HGET", userKey(username), fieldname))
+	if errors.Is(err, redis.ErrNil) {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+// setField sets a field of the given user, and drops the user from the user cache
+func (state *UserState) setField(ctx context.Context, username, fieldname, value string) error {
+	_, err := state.do(ctx, "HSET", userKey(username), fieldname, value)
+	state.invalidateUser(username, revokes(fieldname, value))
+	return err
+}
+
+// delField removes a field of the given user, and drops the user from the user cache
+func (state *UserState) delField(ctx context.Context, username, fieldname string) error {
+	_, err := state.do(ctx, "HDEL", userKey(username), fieldname)
+	state.invalidateUser(username, revokes(fieldname, ""))
+	return err
+}
+
+// HasUserContext checks if the given username exists.
+func (state *UserState) HasUserContext(ctx context.Context, username string) (bool, error) {
+	return redis.Bool(state.do(ctx, "SISMEMBER", usernamesKey, username))
+}
+
+// AllUsernamesContext returns all usernames.
+func (state *UserState) AllUsernamesContext(ctx context.Context) ([]string, error) {
+	return redis.Strings(state.do(ctx, "SMEMBERS", usernamesKey))
+}
+
+// AddUserContext creates a user and hashes the password, does not check for rights.
+// The given data must be valid.
+func (state *UserState) AddUserContext(ctx context.Context, username, password, email string) error {
+	return state.addUserContext(ctx, username, state.HashPassword(username, password), email)
+}
+
+// addUserContext creates a user from the username and password hash, does not check for rights.
+// An existing user with the same username is overwritten. Use CreateUser to avoid this.
+func (state *UserState) addUserContext(ctx context.Context, username, passwordHash, email string) error {
+	commands := []command{
+		cmd("SADD", usernamesKey, username),
+		cmd("HDEL", userKey(username), "passwordUsername", "renamedFrom", "aliases"),
+		cmd("HSET", userKey(username),
+			"password", passwordHash,
+			"email", email,
+			"loggedin", "false",
+			"confirmed", "false",
+			"admin", "false"),
+	}
+	if key := emailIndexKey(email); key != "" {
+		commands = append(commands, cmd("HSET", emailsKey, key, username))
+	}
+	commands = append(commands, cmd("HSETNX", skeletonsKey, skeleton(username), username))
+	_, err := state.exec(ctx, commands...)
+	state.invalidateUser(username, false)
+	return err
+}
+
+// RemoveUserContext removes the user and the login status.
+// Use DeleteUser to also remove all the other fields of the user.
+func (state *UserState) RemoveUserContext(ctx context.Context, username string) error {
+	email, err := state.EmailContext(ctx, username)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	_, err = state.script(ctx, removeUserScript, usernamesKey, userKey(username), emailsKey, skeletonsKey,
+		username, emailIndexKey(email), skeleton(username))
+	state.invalidateUser(username, true)
+	return err
+}
+
+// BooleanFieldContext returns true if the given user exists and the given field is "true".
+func (state *UserState) BooleanFieldContext(ctx context.Context, username, fieldname string) (bool, error) {
+	replies, err := state.exec(ctx,
+		cmd("SISMEMBER", usernamesKey, username),
+		cmd("HGET", userKey(username), fieldname),
+	)
+	if err != nil {
+		return false, err
+	}
+	exists, err := redis.Bool(replies[0], nil)
+	if err != nil || !exists {
+		return false, err
+	}
+	value, err := redis.String(replies[1], nil)
+	if errors.Is(err, redis.ErrNil) {
+		return false, nil
+	}
+	return value == "true", err
+}
+
+// SetBooleanFieldContext stores a boolean value for the given user and field.
+func (state *UserState) SetBooleanFieldContext(ctx context.Context, username, fieldname string, val bool) error {
+	return state.setField(ctx, username, fieldname, strconv.FormatBool(val))
+}
+
+// PropertiesContext returns the names of all fields of the given user.
+func (state *UserState) PropertiesContext(ctx context.Context, username string) ([]string, error) {
+	return redis.Strings(state.do(ctx, "HKEYS", userKey(username)))
+}
+
+// IsLoggedInContext checks if the given user is logged in.
+func (state *UserState) IsLoggedInContext(ctx context.Context, username string) (bool, error) {
+	return state.BooleanFieldContext(ctx, username, "loggedin")
+}
+
+// SetLoggedInContext marks the user as logged in.
+func (state *UserState) SetLoggedInContext(ctx context.Context, username string) error {
+	return state.setField(ctx, username, "loggedin", "true")
+}
+
+// SetLoggedOutContext marks the user as logged out.
+func (state *UserState) SetLoggedOutContext(ctx context.Context, username string) error {
+	return state.setField(ctx, username, "loggedin", "false")
+}
+
+// IsAdminContext checks if the given user is an administrator.
+func (state *UserState) IsAdminContext(ctx context.Context, username string) (bool, error) {
+	return state.BooleanFieldContext(ctx, username, "admin")
+}
+
+// SetAdminStatusContext makes the user an administrator.
+func (state *UserState) SetAdminStatusContext(ctx context.Context, username string) error {
+	return state.setField(ctx, username, "admin", "true")
+}
+
+// RemoveAdminStatusContext removes the administrator status of the user.
+func (state *UserState) RemoveAdminStatusContext(ctx context.Context, username string) error {
+	return state.setField(ctx, username, "admin", "false")
+}
+
+// IsConfirmedContext checks if the given user is confirmed.
+func (state *UserState) IsConfirmedContext(ctx context.Context, username string) (bool, error) {
+	return state.BooleanFieldContext(ctx, username, "confirmed")
+}
+
+// MarkConfirmedContext marks the user as confirmed.
+func (state *UserState) MarkConfirmedContext(ctx context.Context, username string) error {
+	return state.setField(ctx, username, "confirmed", "true")
+}
+
+// AllUnconfirmedUsernamesContext returns the usernames of all users that are not yet confirmed.
+func (state *UserState) AllUnconfirmedUsernamesContext(ctx context.Context) ([]string, error) {
+	return redis.Strings(state.do(ctx, "SMEMBERS", unconfirmedKey))
+}
+
+// AddUnconfirmedContext adds a user that is registered but not confirmed.
+func (state *UserState) AddUnconfirmedContext(ctx context.Context, username, confirmationCode string) error {
+	_, err := state.exec(ctx,
+		cmd("SADD", unconfirmedKey, username),
+		cmd("HSET", userKey(username), "confirmationCode", confirmationCode),
+	)
+	state.invalidateUser(username, false)
+	return err
+}
+
+// RemoveUnconfirmedContext removes a user that is registered but not confirmed.
+func (state *UserState) RemoveUnconfirmedContext(ctx context.Context, username string) error {
+	_, err := state.exec(ctx,
+		cmd("SREM", unconfirmedKey, username),
+		cmd("HDEL", userKey(username), "confirmationCode"),
+	)
+	state.invalidateUser(username, false)
+	return err
+}
+
+// ConfirmContext removes the user from the unconfirmed users and marks the user as confirmed.
+func (state *UserState) ConfirmContext(ctx context.Context, username string) error {
+	_, err := state.exec(ctx,
+		cmd("SREM", unconfirmedKey, username),
+		cmd("HDEL", userKey(username), "confirmationCode"),
+		cmd("HSET", userKey(username), "confirmed", "true"),
+	)
+	state.invalidateUser(username, false)
+	return err
+}
+
+// ConfirmationCodeContext returns the confirmation code of the given user,
+// or ErrNotFound if the user has none.
+func (state *UserState) ConfirmationCodeContext(ctx context.Context, username string) (string, error) {
+	return state.field(ctx, username, "confirmationCode")
+}
+
+// EmailContext returns the e-mail address of the given user, or ErrNotFound if the user has none.
+func (state *UserState) EmailContext(ctx context.Context, username string) (string, error) {
+	return state.field(ctx, username, "email")
+}
+
+// PasswordHashContext returns the password hash of the given user, or ErrNotFound if the user has none.
+func (state *UserState) PasswordHashContext(ctx context.Context, username string) (string, error) {
+	return state.field(ctx, username, "password")
+}
+
+// SetPasswordContext hashes and stores the password for a user.
+// No validation or check of the given password is performed.
+func (state *UserState) SetPasswordContext(ctx context.Context, username, password string) error {
+	_, err := state.exec(ctx,
+		cmd("HSET", userKey(username), "password", state.HashPassword(username, password)),
+		cmd("HDEL", userKey(username), "passwordUsername"),
+	)
+	state.invalidateUser(username, false)
+	return err
+}
+
+// CorrectPasswordContext checks if the password of the given user is correct.
+func (state *UserState) CorrectPasswordContext(ctx context.Context, username, password string) (bool, error) {
+	replies, err := state.exec(ctx,
+		cmd("SISMEMBER", usernamesKey, username),
+		cmd("HGET", userKey(username), "password"),
+		cmd("HGET", userKey(username), "passwordUsername"),
+	)
+	if err != nil {
+		return false, err
+	}
+	exists, err := redis.Bool(replies[0], nil)
+	if err != nil || !exists {
+		return false, err
+	}
+	hash, err := redis.Bytes(replies[1], nil)
+	if errors.Is(err, redis.ErrNil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// sha256 hashes are made with the username, which changes if the user is renamed
+	if passwordUsername, err := redis.String(replies[2], nil); err == nil {
+		username = passwordUsername
+	}
+	return state.correctHash(hash, username, password), nil
+}
+
+// LockContext locks the given user out for the given duration.
+func (state *UserState) LockContext(ctx context.Context, username string, duration time.Duration) error {
+	return state.setField(ctx, username, "lockedUntil", strconv.FormatInt(time.Now().Add(duration).Unix(), 10))
+}
+
+// UnlockContext removes the lock for the given user.
+func (state *UserState) UnlockContext(ctx context.Context, username string) error {
+	return state.delField(ctx, username, "lockedUntil")
+}
+
+// IsLockedContext checks if the given user is locked out.
+func (state *UserState) IsLockedContext(ctx context.Context, username string) (bool, error) {
+	lockedUntil, err := state.field(ctx, username, "lockedUntil")
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return (&userRecord{fields: map[string]string{"lockedUntil": lockedUntil}}).locked(), nil
+}
+
+// AddRoleContext gives the given user a role. Adding the "admin" role is
+// the same as SetAdminStatusContext.
+func (state *UserState) AddRoleContext(ctx context.Context, username, role string) error {
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	if role == "admin" {
+		return state.SetAdminStatusContext(ctx, username)
+	}
+	return state.setField(ctx, username, rolePrefix+role, "true")
+}
+
+// RemoveRoleContext takes a role away from the given user. Removing the
+// "admin" role is the same as RemoveAdminStatusContext.
+func (state *UserState) RemoveRoleContext(ctx context.Context, username, role string) error {
+	if !validRole(role) {
+		return ErrInvalidRole
+	}
+	if role == "admin" {
+		return state.RemoveAdminStatusContext(ctx, username)
+	}
+	return state.delField(ctx, username, rolePrefix+role)
+}
+
+// HasRoleContext checks if the given user has been given the given role.
+// All users have the "user" role, while the "admin" role is the same as
+// IsAdminContext.
+func (state *UserState) HasRoleContext(ctx context.Context, username, role string) (bool, error) {
+	if role != "user" && role != "admin" && !validRole(role) {
+		return false, nil
+	}
+	u, err := state.fetchUser(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	switch role {
+	case "user":
+		return u.exists, nil
+	case "admin":
+		return u.admin(), nil
+	}
+	return u.boolean(rolePrefix + role), nil
+}
+
+// RolesContext returns the sorted names of the roles that the given user
+// has been given, including "admin" for administrators. The implicit "user"
+// role is not included.
+func (state *UserState) RolesContext(ctx context.Context, username string) ([]string, error) {
+	u, err := state.fetchUser(ctx, username)
+	if err != nil {
+		return []string{}, err
+	}
+	return u.roles(), nil
+}
+
+// EffectiveRolesContext returns the sorted names of all roles the given
+// user has, including "user" and every inherited role.
+func (state *UserState) EffectiveRolesContext(ctx context.Context, username string) ([]string, error) {
+	u, err := state.fetchUser(ctx, username)
+	if err != nil {
+		return []string{}, err
+	}
+	return sortedKeys(state.currentRoles().recordRoles(u)), nil
+}
+
+// HasEffectiveRoleContext checks if the given user has the given role,
+// either directly or by inheriting it from another role.
+func (state *UserState) HasEffectiveRoleContext(ctx context.Context, username, role string) (bool, error) {
+	u, err := state.fetchUser(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	return state.currentRoles().recordRoles(u)[role], nil
+}
+
+// CanContext checks if the given user has the given permission, through
+// any of the roles of the user.
+func (state *UserState) CanContext(ctx context.Context, username, permission string) (bool, error) {
+	if !validPermission(permission) {
+		return false, nil
+	}
+	u, err := state.fetchUser(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	roles := state.currentRoles()
+	return roles.can(roles.recordRoles(u), permission), nil
+}
@@ -0,0 +1,115 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestContextAPI(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	if err := userstate.AddUserContext(ctx, "bob", "hunter1", "bob@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.RemoveUserContext(ctx, "bob")
+
+	if ok, err := userstate.HasUserContext(ctx, "bob"); err != nil || !ok {
+		t.Error("Error, bob should exist:", err)
+	}
+	if email, err := userstate.EmailContext(ctx, "bob"); err != nil || email != "bob@zombo.com" {
+		t.Error("Error, unexpected e-mail address:", email, err)
+	}
+	if _, err := userstate.EmailContext(ctx, "nobody"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+	if ok, err := userstate.CorrectPasswordContext(ctx, "bob", "hunter1"); err != nil || !ok {
+		t.Error("Error, the password should be correct:", err)
+	}
+	if ok, err := userstate.CorrectPasswordContext(ctx, "bob", "hunter2"); err != nil || ok {
+		t.Error("Error, the password should be wrong:", err)
+	}
+
+	if err := userstate.SetLoggedInContext(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := userstate.IsLoggedInContext(ctx, "bob"); err != nil || !ok || !userstate.IsLoggedIn("bob") {
+		t.Error("Error, bob should be logged in:", err)
+	}
+	if err := userstate.SetLoggedOutContext(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := userstate.IsLoggedInContext(ctx, "bob"); err != nil || ok {
+		t.Error("Error, bob should be logged out:", err)
+	}
+
+	userstate.GrantPermission("editor", "repo:write")
+	if err := userstate.AddRoleContext(ctx, "bob", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.RemoveRoleContext(ctx, "bob", "editor")
+	if roles, err := userstate.RolesContext(ctx, "bob"); err != nil || !slices.Equal(roles, []string{"editor"}) {
+		t.Error("Error, unexpected roles:", roles, err)
+	}
+	if ok, err := userstate.CanContext(ctx, "bob", "repo:write"); err != nil || !ok {
+		t.Error("Error, bob should have the repo:write permission:", err)
+	}
+	if err := userstate.AddRoleContext(ctx, "bob", ""); err != ErrInvalidRole {
+		t.Error("Error, expected ErrInvalidRole, got", err)
+	}
+
+	if err := userstate.LockContext(ctx, "bob", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := userstate.IsLockedContext(ctx, "bob"); err != nil || !ok {
+		t.Error("Error, bob should be locked:", err)
+	}
+	if err := userstate.UnlockContext(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := userstate.IsLockedContext(ctx, "bob"); err != nil || ok {
+		t.Error("Error, bob should not be locked:", err)
+	}
+
+	if err := userstate.AddUnconfirmedContext(ctx, "bob", "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if code, err := userstate.ConfirmationCodeContext(ctx, "bob"); err != nil || code != "abc123" {
+		t.Error("Error, unexpected confirmation code:", code, err)
+	}
+	if err := userstate.ConfirmContext(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.SetBooleanFieldContext(ctx, "bob", "confirmed", false)
+	if ok, err := userstate.IsConfirmedContext(ctx, "bob"); err != nil || !ok {
+		t.Error("Error, bob should be confirmed:", err)
+	}
+	if unconfirmed, err := userstate.AllUnconfirmedUsernamesContext(ctx); err != nil || slices.Contains(unconfirmed, "bob") {
+		t.Error("Error, bob should no longer be unconfirmed:", err)
+	}
+}
+
+func TestContextErrors(t *testing.T) {
+	userstate := NewUserStateSimple()
+
+	// A deadline that has passed stops the commands
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := userstate.HasUserContext(ctx, "bob"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Error, expected context.DeadlineExceeded, got", err)
+	}
+
+	// Lost connections are returned as errors, instead of as missing users
+	userstate.Close()
+	if _, err := userstate.HasUserContext(context.Background(), "bob"); err == nil {
+		t.Error("Error, expected an error for a closed connection pool")
+	}
+	if err := userstate.SetLoggedInContext(context.Background(), "bob"); err == nil {
+		t.Error("Error, expected an error for a closed connection pool")
+	}
+	if userstate.IsLoggedIn("bob") {
+		t.Error("Error, bob should not be logged in when Redis can not be reached")
+	}
+}
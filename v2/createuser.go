@@ -0,0 +1,201 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// ErrUserExists is returned if a user with the given username already exists
+	ErrUserExists = errors.New("the user already exists")
+
+	// ErrEmailExists is returned if another user already has the given e-mail address
+	ErrEmailExists = errors.New("the e-mail address is already in use")
+)
+
+// emailsKey is the Redis key for the hash from e-mail addresses, in
+// lowercase, to the usernames of the users that have them
+const emailsKey = "emails"
+
+// emailIndexKey returns the key of the given e-mail address in the e-mail
+// index, or "" if there is no e-mail address
+func emailIndexKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// createUserScript adds a user, unless the username or the e-mail address
+// is taken. An e-mail address in the index is only taken if the user that
+// has it still exists. The username of a deleted user is taken until the
+// tombstone expires, and the old username of a renamed user until the alias
+// expires. Fields that were left behind by RemoveUser, like roles, codes and
+// the admin status, are removed, so that the new user does not get them.
+// If the last argument is "true", a username that looks like the username of
+// an existing user, by having the same skeleton, is taken too.
+//
+// KEYS: usernames, users:<username>, emails, deleted:<hash of username>, alias:<username>, skeletons
+// ARGV: username, password hash, e-mail address, e-mail index key, skeleton of username, reject confusable usernames
+var createUserScript = redis.NewScript(6, `
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 1 or redis.call("EXISTS", KEYS[4]) == 1 or redis.call("EXISTS", KEYS[5]) == 1 then
+	return "user"
+end
+local lookalike = redis.call("HGET", KEYS[6], ARGV[5])
+if lookalike and (lookalike == ARGV[1] or redis.call("SISMEMBER", KEYS[1], lookalike) == 0) then
+	lookalike = false
+end
+if lookalike and ARGV[6] == "true" then
+	return "confusable"
+end
+if ARGV[4] ~= "" then
+	local owner = redis.call("HGET", KEYS[3], ARGV[4])
+	if owner and owner ~= ARGV[1] and redis.call("SISMEMBER", KEYS[1], owner) == 1 then
+		return "email"
+	end
+end
+redis.call("SADD", KEYS[1], ARGV[1])
+redis.call("DEL", KEYS[2])
+redis.call("HSET", KEYS[2], "password", ARGV[2], "email", ARGV[3], "loggedin", "false", "confirmed", "false", "admin", "false")
+if ARGV[4] ~= "" then
+	redis.call("HSET", KEYS[3], ARGV[4], ARGV[1])
+end
+if not lookalike then
+	redis.call("HSET", KEYS[6], ARGV[5], ARGV[1])
+end
+return "ok"
+`)
+
+// removeUserScript removes a user from the set of usernames, logs the user
+// out, removes the password reset and magic link codes of the user, and
+// removes the e-mail address of the user from the e-mail index, and the
+// skeleton of the username from the index of skeletons.
+//
+// KEYS: usernames, users:<username>, emails, skeletons
+// ARGV: username, e-mail index key, skeleton of username
+var removeUserScript = redis.NewScript(4, `
+redis.call("SREM", KEYS[1], ARGV[1])
+redis.call("HDEL", KEYS[2], "loggedin", "passwordResetCode", "magicLinkCode")
+if ARGV[2] ~= "" and redis.call("HGET", KEYS[3], ARGV[2]) == ARGV[1] then
+	redis.call("HDEL", KEYS[3], ARGV[2])
+end
+if redis.call("HGET", KEYS[4], ARGV[3]) == ARGV[1] then
+	redis.call("HDEL", KEYS[4], ARGV[3])
+end
+return "ok"
+`)
+
+// script runs the given Lua script
+func (state *UserState) script(ctx context.Context, script *redis.Script, keysAndArgs ...any) (any, error) {
+	conn, err := state.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return script.DoContext(ctx, conn, keysAndArgs...)
+}
+
+// CreateUser creates a user and hashes the password, in one atomic
+// operation. Returns ErrUserExists if the username is taken, or
+// ErrEmailExists if another user has the same e-mail address. E-mail
+// addresses are compared without regard to case. The username of a user that
+// was deleted with DeleteUser is taken until the tombstone lifetime has passed,
+// and the old username of a user that was renamed with RenameUser is taken
+// until the alias lifetime has passed.
+//
+// The username must be allowed by the username profile, and the errors from
+// the username profile are returned. The username must also be normalized
+// already, with NormalizeUsername, or else ErrUsernameNotNormalized is
+// returned, so that the user is stored with the given username. Returns
+// ErrUsernameConfusable if the username looks like the username of another
+// user, unless the username profile allows it.
+//
+// Unlike AddUser, an existing user is never overwritten, also not when two
+// users with the same username are created at the same time.
+func (state *UserState) CreateUser(ctx context.Context, username, password, email string) error {
+	rejectConfusable, err := state.checkNewUsername(username)
+	if err != nil {
+		return err
+	}
+	tombstoneKey, err := state.deletedUserKey(ctx, username)
+	if err != nil {
+		return err
+	}
+	result, err := redis.String(state.script(ctx, createUserScript,
+		usernamesKey, userKey(username), emailsKey, tombstoneKey, aliasUserKey(username), skeletonsKey,
+		username, state.HashPassword(username, password), email, emailIndexKey(email), skeleton(username), rejectConfusable))
+	if err != nil {
+		return err
+	}
+	switch result {
+	case "user":
+		return ErrUserExists
+	case "confusable":
+		return ErrUsernameConfusable
+	case "email":
+		return ErrEmailExists
+	}
+	state.invalidateUser(username, false)
+	return nil
+}
+
+// HasEmailContext finds the user that has the given e-mail address, by
+// looking it up in the e-mail index. Users that are not in the index, for
+// instance because they were added by an older version, are also searched.
+// Returns ErrNotFound if no user has the given e-mail address.
+func (state *UserState) HasEmailContext(ctx context.Context, email string) (string, error) {
+	key := emailIndexKey(email)
+	if key == "" {
+		return "", ErrNotFound
+	}
+	owner, err := redis.String(state.do(ctx, "HGET", emailsKey, key))
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return "", err
+	}
+	if err == nil {
+		if exists, err := state.HasUserContext(ctx, owner); err != nil || exists {
+			return owner, err
+		}
+	}
+	usernames, err := state.AllUsernamesContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, username := range usernames {
+		userEmail, err := state.EmailContext(ctx, username)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if userEmail == email {
+			return username, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// IndexEmailsContext adds the e-mail addresses of all existing users to the
+// e-mail index, so that CreateUser also rejects the e-mail addresses of users
+// that were added by an older version. An e-mail address that already is in
+// the index is not changed.
+func (state *UserState) IndexEmailsContext(ctx context.Context) error {
+	usernames, err := state.AllUsernamesContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		email, err := state.EmailContext(ctx, username)
+		if errors.Is(err, ErrNotFound) || emailIndexKey(email) == "" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := state.do(ctx, "HSETNX", emailsKey, emailIndexKey(email), username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
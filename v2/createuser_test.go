@@ -0,0 +1,113 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCreateUser(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	if err := userstate.CreateUser(ctx, "bob", "hunter1", "Bob@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.RemoveUser("bob")
+
+	if err := userstate.CreateUser(ctx, "bob", "hunter2", "bob2@zombo.com"); err != ErrUserExists {
+		t.Error("Error, expected ErrUserExists, got", err)
+	}
+	if !userstate.CorrectPassword("bob", "hunter1") {
+		t.Error("Error, the password of bob should not have been changed")
+	}
+	if err := userstate.CreateUser(ctx, "alice", "hunter1", "bob@ZOMBO.com"); err != ErrEmailExists {
+		t.Error("Error, expected ErrEmailExists, got", err)
+	}
+	if userstate.HasUser("alice") {
+		t.Error("Error, alice should not have been created")
+	}
+	if username, err := userstate.HasEmail("bob@zombo.com"); err != nil || username != "bob" {
+		t.Error("Error, expected bob to have the e-mail address, got", username, err)
+	}
+
+	// The e-mail address can be used again when the user is removed
+	userstate.RemoveUser("bob")
+	if _, err := userstate.HasEmail("Bob@zombo.com"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+	if err := userstate.CreateUser(ctx, "alice", "hunter1", "bob@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.RemoveUser("alice")
+
+	// Users that are not in the e-mail index are found, and can be added to it
+	userstate.AddUser("carol", "hunter1", "carol@zombo.com")
+	defer userstate.RemoveUser("carol")
+	if _, err := userstate.do(ctx, "HDEL", emailsKey, "carol@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	if username, err := userstate.HasEmail("carol@zombo.com"); err != nil || username != "carol" {
+		t.Error("Error, expected carol to have the e-mail address, got", username, err)
+	}
+	if err := userstate.IndexEmailsContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.CreateUser(ctx, "dave", "hunter1", "carol@zombo.com"); err != ErrEmailExists {
+		t.Error("Error, expected ErrEmailExists, got", err)
+	}
+
+	// A new user does not get the fields that RemoveUser left behind
+	userstate.AddUser("gina", "hunter1", "gina@zombo.com")
+	userstate.SetAdminStatus("gina")
+	userstate.AddRole("gina", "editor")
+	userstate.Disable("gina", "spam")
+	userstate.RemoveUser("gina")
+	if err := userstate.CreateUser(ctx, "gina", "hunter2", "gina2@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.DiscardUser(ctx, "gina")
+	if userstate.IsAdmin("gina") || userstate.HasRole("gina", "editor") || userstate.IsDisabled("gina") {
+		t.Error("Error, the new gina should not have the admin status, roles or suspension of the old one")
+	}
+}
+
+func TestCreateUserConcurrently(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	defer userstate.RemoveUser("bob")
+	for i := range 10 {
+		defer userstate.RemoveUser(fmt.Sprintf("bob%d", i))
+	}
+
+	// Only one of the users with the same username, or the same e-mail address, is created
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 10 {
+		wg.Go(func() {
+			errs <- userstate.CreateUser(ctx, "bob", fmt.Sprintf("hunter%d", i), fmt.Sprintf("bob%d@zombo.com", i))
+		})
+		wg.Go(func() {
+			errs <- userstate.CreateUser(ctx, fmt.Sprintf("bob%d", i), "hunter1", "bob@example.com")
+		})
+	}
+	wg.Wait()
+	close(errs)
+	created, userExists, emailExists := 0, 0, 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case errors.Is(err, ErrUserExists):
+			userExists++
+		case errors.Is(err, ErrEmailExists):
+			emailExists++
+		default:
+			t.Error(err)
+		}
+	}
+	if created != 2 || userExists != 9 || emailExists != 9 {
+		t.Errorf("Error, expected 2 created users, got %d, with %d ErrUserExists and %d ErrEmailExists", created, userExists, emailExists)
+	}
+}
@@ -0,0 +1,93 @@
+package permissions
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// DecisionHeader is the HTTP header that the middleware uses for explaining
+// decisions, when debugging is enabled with SetDebug.
+const DecisionHeader = "X-Permissions-Decision"
+
+// Decision explains why a request is allowed or rejected.
+type Decision struct {
+	Allowed    bool   // true if the request is allowed
+	Reason     Reason // why the request is rejected, or ReasonNone
+	Rule       string // the kind of rule that decided: "options", "root", "admin", "role", "user", "public", "default", "path" (for ambiguous paths) or "permission"
+	Prefix     string // the path prefix or pattern of the rule, if any
+	Role       string // the role that is required by the rule ("admin", "user" or a custom role), or "" for public pages
+	Username   string // the username from the login cookie, if any
+	Path       string // the path that was checked
+	Method     string // the method of the request that was checked
+	Permission string // the permission that is required, for decisions made by Require
+}
+
+// allow returns the decision as an allowed request, for the given rule
+func (d Decision) allow(rule, prefix, role string) Decision {
+	d.Allowed, d.Reason = true, ReasonNone
+	d.Rule, d.Prefix, d.Role = rule, prefix, role
+	return d
+}
+
+// reject returns the decision as a rejected request, for the given rule and reason
+func (d Decision) reject(rule, prefix, role string, r Reason) Decision {
+	d.Allowed, d.Reason = false, r
+	d.Rule, d.Prefix, d.Role = rule, prefix, role
+	return d
+}
+
+// String returns a short explanation of the decision, on one line
+func (d Decision) String() string {
+	outcome := "allow"
+	if !d.Allowed {
+		outcome = "reject"
+	}
+	s := fmt.Sprintf("%s path=%s rule=%s", outcome, strconv.QuoteToASCII(d.Path), d.Rule)
+	if d.Method != "" {
+		s += " method=" + d.Method
+	}
+	if d.Prefix != "" {
+		s += " prefix=" + strconv.QuoteToASCII(d.Prefix)
+	}
+	if d.Role != "" {
+		s += " role=" + d.Role
+	}
+	if d.Permission != "" {
+		s += " permission=" + strconv.QuoteToASCII(d.Permission)
+	}
+	if d.Username != "" {
+		s += " user=" + strconv.QuoteToASCII(d.Username)
+	}
+	if !d.Allowed {
+		s += " reason=" + d.Reason.String()
+	}
+	return s
+}
+
+// SetDebug can be used for explaining every decision that the middleware
+// makes, both in the log and in the X-Permissions-Decision response header.
+// This should only be enabled when developing, since it reveals the rules.
+func (perm *Permissions) SetDebug(debug bool) {
+	perm.update(func(rules *ruleSet) {
+		rules.debug = debug
+	})
+}
+
+// decide makes a decision for the given request with the given rules, and
+// explains it if debugging is enabled
+func (perm *Permissions) decide(rules *ruleSet, w http.ResponseWriter, req *http.Request) Decision {
+	d := perm.decideWith(rules, req)
+	explain(rules, w, req, d)
+	return d
+}
+
+// explain explains the given decision in the log and in a response header,
+// if debugging is enabled
+func explain(rules *ruleSet, w http.ResponseWriter, req *http.Request, d Decision) {
+	if rules.debug {
+		w.Header().Set(DecisionHeader, d.String())
+		log.Printf("permissions: %s %s", req.Method, d)
+	}
+}
@@ -0,0 +1,147 @@
+package permissions
+
+import (
+	"context"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// deletedKey is the prefix of the Redis keys that are tombstones for deleted
+// users, "deleted:" + a hash of the username. A tombstone expires by itself.
+const deletedKey = "deleted"
+
+// deletedUserKey returns the Redis key for the tombstone of the given user.
+// The username is hashed with the pseudonym secret, so that the tombstone
+// does not keep it, and so that a guessed username can not be checked
+// against the tombstones without the secret.
+func (state *UserState) deletedUserKey(ctx context.Context, username string) (string, error) {
+	sum, err := state.keyedHash(ctx, "deleted:"+username)
+	if err != nil {
+		return "", err
+	}
+	return deletedKey + ":" + hex.EncodeToString(sum), nil
+}
+
+// deleteUserScript removes everything that is stored for a user, including
+// the aliases from the earlier usernames, if the user has been renamed, and
+// the pending password reset and magic link codes, and leaves a tombstone
+// that expires after the given number of milliseconds, if it is not 0.
+// Returns "changed" if the e-mail address, the earlier usernames or the codes
+// of the user are not the given ones, since the keys are then out of date.
+//
+// The number of keys is given first, since the user may have several aliases.
+//
+// KEYS: usernames, users:<username>, unconfirmed, emails, deleted:<hash of username>, skeletons, passwordResetCode:<hash>, magicLinkCode:<hash>, alias:<earlier username>...
+// ARGV: username, e-mail address, e-mail index key, tombstone lifetime, deletion time, aliases field, skeleton of username, hash of password reset code, hash of magic link code
+var deleteUserScript = redis.NewScript(-1, `
+if (redis.call("HGET", KEYS[2], "email") or "") ~= ARGV[2] or (redis.call("HGET", KEYS[2], "aliases") or "") ~= ARGV[6] then
+	return "changed"
+end
+if (redis.call("HGET", KEYS[2], "passwordResetCode") or "") ~= ARGV[8] or (redis.call("HGET", KEYS[2], "magicLinkCode") or "") ~= ARGV[9] then
+	return "changed"
+end
+for i = 9, #KEYS do
+	if redis.call("GET", KEYS[i]) == ARGV[1] then
+		redis.call("DEL", KEYS[i])
+	end
+end
+-- The codes may still have an earlier username, if the user has been renamed
+if ARGV[8] ~= "" then
+	redis.call("DEL", KEYS[7])
+end
+if ARGV[9] ~= "" then
+	redis.call("DEL", KEYS[8])
+end
+local existed = redis.call("SREM", KEYS[1], ARGV[1]) + redis.call("DEL", KEYS[2])
+redis.call("SREM", KEYS[3], ARGV[1])
+if ARGV[3] ~= "" and redis.call("HGET", KEYS[4], ARGV[3]) == ARGV[1] then
+	redis.call("HDEL", KEYS[4], ARGV[3])
+end
+if redis.call("HGET", KEYS[6], ARGV[7]) == ARGV[1] then
+	redis.call("HDEL", KEYS[6], ARGV[7])
+end
+if existed == 0 then
+	return "missing"
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call("SET", KEYS[5], ARGV[5], "PX", ARGV[4])
+end
+return "ok"
+`)
+
+// SetTombstoneLifetime sets for how long the username of a deleted user can
+// not be used by CreateUser. The default is 24 hours, and 0 lets the username
+// be used again right away.
+func (state *UserState) SetTombstoneLifetime(lifetime time.Duration) {
+	state.tombstoneLifetime = lifetime
+}
+
+// DeleteUser removes the user and everything that is stored for the user,
+// in one atomic operation: all the fields, like the password hash, the
+// e-mail address, the admin status, tokens and codes, the pending password
+// reset and magic link codes, the entries in the list of unconfirmed users
+// and in the e-mail index, and the aliases of the earlier usernames, if the
+// user has been renamed. The user is logged out
+// everywhere. Returns ErrNotFound if there is nothing to remove.
+//
+// Unlike RemoveUser, that only removes the username and the login status, no
+// fields are left behind for a new user with the same username. The username
+// can not be used by CreateUser until the tombstone lifetime has passed.
+func (state *UserState) DeleteUser(ctx context.Context, username string) error {
+	return state.deleteUser(ctx, username, state.tombstoneLifetime)
+}
+
+// DiscardUser removes the user and everything that is stored for the user,
+// like DeleteUser, but leaves no tombstone, so that the username can be used
+// again right away. This is for undoing CreateUser, for instance if the
+// confirmation e-mail could not be sent. Returns ErrNotFound if there is
+// nothing to remove.
+func (state *UserState) DiscardUser(ctx context.Context, username string) error {
+	return state.deleteUser(ctx, username, 0)
+}
+
+// deleteUser removes the user and everything that is stored for the user,
+// and leaves a tombstone with the given lifetime, if it is not 0
+func (state *UserState) deleteUser(ctx context.Context, username string, tombstoneLifetime time.Duration) error {
+	tombstoneKey, err := state.deletedUserKey(ctx, username)
+	if err != nil {
+		return err
+	}
+	for {
+		u, err := state.readRenamedUser(ctx, username)
+		if err != nil {
+			return err
+		}
+		keys := append([]any{8 + len(u.aliases),
+			usernamesKey, userKey(username), unconfirmedKey, emailsKey, tombstoneKey, skeletonsKey,
+			"passwordResetCode:" + u.passwordResetCode, "magicLinkCode:" + u.magicLinkCode}, u.aliasKeys()...)
+		result, err := redis.String(state.script(ctx, deleteUserScript, append(keys,
+			username, u.email, emailIndexKey(u.email), tombstoneLifetime.Milliseconds(), strconv.FormatInt(time.Now().Unix(), 10),
+			u.aliasesField, skeleton(username), u.passwordResetCode, u.magicLinkCode)...))
+		if err != nil {
+			return err
+		}
+		switch result {
+		case "changed":
+			// The user was changed right before it was deleted
+			continue
+		case "missing":
+			return ErrNotFound
+		}
+		state.invalidateUser(username, true)
+		return nil
+	}
+}
+
+// IsDeletedContext checks if the given user was deleted recently, and the
+// username can not be used by CreateUser yet.
+func (state *UserState) IsDeletedContext(ctx context.Context, username string) (bool, error) {
+	key, err := state.deletedUserKey(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	return redis.Bool(state.do(ctx, "EXISTS", key))
+}
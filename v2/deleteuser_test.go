@@ -0,0 +1,63 @@
+package permissions
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	userstate.SetTombstoneLifetime(3 * time.Second)
+	if err := userstate.CreateUser(ctx, "bob", "hunter1", "bob@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// Leave no tombstone for the other tests
+		userstate.SetTombstoneLifetime(0)
+		userstate.DeleteUser(ctx, "bob")
+	}()
+	userstate.SetAdminStatus("bob")
+	userstate.SetToken("bob", "abc123", time.Minute)
+	userstate.AddUnconfirmed("bob", "abc123")
+	userstate.SetLoggedIn("bob")
+
+	if err := userstate.DeleteUser(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if properties, err := userstate.PropertiesContext(ctx, "bob"); err != nil || len(properties) != 0 {
+		t.Error("Error, all the fields of bob should have been removed, got", properties, err)
+	}
+	if userstate.HasUser("bob") || userstate.IsLoggedIn("bob") {
+		t.Error("Error, bob should no longer exist or be logged in")
+	}
+	if unconfirmed, _ := userstate.AllUnconfirmedUsernames(); slices.Contains(unconfirmed, "bob") {
+		t.Error("Error, bob should no longer be unconfirmed")
+	}
+	if _, err := userstate.HasEmail("bob@zombo.com"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+	if err := userstate.DeleteUser(ctx, "bob"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+
+	// The username can not be used again until the tombstone expires, and the new user does not get the old fields
+	if deleted, err := userstate.IsDeletedContext(ctx, "bob"); err != nil || !deleted {
+		t.Error("Error, bob should have a tombstone:", err)
+	}
+	if err := userstate.CreateUser(ctx, "bob", "hunter2", "bob@zombo.com"); err != ErrUserExists {
+		t.Error("Error, expected ErrUserExists, got", err)
+	}
+	waitFor(t, "the tombstone to expire", func() bool {
+		deleted, err := userstate.IsDeletedContext(ctx, "bob")
+		return err == nil && !deleted
+	})
+	if err := userstate.CreateUser(ctx, "bob", "hunter2", "bob@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	if userstate.IsAdmin("bob") {
+		t.Error("Error, the new bob should not be an admin")
+	}
+}
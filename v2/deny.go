@@ -0,0 +1,194 @@
+package permissions
+
+import (
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Reason is why a request is rejected
+type Reason int
+
+// The reasons for rejecting a request
+const (
+	ReasonNone            Reason = iota // the request is not rejected
+	ReasonUnauthenticated               // the visitor is not logged in
+	ReasonForbidden                     // the user is logged in, but lacks the required rights
+	ReasonLocked                        // the user is locked out
+	ReasonUnconfirmed                   // the user has not been confirmed yet
+	ReasonDisabled                      // the user has been suspended
+	ReasonExpired                       // the expiry time of the user has passed
+)
+
+// String returns the reason code, like "unauthenticated" or "forbidden"
+func (r Reason) String() string {
+	switch r {
+	case ReasonNone:
+		return "none"
+	case ReasonUnauthenticated:
+		return "unauthenticated"
+	case ReasonForbidden:
+		return "forbidden"
+	case ReasonLocked:
+		return "locked"
+	case ReasonUnconfirmed:
+		return "unconfirmed"
+	case ReasonDisabled:
+		return "disabled"
+	case ReasonExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// detail returns a human readable description of the reason
+func (r Reason) detail() string {
+	switch r {
+	case ReasonUnauthenticated:
+		return "You need to log in to access this page."
+	case ReasonLocked:
+		return "This account is locked."
+	case ReasonUnconfirmed:
+		return "This account has not been confirmed yet."
+	case ReasonDisabled:
+		return "This account has been suspended."
+	case ReasonExpired:
+		return "This account has expired."
+	}
+	return "You do not have the rights to access this page."
+}
+
+// reasonKey is the context key for the reason a request was rejected
+type reasonKey struct{}
+
+// ReasonFromRequest returns why the given request was rejected, for use in
+// deny functions. Returns ReasonForbidden if the reason is not known.
+func ReasonFromRequest(req *http.Request) Reason {
+	if r, ok := req.Context().Value(reasonKey{}).(Reason); ok && r != ReasonNone {
+		return r
+	}
+	return ReasonForbidden
+}
+
+// Problem is a RFC 9457 problem details object, for rejected requests
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+var deniedPage = template.Must(template.New("denied").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+</body>
+</html>
+`))
+
+// PermissionDenied is the default "permission denied" http handler.
+// It responds with 403 Forbidden, as application/problem+json for clients
+// that ask for JSON, as HTML for browsers and as plain text for everyone else.
+func PermissionDenied(w http.ResponseWriter, req *http.Request) {
+	writeDenial(w, req, http.StatusForbidden, ReasonFromRequest(req))
+}
+
+// SetReasonDenyFunction can be used for specifying a http.HandlerFunc that
+// will be used when requests are rejected for the given reason, instead of
+// the function given to SetDenyFunction, or the redirect to the login page.
+// Give nil to remove it again.
+func (perm *Permissions) SetReasonDenyFunction(r Reason, f http.HandlerFunc) {
+	perm.update(func(rules *ruleSet) {
+		if f == nil {
+			delete(rules.reasonDenied, r)
+			return
+		}
+		if rules.reasonDenied == nil {
+			rules.reasonDenied = make(map[Reason]http.HandlerFunc)
+		}
+		rules.reasonDenied[r] = f
+	})
+}
+
+// writeDenial writes a response for a rejected request, in the format the client prefers
+func writeDenial(w http.ResponseWriter, req *http.Request, status int, r Reason) {
+	problem := &Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   r.detail(),
+		Instance: req.URL.Path,
+		Reason:   r.String(),
+	}
+	w.Header().Set("Vary", "Accept")
+	switch negotiate(req.Header.Get("Accept"), "text/plain", "text/html", "application/problem+json", "application/json") {
+	case "application/problem+json", "application/json":
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(problem)
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		deniedPage.Execute(w, problem)
+	default:
+		http.Error(w, "Permission denied.", status)
+	}
+}
+
+// negotiate returns the offered media type that the Accept header prefers.
+// If several offers are equally preferred, the first one is returned.
+func negotiate(accept string, offers ...string) string {
+	best, bestQ, bestSpecificity := offers[0], -1.0, -1
+	for _, offer := range offers {
+		q, specificity := acceptQuality(accept, offer)
+		if q > bestQ || (q == bestQ && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality value for the given media type, from the
+// most specific matching media range in the Accept header, and how specific
+// that range is (0 for */*, 1 for type/*, 2 for type/subtype)
+func acceptQuality(accept, offer string) (float64, int) {
+	if strings.TrimSpace(accept) == "" {
+		return 1, 0
+	}
+	offerType, offerSubtype, _ := strings.Cut(offer, "/")
+	q, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		rangeType, rangeSubtype, _ := strings.Cut(mediaType, "/")
+		s := -1
+		switch {
+		case rangeType == offerType && rangeSubtype == offerSubtype:
+			s = 2
+		case rangeType == offerType && rangeSubtype == "*":
+			s = 1
+		case rangeType == "*" && rangeSubtype == "*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return q, specificity
+}
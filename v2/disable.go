@@ -0,0 +1,174 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// disabled checks if the user has been disabled, like IsDisabled
+func (u *userRecord) disabled() bool {
+	return u.fields["disabled"] == "true"
+}
+
+// expired checks if the expiry time of the user has passed, like IsExpired
+func (u *userRecord) expired() bool {
+	unixTime, err := strconv.ParseInt(u.fields["expiresAt"], 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Unix() >= unixTime
+}
+
+// setFieldsScript sets fields of a user that exists, and removes the fields
+// that are given blank values. Returns 0 if the user does not exist.
+//
+// KEYS: usernames, users:<username>
+// ARGV: username, then field names and values
+var setFieldsScript = redis.NewScript(2, `
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+for i = 2, #ARGV, 2 do
+	if ARGV[i + 1] == "" then
+		redis.call("HDEL", KEYS[2], ARGV[i])
+	else
+		redis.call("HSET", KEYS[2], ARGV[i], ARGV[i + 1])
+	end
+end
+return 1
+`)
+
+// setUserFields sets the given fields of the given user in one atomic
+// operation, like setField, and removes the fields that are given blank
+// values. Returns ErrNotFound, and changes nothing, if the user does not exist.
+func (state *UserState) setUserFields(ctx context.Context, username string, fieldsAndValues ...string) error {
+	keysAndArgs := []any{usernamesKey, userKey(username), username}
+	wait := false
+	for i := 0; i+1 < len(fieldsAndValues); i += 2 {
+		keysAndArgs = append(keysAndArgs, fieldsAndValues[i], fieldsAndValues[i+1])
+		wait = wait || revokes(fieldsAndValues[i], fieldsAndValues[i+1])
+	}
+	found, err := redis.Bool(state.script(ctx, setFieldsScript, keysAndArgs...))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	state.invalidateUser(username, wait)
+	return nil
+}
+
+// DisableContext suspends the given user, until EnableContext is called, and
+// logs the user out everywhere. The reason is stored with the user, and can
+// be retrieved with DisabledReasonContext. Returns ErrNotFound if the user
+// does not exist.
+func (state *UserState) DisableContext(ctx context.Context, username, reason string) error {
+	return state.setUserFields(ctx, username,
+		"disabled", "true",
+		"disabledReason", reason,
+		"loggedin", "false")
+}
+
+// EnableContext lifts the suspension of the given user. The user needs to
+// log in again. Returns ErrNotFound if the user does not exist.
+func (state *UserState) EnableContext(ctx context.Context, username string) error {
+	return state.setUserFields(ctx, username, "disabled", "", "disabledReason", "")
+}
+
+// IsDisabledContext checks if the given user has been suspended.
+func (state *UserState) IsDisabledContext(ctx context.Context, username string) (bool, error) {
+	disabled, err := state.field(ctx, username, "disabled")
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return disabled == "true", err
+}
+
+// DisabledReasonContext returns why the given user was suspended, or
+// ErrNotFound if the user is not suspended.
+func (state *UserState) DisabledReasonContext(ctx context.Context, username string) (string, error) {
+	if disabled, err := state.IsDisabledContext(ctx, username); err != nil || !disabled {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return "", err
+	}
+	return state.field(ctx, username, "disabledReason")
+}
+
+// SetExpiryContext sets when the given user expires, for instance for an
+// account that is only needed for a while. Expired users are rejected, like
+// suspended users. A zero time removes the expiry time. Returns ErrNotFound
+// if the user does not exist.
+func (state *UserState) SetExpiryContext(ctx context.Context, username string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		return state.setUserFields(ctx, username, "expiresAt", "")
+	}
+	return state.setUserFields(ctx, username, "expiresAt", strconv.FormatInt(expiresAt.Unix(), 10))
+}
+
+// ExpiryContext returns when the given user expires, or ErrNotFound if the
+// user has no expiry time.
+func (state *UserState) ExpiryContext(ctx context.Context, username string) (time.Time, error) {
+	expiresAt, err := state.field(ctx, username, "expiresAt")
+	if err != nil {
+		return time.Time{}, err
+	}
+	unixTime, err := strconv.ParseInt(expiresAt, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unixTime, 0), nil
+}
+
+// IsExpiredContext checks if the expiry time of the given user has passed.
+func (state *UserState) IsExpiredContext(ctx context.Context, username string) (bool, error) {
+	expiresAt, err := state.field(ctx, username, "expiresAt")
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return (&userRecord{fields: map[string]string{"expiresAt": expiresAt}}).expired(), nil
+}
+
+// Disable suspends the given user, until Enable is called, and logs the
+// user out everywhere. The reason is stored with the user.
+func (state *UserState) Disable(username, reason string) {
+	state.DisableContext(context.Background(), username, reason)
+}
+
+// Enable lifts the suspension of the given user.
+func (state *UserState) Enable(username string) {
+	state.EnableContext(context.Background(), username)
+}
+
+// IsDisabled checks if the given user has been suspended.
+func (state *UserState) IsDisabled(username string) bool {
+	disabled, _ := state.IsDisabledContext(context.Background(), username)
+	return disabled
+}
+
+// DisabledReason returns why the given user was suspended, or an empty
+// string if the user is not suspended.
+func (state *UserState) DisabledReason(username string) string {
+	reason, _ := state.DisabledReasonContext(context.Background(), username)
+	return reason
+}
+
+// SetExpiry sets when the given user expires. A zero time removes the expiry time.
+func (state *UserState) SetExpiry(username string, expiresAt time.Time) {
+	state.SetExpiryContext(context.Background(), username, expiresAt)
+}
+
+// IsExpired checks if the expiry time of the given user has passed.
+func (state *UserState) IsExpired(username string) bool {
+	expired, _ := state.IsExpiredContext(context.Background(), username)
+	return expired
+}
@@ -0,0 +1,100 @@
+package permissions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestDisable(t *testing.T) {
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	cookies := loginCookies(t, userstate, "bob")
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/data", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		return req
+	}
+
+	// Suspending a user logs the user out
+	userstate.Disable("bob", "unpaid invoice")
+	defer userstate.Enable("bob")
+	if !userstate.IsDisabled("bob") || userstate.DisabledReason("bob") != "unpaid invoice" {
+		t.Error("Error, bob should be disabled, because of an unpaid invoice")
+	}
+	if userstate.IsLoggedIn("bob") || userstate.UserRights(request()) {
+		t.Error("Error, bob should have been logged out")
+	}
+
+	// A suspended user that logs in again is rejected with a distinct reason
+	userstate.SetLoggedIn("bob")
+	if r := perm.RejectReason(request()); r != ReasonDisabled {
+		t.Error("Error, bob should be disabled, not", r)
+	}
+	if userstate.UserRights(request()) {
+		t.Error("Error, a disabled user should not have user rights")
+	}
+	userstate.Enable("bob")
+	if userstate.IsDisabled("bob") || userstate.DisabledReason("bob") != "" {
+		t.Error("Error, bob should no longer be disabled")
+	}
+	if r := perm.RejectReason(request()); r != ReasonNone || !userstate.UserRights(request()) {
+		t.Error("Error, bob should be allowed to visit /data when enabled, not", r)
+	}
+
+	// Users are rejected when the expiry time has passed
+	userstate.SetExpiry("bob", time.Now().Add(time.Hour))
+	defer userstate.SetExpiry("bob", time.Time{})
+	if userstate.IsExpired("bob") || perm.RejectReason(request()) != ReasonNone {
+		t.Error("Error, bob should not have expired yet")
+	}
+	userstate.SetAdminStatus("bob")
+	defer userstate.RemoveAdminStatus("bob")
+	userstate.SetExpiry("bob", time.Now().Add(-time.Minute))
+	if !userstate.IsExpired("bob") {
+		t.Error("Error, bob should have expired")
+	}
+	if r := perm.RejectReason(request()); r != ReasonExpired {
+		t.Error("Error, bob should be expired, not", r)
+	}
+	if userstate.UserRights(request()) || userstate.AdminRights(request()) {
+		t.Error("Error, an expired user should have no rights")
+	}
+	userstate.SetExpiry("bob", time.Time{})
+	if userstate.IsExpired("bob") || !userstate.AdminRights(request()) {
+		t.Error("Error, bob should no longer be expired")
+	}
+
+	// Locked users have no rights either
+	userstate.Lock("bob", time.Minute)
+	if userstate.UserRights(request()) || userstate.AdminRights(request()) {
+		t.Error("Error, a locked user should have no rights")
+	}
+	userstate.Unlock("bob")
+	if !userstate.AdminRights(request()) {
+		t.Error("Error, bob should no longer be locked")
+	}
+
+	// Users that do not exist are not created
+	ctx := context.Background()
+	if err := userstate.DisableContext(ctx, "nobody", "spam"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+	if err := userstate.SetExpiryContext(ctx, "nobody", time.Now()); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+	if err := userstate.EnableContext(ctx, "nobody"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+	if exists, err := redis.Bool(userstate.do(ctx, "EXISTS", userKey("nobody"))); err != nil || exists {
+		t.Error("Error, no fields should have been stored for a user that does not exist")
+	}
+}
@@ -0,0 +1,470 @@
+package permissions
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	htmltemplate "html/template"
+	"net/url"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// The kinds of e-mail that are sent by the UserState flows
+const (
+	ConfirmationEmail  = "confirmation"
+	PasswordResetEmail = "passwordreset"
+	MagicLinkEmail     = "magiclink"
+	SecurityAlertEmail = "securityalert"
+)
+
+var (
+	// ErrInvalidCode is returned if a password reset code or magic link code is invalid or has expired
+	ErrInvalidCode = errors.New("the code is invalid or has expired")
+
+	// ErrUnknownEmailKind is returned if there is no e-mail template for the given kind of e-mail
+	ErrUnknownEmailKind = errors.New("unknown kind of e-mail")
+)
+
+// EmailData is the data that is available when rendering e-mail templates.
+type EmailData struct {
+	SiteName string
+	SiteURL  string
+	Username string
+	Email    string
+	URL      string        // the link the user should visit, if any
+	Code     string        // the confirmation, password reset or magic link code, if any
+	Expires  time.Duration // for how long the code is valid, if it expires
+	Event    string        // what happened, for security alerts
+	Time     time.Time
+}
+
+// EmailTemplate is the template source for one kind of e-mail.
+// Subject and Text are text/template templates, HTML is a html/template
+// template. HTML may be blank, for sending plain text e-mail only.
+type EmailTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// emailTemplate is a parsed EmailTemplate
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// EmailTemplates is a collection of templates for the different kinds of e-mail.
+type EmailTemplates struct {
+	templates map[string]*emailTemplate
+	mut       sync.RWMutex
+}
+
+// defaultEmailTemplates are the built-in templates, per kind of e-mail
+var defaultEmailTemplates = map[string]EmailTemplate{
+	ConfirmationEmail: {
+		Subject: "Please confirm your account at {{.SiteName}}",
+		Text: `Hi {{.Username}},
+
+Thank you for registering at {{.SiteName}}. Please confirm your e-mail address by visiting this link:
+
+{{.URL}}
+
+If you did not register, you can safely ignore this e-mail.
+`,
+		HTML: `<p>Hi {{.Username}},</p>
+<p>Thank you for registering at {{.SiteName}}. Please confirm your e-mail address by visiting this link:</p>
+<p><a href="{{.URL}}">Confirm my account</a></p>
+<p>If you did not register, you can safely ignore this e-mail.</p>
+`,
+	},
+	PasswordResetEmail: {
+		Subject: "Reset your password at {{.SiteName}}",
+		Text: `Hi {{.Username}},
+
+Someone asked to reset the password for your account at {{.SiteName}}. To choose a new password, visit this link within {{.Expires}}:
+
+{{.URL}}
+
+If you did not ask for this, you can safely ignore this e-mail. Your password has not been changed.
+`,
+		HTML: `<p>Hi {{.Username}},</p>
+<p>Someone asked to reset the password for your account at {{.SiteName}}. To choose a new password, visit this link within {{.Expires}}:</p>
+<p><a href="{{.URL}}">Reset my password</a></p>
+<p>If you did not ask for this, you can safely ignore this e-mail. Your password has not been changed.</p>
+`,
+	},
+	MagicLinkEmail: {
+		Subject: "Your login link for {{.SiteName}}",
+		Text: `Hi {{.Username}},
+
+Visit this link within {{.Expires}} to log in to {{.SiteName}}:
+
+{{.URL}}
+
+If you did not ask for this, you can safely ignore this e-mail.
+`,
+		HTML: `<p>Hi {{.Username}},</p>
+<p>Visit this link within {{.Expires}} to log in to {{.SiteName}}:</p>
+<p><a href="{{.URL}}">Log in</a></p>
+<p>If you did not ask for this, you can safely ignore this e-mail.</p>
+`,
+	},
+	SecurityAlertEmail: {
+		Subject: "Security alert for your account at {{.SiteName}}",
+		Text: `Hi {{.Username}},
+
+This is a notification about your account at {{.SiteName}}:
+
+{{.Event}} ({{.Time.Format "2006-01-02 15:04:05 MST"}})
+
+If this was not you, please contact us right away.
+`,
+		HTML: `<p>Hi {{.Username}},</p>
+<p>This is a notification about your account at {{.SiteName}}:</p>
+<p><strong>{{.Event}}</strong> ({{.Time.Format "2006-01-02 15:04:05 MST"}})</p>
+<p>If this was not you, please contact us right away.</p>
+`,
+	},
+}
+
+// NewEmailTemplates creates a collection of e-mail templates, with the
+// built-in templates for confirmation, password reset, magic link and
+// security alert e-mails.
+func NewEmailTemplates() *EmailTemplates {
+	et := &EmailTemplates{templates: make(map[string]*emailTemplate)}
+	for kind, t := range defaultEmailTemplates {
+		if err := et.Set(kind, t); err != nil {
+			panic("Permissions: could not parse the built-in e-mail templates: " + err.Error())
+		}
+	}
+	return et
+}
+
+// Set parses and stores the template for the given kind of e-mail,
+// replacing any previous template.
+func (et *EmailTemplates) Set(kind string, t EmailTemplate) error {
+	var (
+		parsed emailTemplate
+		err    error
+	)
+	if parsed.subject, err = texttemplate.New(kind + " subject").Parse(t.Subject); err != nil {
+		return err
+	}
+	if parsed.text, err = texttemplate.New(kind + " text").Parse(t.Text); err != nil {
+		return err
+	}
+	if t.HTML != "" {
+		if parsed.html, err = htmltemplate.New(kind + " html").Parse(t.HTML); err != nil {
+			return err
+		}
+	}
+	et.mut.Lock()
+	et.templates[kind] = &parsed
+	et.mut.Unlock()
+	return nil
+}
+
+// Render renders the e-mail template of the given kind into a message.
+// The recipient is taken from data.Email.
+func (et *EmailTemplates) Render(kind string, data *EmailData) (*Message, error) {
+	et.mut.RLock()
+	t, ok := et.templates[kind]
+	et.mut.RUnlock()
+	if !ok {
+		return nil, ErrUnknownEmailKind
+	}
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if t.html != nil {
+		if err := t.html.Execute(&html, data); err != nil {
+			return nil, err
+		}
+	}
+	return &Message{
+		To:      []string{data.Email},
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// SetMailer sets the Mailer that is used for sending e-mails to users.
+func (state *UserState) SetMailer(mailer Mailer) {
+	state.mailer = mailer
+}
+
+// Mailer returns the current Mailer, or nil if no Mailer has been set.
+func (state *UserState) Mailer() Mailer {
+	return state.mailer
+}
+
+// SetEmailTemplates sets the templates that are used for the e-mails to users.
+func (state *UserState) SetEmailTemplates(templates *EmailTemplates) {
+	state.emailTemplates = templates
+}
+
+// EmailTemplates returns the templates that are used for the e-mails to users.
+func (state *UserState) EmailTemplates() *EmailTemplates {
+	return state.emailTemplates
+}
+
+// SetSite sets the site name and the base URL (like "https://example.com")
+// that are used in the e-mails to users.
+func (state *UserState) SetSite(name, baseURL string) {
+	state.siteName = name
+	state.siteURL = strings.TrimSuffix(baseURL, "/")
+}
+
+// SetCodeLifetimes sets for how long password reset codes and magic link
+// codes are valid. The defaults are 1 hour and 15 minutes.
+func (state *UserState) SetCodeLifetimes(passwordReset, magicLink time.Duration) {
+	state.passwordResetLifetime = passwordReset
+	state.magicLinkLifetime = magicLink
+}
+
+// sendEmail renders and sends an e-mail of the given kind to the given user
+func (state *UserState) sendEmail(kind, username string, data *EmailData) error {
+	if state.mailer == nil {
+		return ErrNoMailer
+	}
+	email, err := state.Email(username)
+	if err != nil {
+		return err
+	}
+	data.SiteName = state.siteName
+	data.SiteURL = state.siteURL
+	data.Username = username
+	data.Email = email
+	if data.Time.IsZero() {
+		data.Time = time.Now()
+	}
+	msg, err := state.emailTemplates.Render(kind, data)
+	if err != nil {
+		return err
+	}
+	return state.mailer.Send(msg)
+}
+
+// siteLink returns a link to the given path on the site, with the given code
+func (state *UserState) siteLink(path, code string) string {
+	return state.siteURL + path + "?code=" + url.QueryEscape(code)
+}
+
+// SendConfirmationEmail generates a unique confirmation code for the given
+// user, adds the user to the list of unconfirmed users and sends an e-mail
+// with a link to /confirm?code=... on the site.
+func (state *UserState) SendConfirmationEmail(username string) error {
+	if state.mailer == nil {
+		return ErrNoMailer
+	}
+	confirmationCode, err := state.GenerateUniqueConfirmationCode()
+	if err != nil {
+		return err
+	}
+	state.AddUnconfirmed(username, confirmationCode)
+	return state.sendEmail(ConfirmationEmail, username, &EmailData{
+		URL:  state.siteLink("/confirm", confirmationCode),
+		Code: confirmationCode,
+	})
+}
+
+// codeKey returns the Redis key for a code of the given kind, like
+// "passwordResetCode". Only a hash of the code is stored, so that the codes
+// that are sent by e-mail can not be read from Redis.
+func codeKey(fieldname, code string) (string, string) {
+	sum := sha256.Sum256([]byte(code))
+	hash := hex.EncodeToString(sum[:])
+	return fieldname + ":" + hash, hash
+}
+
+// setCodeScript stores a code for a user that exists, and removes the
+// previous code of the same kind. The hash of the code is also stored in the
+// given field of the user, so that the code only works for this user.
+// Returns "changed" if the previous code has been replaced meanwhile.
+//
+// KEYS: usernames, users:<username>, the key of the new code, the key of the previous code
+// ARGV: username, field name, hash of the new code, hash of the previous code, lifetime in milliseconds
+var setCodeScript = redis.NewScript(4, `
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 0 then
+	return "user"
+end
+if (redis.call("HGET", KEYS[2], ARGV[2]) or "") ~= ARGV[4] then
+	return "changed"
+end
+if ARGV[4] ~= "" then
+	redis.call("DEL", KEYS[4])
+end
+redis.call("SET", KEYS[3], ARGV[1], "PX", ARGV[5])
+redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+redis.call("HDEL", KEYS[2], ARGV[2] .. "Expires")
+return "ok"
+`)
+
+// useCodeScript removes a code, and returns "ok" if it belongs to the given
+// user, who still exists and has not been sent a newer code of the same kind.
+//
+// KEYS: usernames, users:<username>, the key of the code
+// ARGV: username, field name, hash of the code
+var useCodeScript = redis.NewScript(3, `
+if redis.call("GET", KEYS[3]) ~= ARGV[1] then
+	return "invalid"
+end
+redis.call("DEL", KEYS[3])
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 0 or redis.call("HGET", KEYS[2], ARGV[2]) ~= ARGV[3] then
+	return "invalid"
+end
+redis.call("HDEL", KEYS[2], ARGV[2])
+return "ok"
+`)
+
+// setCode stores a code that expires after the given lifetime, for the given
+// user and field name, and returns the code. A previous code of the same kind
+// stops working.
+func (state *UserState) setCode(ctx context.Context, username, fieldname string, lifetime time.Duration) (string, error) {
+	code := randomToken(24)
+	key, hash := codeKey(fieldname, code)
+	for {
+		previous, err := redis.String(state.do(ctx, "HGET", userKey(username), fieldname))
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			return "", err
+		}
+		result, err := redis.String(state.script(ctx, setCodeScript,
+			usernamesKey, userKey(username), key, fieldname+":"+previous,
+			username, fieldname, hash, previous, max(lifetime.Milliseconds(), 1)))
+		if err != nil {
+			return "", err
+		}
+		switch result {
+		case "changed":
+			continue
+		case "user":
+			return "", ErrNotFound
+		}
+		return code, nil
+	}
+}
+
+// useCode finds the user that has been sent the given code of the given
+// kind, then removes the code, in one atomic operation. Returns
+// ErrInvalidCode if the code has expired or has been used already, or if the
+// user has been deleted or renamed since.
+func (state *UserState) useCode(ctx context.Context, fieldname, code string) (string, error) {
+	if code == "" {
+		return "", ErrInvalidCode
+	}
+	key, hash := codeKey(fieldname, code)
+	username, err := redis.String(state.do(ctx, "GET", key))
+	if errors.Is(err, redis.ErrNil) {
+		return "", ErrInvalidCode
+	} else if err != nil {
+		return "", err
+	}
+	result, err := redis.String(state.script(ctx, useCodeScript,
+		usernamesKey, userKey(username), key,
+		username, fieldname, hash))
+	if err != nil {
+		return "", err
+	}
+	if result != "ok" {
+		return "", ErrInvalidCode
+	}
+	state.invalidateUser(username, false)
+	return username, nil
+}
+
+// RequestPasswordReset finds the user with the given e-mail address and
+// sends an e-mail with a link to /reset?code=... on the site.
+// Returns ErrNotFound if no user has the given e-mail address.
+func (state *UserState) RequestPasswordReset(email string) error {
+	if state.mailer == nil {
+		return ErrNoMailer
+	}
+	username, err := state.HasEmail(email)
+	if err != nil {
+		return err
+	}
+	code, err := state.setCode(context.Background(), username, "passwordResetCode", state.passwordResetLifetime)
+	if err != nil {
+		return err
+	}
+	return state.sendEmail(PasswordResetEmail, username, &EmailData{
+		URL:     state.siteLink("/reset", code),
+		Code:    code,
+		Expires: state.passwordResetLifetime,
+	})
+}
+
+// ResetPassword sets a new password for the user that was sent the given
+// password reset code, and logs the user out, so that every existing login
+// of the user ends. The code can only be used once. If a Mailer is set,
+// a security alert is sent to the user afterwards, on a best effort basis.
+// Returns the username.
+func (state *UserState) ResetPassword(code, password string) (string, error) {
+	ctx := context.Background()
+	username, err := state.useCode(ctx, "passwordResetCode", code)
+	if err != nil {
+		return "", err
+	}
+	_, err = state.exec(ctx,
+		cmd("HSET", userKey(username), "password", state.HashPassword(username, password), "loggedin", "false"),
+		cmd("HDEL", userKey(username), "passwordUsername"),
+	)
+	state.invalidateUser(username, true)
+	if err != nil {
+		return "", err
+	}
+	if state.mailer != nil {
+		state.SendSecurityAlert(username, "Your password was reset.")
+	}
+	return username, nil
+}
+
+// SendMagicLink finds the user with the given e-mail address and sends an
+// e-mail with a link to /magic?code=... on the site, for logging in without
+// a password. The MagicLink handler in the handlers package serves /magic.
+// Returns ErrNotFound if no user has the given e-mail address.
+func (state *UserState) SendMagicLink(email string) error {
+	if state.mailer == nil {
+		return ErrNoMailer
+	}
+	username, err := state.HasEmail(email)
+	if err != nil {
+		return err
+	}
+	code, err := state.setCode(context.Background(), username, "magicLinkCode", state.magicLinkLifetime)
+	if err != nil {
+		return err
+	}
+	return state.sendEmail(MagicLinkEmail, username, &EmailData{
+		URL:     state.siteLink("/magic", code),
+		Code:    code,
+		Expires: state.magicLinkLifetime,
+	})
+}
+
+// UseMagicLink finds the user that was sent the given magic link code.
+// The code can only be used once. Call Login afterwards to log the user in.
+// Returns the username.
+func (state *UserState) UseMagicLink(code string) (string, error) {
+	return state.useCode(context.Background(), "magicLinkCode", code)
+}
+
+// SendSecurityAlert sends an e-mail to the given user, about the given event.
+func (state *UserState) SendSecurityAlert(username, event string) error {
+	return state.sendEmail(SecurityAlertEmail, username, &EmailData{
+		Event: event,
+	})
+}
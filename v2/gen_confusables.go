@@ -0,0 +1,104 @@
+//go:build ignore
+
+// This program generates confusables_table.go from the confusables.txt data
+// file of Unicode Technical Standard #39. Run it with "go generate", or with
+// "go run gen_confusables.go confusables.txt" for a local copy of the file.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const confusablesURL = "https://www.unicode.org/Public/security/latest/confusables.txt"
+
+// open opens the given file, or downloads confusables.txt if no file is given
+func open() (io.ReadCloser, error) {
+	if len(os.Args) > 1 {
+		return os.Open(os.Args[1])
+	}
+	resp, err := http.Get(confusablesURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not download %s: %s", confusablesURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// parseRunes parses code points like "0072 006E"
+func parseRunes(s string) ([]rune, error) {
+	var runes []rune
+	for _, field := range strings.Fields(s) {
+		r, err := strconv.ParseUint(field, 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		runes = append(runes, rune(r))
+	}
+	return runes, nil
+}
+
+func main() {
+	r, err := open()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer r.Close()
+
+	table := make(map[rune]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Split(line, ";")
+		if len(fields) < 3 {
+			continue
+		}
+		source, err := parseRunes(strings.TrimPrefix(fields[0], "\ufeff"))
+		if err != nil || len(source) != 1 {
+			log.Fatalf("invalid source in %q", scanner.Text())
+		}
+		target, err := parseRunes(fields[1])
+		if err != nil || len(target) == 0 {
+			log.Fatalf("invalid target in %q", scanner.Text())
+		}
+		table[source[0]] = string(target)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by go run gen_confusables.go; DO NOT EDIT.\n\n")
+	buf.WriteString("package permissions\n\n")
+	buf.WriteString("// confusables maps characters to the characters that they can be confused\n")
+	buf.WriteString("// with, from confusables.txt of Unicode Technical Standard #39\n")
+	buf.WriteString("var confusables = map[rune]string{\n")
+	runes := make([]rune, 0, len(table))
+	for r := range table {
+		runes = append(runes, r)
+	}
+	slices.Sort(runes)
+	for _, r := range runes {
+		fmt.Fprintf(&buf, "%#04x: %+q,\n", r, table[r])
+	}
+	buf.WriteString("}\n")
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := os.WriteFile("confusables_table.go", source, 0o644); err != nil {
+		log.Fatalln(err)
+	}
+}
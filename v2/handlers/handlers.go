@@ -0,0 +1,793 @@
+// Package handlers provides ready-made HTTP handlers for registering users,
+// logging in and out, logging in with magic links, confirming users and
+// resetting passwords.
+//
+// All handlers accept both HTML forms and JSON bodies. JSON is returned if
+// the request body is JSON, or if the client asks for JSON in the Accept
+// header. Otherwise, HTML pages are rendered from templates that can be
+// replaced with SetTemplate.
+//
+// Forms must include the CSRF token from the page, in the "csrf_token"
+// field, which is checked against a cookie. JSON bodies need no token, since
+// browsers do not send them to other sites without asking first (CORS).
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/permissions2/v2"
+)
+
+var (
+	errMissingUsername    = errors.New("missing username")
+	errPasswordTooShort   = errors.New("the password is too short")
+	errPasswordMismatch   = errors.New("the passwords do not match")
+	errInvalidEmail       = errors.New("invalid e-mail address")
+	errUsernameTaken      = errors.New("the username is already taken")
+	errEmailTaken         = errors.New("the e-mail address is already in use")
+	errWrongPassword      = errors.New("wrong username or password")
+	errNotConfirmed       = errors.New("the user has not been confirmed yet")
+	errLocked             = errors.New("the account is locked, please try again later")
+	errDisabled           = errors.New("the account has been suspended")
+	errExpired            = errors.New("the account has expired")
+	errTooManyAttempts    = errors.New("too many failed login attempts, please try again later")
+	errMissingCode        = errors.New("missing code")
+	errInvalidCSRF        = errors.New("the form has expired, please try again")
+	errMethodNotAllowed   = errors.New("method not allowed")
+	errInvalidRequest     = errors.New("invalid request body")
+	errSomethingWentWrong = errors.New("something went wrong, please try again later")
+)
+
+// Handlers is a collection of HTTP handlers for registering users, logging
+// in and out, logging in with magic links, confirming users and resetting
+// passwords.
+type Handlers struct {
+	state     *permissions.UserState
+	templates *template.Template
+	settings  settings
+	mut       sync.RWMutex // Mutex for the templates and the settings
+}
+
+// settings are the settings of the handlers, that can be changed while
+// requests are being handled
+type settings struct {
+	throttle            *throttle
+	minPasswordLength   int
+	requireConfirmation bool
+	afterLogin          string
+	afterLogout         string
+	trustedProxies      []netip.Prefix
+}
+
+// New creates a collection of HTTP handlers that use the given UserState.
+// By default, passwords must be at least 8 characters long, users must be
+// confirmed before they can log in and 5 failed login attempts within 15
+// minutes will block further attempts for that username or IP address.
+func New(state *permissions.UserState) *Handlers {
+	return &Handlers{
+		state:     state,
+		templates: newDefaultTemplates(),
+		settings: settings{
+			throttle:            newThrottle(5, 15*time.Minute),
+			minPasswordLength:   8,
+			requireConfirmation: true,
+			afterLogin:          "/",
+			afterLogout:         "/",
+		},
+	}
+}
+
+// current returns the current settings
+func (h *Handlers) current() settings {
+	h.mut.RLock()
+	defer h.mut.RUnlock()
+	return h.settings
+}
+
+// SetTemplate replaces one of the templates (like LoginTemplate) with the
+// given html/template source. The "header" and "footer" templates can also
+// be replaced.
+func (h *Handlers) SetTemplate(name, source string) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	templates, err := h.templates.Clone()
+	if err != nil {
+		return err
+	}
+	if _, err := templates.New(name).Parse(source); err != nil {
+		return err
+	}
+	h.templates = templates
+	return nil
+}
+
+// SetMinPasswordLength sets the minimum password length, when registering
+// or resetting passwords.
+func (h *Handlers) SetMinPasswordLength(length int) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.settings.minPasswordLength = length
+}
+
+// SetRequireConfirmation can be used for letting users log in without
+// confirming their e-mail address first, by giving false.
+func (h *Handlers) SetRequireConfirmation(require bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.settings.requireConfirmation = require
+}
+
+// SetLoginThrottle sets how many failed login attempts are allowed within
+// the given time window, per username and per IP address. 0 disables it.
+func (h *Handlers) SetLoginThrottle(maxAttempts int, window time.Duration) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.settings.throttle = newThrottle(maxAttempts, window)
+}
+
+// SetTrustedProxies sets the IP addresses or CIDR ranges (like "10.0.0.0/8")
+// of the reverse proxies in front of the server. For requests from a trusted
+// proxy, the login throttle uses the client IP address from the
+// X-Forwarded-For header instead: the last address that is not a trusted
+// proxy. By default, no proxies are trusted, and the header is ignored.
+func (h *Handlers) SetTrustedProxies(proxies ...string) error {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.settings.trustedProxies = prefixes
+	return nil
+}
+
+// SetRedirects sets where to redirect to after logging in (if there is no
+// page to return to) and after logging out. The default is "/" for both.
+func (h *Handlers) SetRedirects(afterLogin, afterLogout string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.settings.afterLogin = afterLogin
+	h.settings.afterLogout = afterLogout
+}
+
+// Mount adds all the handlers to the given ServeMux, as /register, /login,
+// /logout, /confirm, /reset and /magic. These are the paths that are used in
+// the e-mails that are sent by the UserState.
+func (h *Handlers) Mount(mux *http.ServeMux) {
+	mux.Handle("/register", h.Register())
+	mux.Handle("/login", h.Login())
+	mux.Handle("/logout", h.Logout())
+	mux.Handle("/confirm", h.Confirm())
+	mux.Handle("/reset", h.ResetPassword())
+	mux.Handle("/magic", h.MagicLink())
+}
+
+// Register returns a handler that shows the registration form for GET
+// requests and registers a new user for POST requests. The fields are
+// "username", "email", "password" and optionally "password2".
+func (h *Handlers) Register() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page := &Page{Title: "Register", CSRFToken: csrfToken(w, req)}
+		settings := h.current()
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			h.render(w, http.StatusOK, RegisterTemplate, page)
+			return
+		case http.MethodPost:
+		default:
+			h.methodNotAllowed(w, req, "GET, HEAD, POST")
+			return
+		}
+		fields, asJSON, err := readFields(req)
+		if err != nil {
+			h.fail(w, req, asJSON, http.StatusBadRequest, RegisterTemplate, page, err)
+			return
+		}
+		if !validCSRF(req, asJSON, fields) {
+			h.fail(w, req, asJSON, http.StatusForbidden, RegisterTemplate, page, errInvalidCSRF)
+			return
+		}
+		username := strings.TrimSpace(fields["username"])
+		email := strings.TrimSpace(fields["email"])
+		password := fields["password"]
+		page.Username, page.Email = username, email
+
+		username, status, err := h.validateRegistration(settings, username, email, password, fields)
+		if err != nil {
+			h.fail(w, req, asJSON, status, RegisterTemplate, page, err)
+			return
+		}
+
+		// The checks above give friendly errors, but only CreateUser is safe
+		// against two registrations for the same username at the same time
+		if err := h.state.CreateUser(req.Context(), username, password, email); err != nil {
+			switch {
+			case errors.Is(err, permissions.ErrUserExists):
+				h.fail(w, req, asJSON, http.StatusConflict, RegisterTemplate, page, errUsernameTaken)
+			case errors.Is(err, permissions.ErrUsernameConfusable):
+				h.fail(w, req, asJSON, http.StatusConflict, RegisterTemplate, page, err)
+			case errors.Is(err, permissions.ErrEmailExists):
+				h.fail(w, req, asJSON, http.StatusConflict, RegisterTemplate, page, errEmailTaken)
+			default:
+				h.fail(w, req, asJSON, http.StatusInternalServerError, RegisterTemplate, page, errSomethingWentWrong)
+			}
+			return
+		}
+		if settings.requireConfirmation {
+			if err := h.sendConfirmation(username); err != nil {
+				h.state.DiscardUser(req.Context(), username)
+				h.fail(w, req, asJSON, http.StatusInternalServerError, RegisterTemplate, page, errSomethingWentWrong)
+				return
+			}
+			page.Message = "You have been registered. Please check your e-mail for a link to confirm your account."
+		} else {
+			h.state.MarkConfirmed(username)
+			page.Message = "You have been registered and can now log in."
+		}
+		if asJSON {
+			writeJSON(w, http.StatusCreated, map[string]any{"username": username, "confirmed": !settings.requireConfirmation})
+			return
+		}
+		h.render(w, http.StatusCreated, MessageTemplate, page)
+	})
+}
+
+// validateRegistration checks the fields for a new user, and returns the
+// normalized username, or the HTTP status code and an error if something is wrong
+func (h *Handlers) validateRegistration(settings settings, username, email, password string, fields map[string]string) (string, int, error) {
+	if username == "" {
+		return "", http.StatusBadRequest, errMissingUsername
+	}
+	username, err := h.state.NormalizeUsername(username)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	if username == password {
+		return "", http.StatusBadRequest, permissions.ErrSameUsernameAndPassword
+	}
+	if err := validPassword(settings, password, fields); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return "", http.StatusBadRequest, errInvalidEmail
+	}
+	if h.state.HasUser(username) {
+		return "", http.StatusConflict, errUsernameTaken
+	}
+	if _, err := h.state.HasEmail(email); err == nil {
+		return "", http.StatusConflict, errEmailTaken
+	}
+	return username, http.StatusOK, nil
+}
+
+// validPassword checks the length of the password, and that it matches the
+// "password2" field, if given
+func validPassword(settings settings, password string, fields map[string]string) error {
+	if len([]rune(password)) < settings.minPasswordLength {
+		return errPasswordTooShort
+	}
+	if password2, ok := fields["password2"]; ok && password2 != password {
+		return errPasswordMismatch
+	}
+	return nil
+}
+
+// sendConfirmation sends a confirmation e-mail if a Mailer is set, or else
+// just generates a confirmation code that the application can send by other means
+func (h *Handlers) sendConfirmation(username string) error {
+	if h.state.Mailer() != nil {
+		return h.state.SendConfirmationEmail(username)
+	}
+	confirmationCode, err := h.state.GenerateUniqueConfirmationCode()
+	if err != nil {
+		return err
+	}
+	h.state.AddUnconfirmed(username, confirmationCode)
+	return nil
+}
+
+// Login returns a handler that shows the login form for GET requests and
+// logs the user in for POST requests. The fields are "username", "password"
+// and optionally "next", for where to redirect to after logging in. "next"
+// can be a local path, or a path that is signed by the permissions middleware.
+func (h *Handlers) Login() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page := &Page{Title: "Log in", CSRFToken: csrfToken(w, req)}
+		settings := h.current()
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			page.Next = req.URL.Query().Get("next")
+			h.render(w, http.StatusOK, LoginTemplate, page)
+			return
+		case http.MethodPost:
+		default:
+			h.methodNotAllowed(w, req, "GET, HEAD, POST")
+			return
+		}
+		fields, asJSON, err := readFields(req)
+		if err != nil {
+			h.fail(w, req, asJSON, http.StatusBadRequest, LoginTemplate, page, err)
+			return
+		}
+		page.Next = fields["next"]
+		if !validCSRF(req, asJSON, fields) {
+			h.fail(w, req, asJSON, http.StatusForbidden, LoginTemplate, page, errInvalidCSRF)
+			return
+		}
+		username := strings.TrimSpace(fields["username"])
+		password := fields["password"]
+		page.Username, page.Next = username, fields["next"]
+
+		// Users are stored with the normalized username, unless they were added before the username profile
+		if normalized, err := h.state.NormalizeUsername(username); err == nil && normalized != username {
+			if exists, err := h.state.HasUser2(normalized); err == nil && exists {
+				username = normalized
+			}
+		}
+
+		keys := []string{"user:" + strings.ToLower(username), "ip:" + clientIP(req, settings.trustedProxies)}
+		if blocked, wait := settings.throttle.Blocked(keys...); blocked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			h.fail(w, req, asJSON, http.StatusTooManyRequests, LoginTemplate, page, errTooManyAttempts)
+			return
+		}
+		if username == "" || !h.state.CorrectPassword(username, password) {
+			settings.throttle.Fail(keys...)
+			h.fail(w, req, asJSON, http.StatusUnauthorized, LoginTemplate, page, errWrongPassword)
+			return
+		}
+		if err := h.canLogIn(settings, username); err != nil {
+			h.fail(w, req, asJSON, http.StatusForbidden, LoginTemplate, page, err)
+			return
+		}
+		if err := h.state.Login(w, username); err != nil {
+			h.fail(w, req, asJSON, http.StatusInternalServerError, LoginTemplate, page, errSomethingWentWrong)
+			return
+		}
+		settings.throttle.Reset(keys[0])
+
+		// The page to return to is either signed by the permissions middleware, or a local path
+		next := settings.afterLogin
+		if path, ok := h.state.VerifyReturnPath(page.Next); ok {
+			next = path
+		} else if permissions.LocalPath(page.Next) {
+			next = page.Next
+		}
+		if asJSON {
+			writeJSON(w, http.StatusOK, map[string]any{"username": username, "next": next})
+			return
+		}
+		http.Redirect(w, req, next, http.StatusSeeOther)
+	})
+}
+
+// canLogIn checks if the given user, who has shown who they are, may log in
+func (h *Handlers) canLogIn(settings settings, username string) error {
+	switch {
+	case h.state.IsLocked(username):
+		return errLocked
+	case h.state.IsDisabled(username):
+		return errDisabled
+	case h.state.IsExpired(username):
+		return errExpired
+	case settings.requireConfirmation && !h.state.IsConfirmed(username):
+		return errNotConfirmed
+	}
+	return nil
+}
+
+// Logout returns a handler that shows a form for logging out for GET
+// requests, and logs out the current user and clears the login cookie for
+// POST requests. Only POST requests log out, so that other sites can not log
+// users out with a link or an image.
+func (h *Handlers) Logout() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page := &Page{Title: "Log out", CSRFToken: csrfToken(w, req)}
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			page.Username = h.state.Username(req)
+			h.render(w, http.StatusOK, LogoutTemplate, page)
+			return
+		case http.MethodPost:
+		default:
+			h.methodNotAllowed(w, req, "GET, HEAD, POST")
+			return
+		}
+		fields, asJSON, err := readFields(req)
+		if err != nil {
+			h.fail(w, req, asJSON, http.StatusBadRequest, LogoutTemplate, page, err)
+			return
+		}
+		if !validCSRF(req, asJSON, fields) {
+			h.fail(w, req, asJSON, http.StatusForbidden, LogoutTemplate, page, errInvalidCSRF)
+			return
+		}
+		if username := h.state.Username(req); username != "" {
+			h.state.Logout(username)
+		}
+		h.state.ClearCookie(w)
+		if asJSON || wantsJSON(req) {
+			writeJSON(w, http.StatusOK, map[string]any{"loggedout": true})
+			return
+		}
+		http.Redirect(w, req, h.current().afterLogout, http.StatusSeeOther)
+	})
+}
+
+// Confirm returns a handler that confirms the user that has the given
+// confirmation code. The code is given in the "code" field or query parameter.
+func (h *Handlers) Confirm() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page := &Page{Title: "Confirm account"}
+		var (
+			fields map[string]string
+			asJSON = wantsJSON(req)
+			err    error
+		)
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			fields = map[string]string{"code": req.URL.Query().Get("code")}
+		case http.MethodPost:
+			if fields, asJSON, err = readFields(req); err != nil {
+				h.fail(w, req, asJSON, http.StatusBadRequest, MessageTemplate, page, err)
+				return
+			}
+		default:
+			h.methodNotAllowed(w, req, "GET, HEAD, POST")
+			return
+		}
+		code := strings.TrimSpace(fields["code"])
+		if code == "" {
+			h.fail(w, req, asJSON, http.StatusBadRequest, MessageTemplate, page, errMissingCode)
+			return
+		}
+		username, err := h.state.FindUserByConfirmationCode(code)
+		if err != nil {
+			h.fail(w, req, asJSON, http.StatusBadRequest, MessageTemplate, page, err)
+			return
+		}
+		h.state.Confirm(username)
+		if asJSON {
+			writeJSON(w, http.StatusOK, map[string]any{"username": username, "confirmed": true})
+			return
+		}
+		page.Username = username
+		page.Message = "Your account has been confirmed. You can now log in."
+		h.render(w, http.StatusOK, MessageTemplate, page)
+	})
+}
+
+// ResetPassword returns a handler for resetting passwords.
+//
+// GET shows a form for requesting a password reset e-mail, or a form for
+// choosing a new password if there is a "code" query parameter.
+// POST with an "email" field sends a password reset e-mail, while POST with
+// "code", "password" and optionally "password2" fields sets the new password.
+func (h *Handlers) ResetPassword() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page := &Page{Title: "Reset password", CSRFToken: csrfToken(w, req)}
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			if page.Code = req.URL.Query().Get("code"); page.Code != "" {
+				h.render(w, http.StatusOK, ResetPasswordTemplate, page)
+				return
+			}
+			h.render(w, http.StatusOK, ResetRequestTemplate, page)
+			return
+		case http.MethodPost:
+		default:
+			h.methodNotAllowed(w, req, "GET, HEAD, POST")
+			return
+		}
+		fields, asJSON, err := readFields(req)
+		if err != nil {
+			h.fail(w, req, asJSON, http.StatusBadRequest, ResetRequestTemplate, page, err)
+			return
+		}
+
+		if code, ok := fields["code"]; ok {
+			page.Code = code
+			if !validCSRF(req, asJSON, fields) {
+				h.fail(w, req, asJSON, http.StatusForbidden, ResetPasswordTemplate, page, errInvalidCSRF)
+				return
+			}
+			password := fields["password"]
+			if err := validPassword(h.current(), password, fields); err != nil {
+				h.fail(w, req, asJSON, http.StatusBadRequest, ResetPasswordTemplate, page, err)
+				return
+			}
+			username, err := h.state.ResetPassword(code, password)
+			if err != nil {
+				h.fail(w, req, asJSON, http.StatusBadRequest, ResetPasswordTemplate, page, err)
+				return
+			}
+			if asJSON {
+				writeJSON(w, http.StatusOK, map[string]any{"username": username, "reset": true})
+				return
+			}
+			page.Message = "Your password has been changed. You can now log in."
+			h.render(w, http.StatusOK, MessageTemplate, page)
+			return
+		}
+
+		page.Email = strings.TrimSpace(fields["email"])
+		if !validCSRF(req, asJSON, fields) {
+			h.fail(w, req, asJSON, http.StatusForbidden, ResetRequestTemplate, page, errInvalidCSRF)
+			return
+		}
+		// Do not reveal if the e-mail address belongs to a user or not
+		if err := h.state.RequestPasswordReset(page.Email); err != nil && err != permissions.ErrNotFound {
+			h.fail(w, req, asJSON, http.StatusInternalServerError, ResetRequestTemplate, page, errSomethingWentWrong)
+			return
+		}
+		if asJSON {
+			writeJSON(w, http.StatusAccepted, map[string]any{"sent": true})
+			return
+		}
+		page.Message = "If the e-mail address is registered, a link for resetting the password has been sent to it."
+		h.render(w, http.StatusAccepted, MessageTemplate, page)
+	})
+}
+
+// MagicLink returns a handler for logging in with magic links, without a
+// password.
+//
+// GET shows a form for requesting a magic link e-mail, or a button for
+// logging in if there is a "code" query parameter, so that the code is not
+// used up by programs that follow the links in e-mails.
+// POST with an "email" field sends a magic link e-mail, while POST with a
+// "code" field logs the user in.
+func (h *Handlers) MagicLink() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page := &Page{Title: "Log in with a link", CSRFToken: csrfToken(w, req)}
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			if page.Code = req.URL.Query().Get("code"); page.Code != "" {
+				h.render(w, http.StatusOK, MagicLinkTemplate, page)
+				return
+			}
+			h.render(w, http.StatusOK, MagicRequestTemplate, page)
+			return
+		case http.MethodPost:
+		default:
+			h.methodNotAllowed(w, req, "GET, HEAD, POST")
+			return
+		}
+		fields, asJSON, err := readFields(req)
+		if err != nil {
+			h.fail(w, req, asJSON, http.StatusBadRequest, MagicRequestTemplate, page, err)
+			return
+		}
+
+		if code, ok := fields["code"]; ok {
+			page.Code = code
+			if !validCSRF(req, asJSON, fields) {
+				h.fail(w, req, asJSON, http.StatusForbidden, MagicLinkTemplate, page, errInvalidCSRF)
+				return
+			}
+			settings := h.current()
+			username, err := h.state.UseMagicLink(code)
+			if err != nil {
+				h.fail(w, req, asJSON, http.StatusBadRequest, MagicLinkTemplate, page, err)
+				return
+			}
+			if err := h.canLogIn(settings, username); err != nil {
+				h.fail(w, req, asJSON, http.StatusForbidden, MagicLinkTemplate, page, err)
+				return
+			}
+			if err := h.state.Login(w, username); err != nil {
+				h.fail(w, req, asJSON, http.StatusInternalServerError, MagicLinkTemplate, page, errSomethingWentWrong)
+				return
+			}
+			if asJSON {
+				writeJSON(w, http.StatusOK, map[string]any{"username": username, "next": settings.afterLogin})
+				return
+			}
+			http.Redirect(w, req, settings.afterLogin, http.StatusSeeOther)
+			return
+		}
+
+		page.Email = strings.TrimSpace(fields["email"])
+		if !validCSRF(req, asJSON, fields) {
+			h.fail(w, req, asJSON, http.StatusForbidden, MagicRequestTemplate, page, errInvalidCSRF)
+			return
+		}
+		// Do not reveal if the e-mail address belongs to a user or not
+		if err := h.state.SendMagicLink(page.Email); err != nil && err != permissions.ErrNotFound {
+			h.fail(w, req, asJSON, http.StatusInternalServerError, MagicRequestTemplate, page, errSomethingWentWrong)
+			return
+		}
+		if asJSON {
+			writeJSON(w, http.StatusAccepted, map[string]any{"sent": true})
+			return
+		}
+		page.Message = "If the e-mail address is registered, a link for logging in has been sent to it."
+		h.render(w, http.StatusAccepted, MessageTemplate, page)
+	})
+}
+
+// render renders the given template, or responds with an internal server error
+func (h *Handlers) render(w http.ResponseWriter, status int, name string, page *Page) {
+	h.mut.RLock()
+	templates := h.templates
+	h.mut.RUnlock()
+	var buf strings.Builder
+	if err := templates.ExecuteTemplate(&buf, name, page); err != nil {
+		http.Error(w, errSomethingWentWrong.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(buf.String()))
+}
+
+// fail responds with the given error, either as JSON or by rendering the given template
+func (h *Handlers) fail(w http.ResponseWriter, req *http.Request, asJSON bool, status int, name string, page *Page, err error) {
+	if asJSON || wantsJSON(req) {
+		writeJSON(w, status, map[string]any{"error": err.Error()})
+		return
+	}
+	page.Error = err.Error()
+	h.render(w, status, name, page)
+}
+
+// methodNotAllowed responds with 405 and the given allowed methods
+func (h *Handlers) methodNotAllowed(w http.ResponseWriter, req *http.Request, allowed string) {
+	w.Header().Set("Allow", allowed)
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": errMethodNotAllowed.Error()})
+		return
+	}
+	http.Error(w, errMethodNotAllowed.Error(), http.StatusMethodNotAllowed)
+}
+
+// writeJSON writes the given value as JSON, with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// isJSON checks if the request body is JSON
+func isJSON(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// wantsJSON checks if the request body is JSON, or if the client prefers JSON over HTML
+func wantsJSON(req *http.Request) bool {
+	if isJSON(req) {
+		return true
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// readFields reads the fields of a POST request, from either a JSON object or
+// a form. Also returns true if the body was JSON.
+func readFields(req *http.Request) (map[string]string, bool, error) {
+	const maxBodySize = 1 << 20
+	if isJSON(req) {
+		fields := make(map[string]string)
+		decoder := json.NewDecoder(http.MaxBytesReader(nil, req.Body, maxBodySize))
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, true, errInvalidRequest
+		}
+		return fields, true, nil
+	}
+	req.Body = http.MaxBytesReader(nil, req.Body, maxBodySize)
+	if err := req.ParseForm(); err != nil {
+		return nil, false, errInvalidRequest
+	}
+	fields := make(map[string]string, len(req.PostForm))
+	for key := range req.PostForm {
+		fields[key] = req.PostForm.Get(key)
+	}
+	return fields, false, nil
+}
+
+// clientIP returns the IP address of the client, without the port number.
+// If the request comes from one of the given trusted proxies, the last
+// address in the X-Forwarded-For header that is not a trusted proxy is used.
+func clientIP(req *http.Request, trustedProxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !trusted(host, trustedProxies) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// Do not trust what comes before an address that is not valid
+			break
+		}
+		host = addr.Unmap().String()
+		if !trusted(host, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+// trusted checks if the given IP address is in one of the given ranges
+func trusted(host string, trustedProxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfCookie is the name of the cookie with the CSRF token, and csrfField is
+// the name of the form field that must have the same token
+const (
+	csrfCookie = "csrf"
+	csrfField  = "csrf_token"
+)
+
+// csrfToken returns the CSRF token from the cookie of the request, or sets a
+// cookie with a new token and returns it
+func csrfToken(w http.ResponseWriter, req *http.Request) string {
+	if c, err := req.Cookie(csrfCookie); err == nil && len(c.Value) == 2*csrfTokenSize {
+		return c.Value
+	}
+	b := make([]byte, csrfTokenSize)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// csrfTokenSize is the number of random bytes in a CSRF token
+const csrfTokenSize = 32
+
+// validCSRF checks that the CSRF token in the fields of a form is the same
+// as the one in the cookie. JSON bodies are always valid.
+func validCSRF(req *http.Request, asJSON bool, fields map[string]string) bool {
+	if asJSON {
+		return true
+	}
+	c, err := req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(fields[csrfField])) == 1
+}
@@ -0,0 +1,424 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xyproto/permissions2/v2"
+)
+
+// testCSRFToken is the CSRF token that postForm sends in both the cookie and the form
+var testCSRFToken = strings.Repeat("ab", csrfTokenSize)
+
+func postForm(h http.Handler, path string, values url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	values.Set(csrfField, testCSRFToken)
+	return postFormWithoutCSRF(h, path, values, append(cookies, &http.Cookie{Name: csrfCookie, Value: testCSRFToken})...)
+}
+
+func postFormWithoutCSRF(h http.Handler, path string, values url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func postJSON(h http.Handler, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRegisterConfirmLogin(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	defer userstate.RemoveUser("carol")
+	h := New(userstate)
+
+	rec := postJSON(h.Register(), "/register", `{"username": "carol", "email": "carol@zombo.com", "password": "short"}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errPasswordTooShort.Error()) {
+		t.Error("Error, a short password should be rejected:", rec.Code, rec.Body.String())
+	}
+
+	rec = postJSON(h.Register(), "/register", `{"username": "carol", "email": "carol@zombo.com", "password": "hunter1234"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatal("Error, carol should have been registered:", rec.Code, rec.Body.String())
+	}
+	if !userstate.HasUser("carol") || userstate.IsConfirmed("carol") {
+		t.Fatal("Error, carol should exist, but not be confirmed yet")
+	}
+
+	rec = postJSON(h.Register(), "/register", `{"username": "carol", "email": "carol2@zombo.com", "password": "hunter1234"}`)
+	if rec.Code != http.StatusConflict {
+		t.Error("Error, the username should already be taken:", rec.Code)
+	}
+
+	rec = postForm(h.Login(), "/login", url.Values{"username": {"carol"}, "password": {"hunter1234"}})
+	if rec.Code != http.StatusForbidden {
+		t.Error("Error, carol should not be able to log in before confirming:", rec.Code)
+	}
+
+	code, err := userstate.ConfirmationCode("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/confirm?code="+url.QueryEscape(code), nil)
+	rec = httptest.NewRecorder()
+	h.Confirm().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !userstate.IsConfirmed("carol") {
+		t.Fatal("Error, carol should be confirmed:", rec.Code, rec.Body.String())
+	}
+
+	rec = postForm(h.Login(), "/login", url.Values{"username": {"carol"}, "password": {"hunter1234"}, "next": {"/data/1"}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/data/1" {
+		t.Fatal("Error, carol should be logged in and redirected back:", rec.Code, rec.Header().Get("Location"))
+	}
+	if !userstate.IsLoggedIn("carol") {
+		t.Error("Error, carol should be logged in")
+	}
+	cookies := rec.Result().Cookies()
+
+	// Only POST requests with a CSRF token log out
+	req = httptest.NewRequest(http.MethodGet, "/logout", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	h.Logout().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !userstate.IsLoggedIn("carol") {
+		t.Error("Error, a GET request should not log out carol:", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `name="csrf_token"`) {
+		t.Error("Error, the logout form should have a CSRF token")
+	}
+	rec = postFormWithoutCSRF(h.Logout(), "/logout", url.Values{}, cookies...)
+	if rec.Code != http.StatusForbidden || !userstate.IsLoggedIn("carol") {
+		t.Error("Error, a POST request without a CSRF token should not log out carol:", rec.Code)
+	}
+	rec = postForm(h.Logout(), "/logout", url.Values{}, cookies...)
+	if rec.Code != http.StatusSeeOther || userstate.IsLoggedIn("carol") {
+		t.Error("Error, carol should be logged out")
+	}
+}
+
+func TestRegisterDeletedUsername(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	userstate.SetTombstoneLifetime(2 * time.Second)
+	userstate.AddUser("dave", "hunter1234", "dave@zombo.com")
+	if err := userstate.DeleteUser(context.Background(), "dave"); err != nil {
+		t.Fatal(err)
+	}
+	h := New(userstate)
+
+	// Only CreateUser knows that the username was used by a deleted user
+	rec := postJSON(h.Register(), "/register", `{"username": "dave", "email": "dave@zombo.com", "password": "hunter1234"}`)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "taken") {
+		t.Error("Error, the username of a deleted user should be taken:", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRegisterNormalizedUsername(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	defer userstate.RemoveUser("erin")
+	h := New(userstate)
+
+	for _, username := range []string{"root", "\u0430dmin", "erin smith"} {
+		rec := postJSON(h.Register(), "/register", `{"username": "`+username+`", "email": "erin@zombo.com", "password": "hunter1234"}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Error, the username %q should be rejected: %d %s", username, rec.Code, rec.Body.String())
+		}
+	}
+	rec := postJSON(h.Register(), "/register", `{"username": "Erin", "email": "erin@zombo.com", "password": "hunter1234"}`)
+	if rec.Code != http.StatusCreated || !userstate.HasUser("erin") {
+		t.Fatal("Error, erin should have been registered with the normalized username:", rec.Code, rec.Body.String())
+	}
+	rec = postJSON(h.Register(), "/register", `{"username": "ERIN", "email": "erin2@zombo.com", "password": "hunter1234"}`)
+	if rec.Code != http.StatusConflict {
+		t.Error("Error, the username should already be taken:", rec.Code)
+	}
+
+	// Users can log in with any username that is normalized to theirs
+	userstate.MarkConfirmed("erin")
+	rec = postJSON(h.Login(), "/login", `{"username": "ＥＲＩＮ", "password": "hunter1234"}`)
+	if rec.Code != http.StatusOK || !userstate.IsLoggedIn("erin") {
+		t.Error("Error, erin should be able to log in as ＥＲＩＮ:", rec.Code, rec.Body.String())
+	}
+}
+
+// failingMailer is a Mailer that can not send e-mails
+type failingMailer struct{}
+
+func (failingMailer) Send(*permissions.Message) error {
+	return errors.New("the mail server is down")
+}
+
+func TestRegisterRollback(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	userstate.SetMailer(failingMailer{})
+	h := New(userstate)
+
+	// Nothing is left behind if the confirmation e-mail can not be sent
+	rec := postJSON(h.Register(), "/register", `{"username": "frank", "email": "frank@zombo.com", "password": "hunter1234"}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Error("Error, the registration should fail:", rec.Code, rec.Body.String())
+	}
+	if _, err := userstate.HasEmail("frank@zombo.com"); err != permissions.ErrNotFound {
+		t.Error("Error, the e-mail address should not be taken, got", err)
+	}
+	if _, err := userstate.ExportUserData(context.Background(), "frank"); err != permissions.ErrNotFound {
+		t.Error("Error, nothing should be stored for frank, got", err)
+	}
+
+	// The username can be used again right away
+	userstate.SetMailer(nil)
+	defer userstate.DiscardUser(context.Background(), "frank")
+	rec = postJSON(h.Register(), "/register", `{"username": "frank", "email": "frank@zombo.com", "password": "hunter1234"}`)
+	if rec.Code != http.StatusCreated {
+		t.Error("Error, frank should have been registered:", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLoginDisabled(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	userstate.AddUser("carol", "hunter1234", "carol@zombo.com")
+	userstate.MarkConfirmed("carol")
+	defer userstate.RemoveUser("carol")
+	h := New(userstate)
+
+	userstate.Disable("carol", "suspended")
+	rec := postJSON(h.Login(), "/login", `{"username": "carol", "password": "hunter1234"}`)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "suspended") || userstate.IsLoggedIn("carol") {
+		t.Error("Error, a disabled user should not be able to log in:", rec.Code, rec.Body.String())
+	}
+	userstate.Enable("carol")
+
+	userstate.SetExpiry("carol", time.Now().Add(-time.Minute))
+	defer userstate.SetExpiry("carol", time.Time{})
+	rec = postJSON(h.Login(), "/login", `{"username": "carol", "password": "hunter1234"}`)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "expired") || userstate.IsLoggedIn("carol") {
+		t.Error("Error, an expired user should not be able to log in:", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLoginRedirectIsLocal(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	userstate.AddUser("carol", "hunter1234", "carol@zombo.com")
+	userstate.MarkConfirmed("carol")
+	defer userstate.RemoveUser("carol")
+	h := New(userstate)
+
+	for _, next := range []string{"https://evil.com/", "//evil.com/", "/\\evil.com", "/\t/evil.com", "/%2F/evil.com"} {
+		rec := postForm(h.Login(), "/login", url.Values{"username": {"carol"}, "password": {"hunter1234"}, "next": {next}})
+		if location := rec.Header().Get("Location"); location != "/" {
+			t.Errorf("Error, %q should not be used as a redirect, got %q", next, location)
+		}
+	}
+
+	// A path that is signed by the permissions middleware
+	signed := userstate.SignReturnPath("/data/2?page=3")
+	rec := postForm(h.Login(), "/login", url.Values{"username": {"carol"}, "password": {"hunter1234"}, "next": {signed}})
+	if location := rec.Header().Get("Location"); location != "/data/2?page=3" {
+		t.Error("Error, the signed path should be used as a redirect, got", location)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	userstate.AddUser("carol", "hunter1234", "carol@zombo.com")
+	userstate.MarkConfirmed("carol")
+	defer userstate.RemoveUser("carol")
+	h := New(userstate)
+	h.SetLoginThrottle(2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		rec := postJSON(h.Login(), "/login", `{"username": "carol", "password": "wrong"}`)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatal("Error, a wrong password should be rejected:", rec.Code)
+		}
+	}
+	rec := postJSON(h.Login(), "/login", `{"username": "carol", "password": "hunter1234"}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Error("Error, the login should be throttled:", rec.Code)
+	}
+}
+
+func TestCustomTemplate(t *testing.T) {
+	h := New(permissions.NewUserStateSimple())
+	if err := h.SetTemplate(LoginTemplate, `<p>Custom login{{if .Next}} for {{.Next}}{{end}}</p>`); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/login?next=/data", nil)
+	rec := httptest.NewRecorder()
+	h.Login().ServeHTTP(rec, req)
+	if body := rec.Body.String(); body != "<p>Custom login for /data</p>" {
+		t.Error("Error, the custom template should be used:", body)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	userstate.AddUser("carol", "hunter1234", "carol@zombo.com")
+	userstate.MarkConfirmed("carol")
+	defer userstate.RemoveUser("carol")
+	h := New(userstate)
+
+	// The form has the same token as the cookie
+	rec := httptest.NewRecorder()
+	h.Login().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	var token string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == csrfCookie {
+			token = c.Value
+		}
+	}
+	if token == "" || !strings.Contains(rec.Body.String(), `value="`+token+`"`) {
+		t.Fatal("Error, the login form should have the CSRF token from the cookie")
+	}
+
+	values := url.Values{"username": {"carol"}, "password": {"hunter1234"}}
+	if rec := postFormWithoutCSRF(h.Login(), "/login", values); rec.Code != http.StatusForbidden {
+		t.Error("Error, a form without a CSRF token should be rejected:", rec.Code)
+	}
+	values.Set(csrfField, "wrong")
+	if rec := postFormWithoutCSRF(h.Login(), "/login", values, &http.Cookie{Name: csrfCookie, Value: token}); rec.Code != http.StatusForbidden {
+		t.Error("Error, a form with the wrong CSRF token should be rejected:", rec.Code)
+	}
+	if userstate.IsLoggedIn("carol") {
+		t.Error("Error, carol should not be logged in")
+	}
+	values.Set(csrfField, token)
+	if rec := postFormWithoutCSRF(h.Login(), "/login", values, &http.Cookie{Name: csrfCookie, Value: token}); rec.Code != http.StatusSeeOther {
+		t.Error("Error, a form with the CSRF token should be accepted:", rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	h := New(permissions.NewUserStateSimple())
+	if err := h.SetTrustedProxies("10.0.0.0/8", "192.168.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetTrustedProxies("not a proxy"); err == nil {
+		t.Error("Error, an invalid proxy should be rejected")
+	}
+	trustedProxies := h.current().trustedProxies
+	for _, test := range []struct {
+		remoteAddr, forwarded, expected string
+	}{
+		{"203.0.113.1:1234", "198.51.100.1", "203.0.113.1"}, // not from a proxy
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "1.2.3.4, 198.51.100.1, 192.168.1.1", "198.51.100.1"}, // spoofed first address
+		{"10.0.0.1:1234", "198.51.100.1, garbage, 10.0.0.2", "10.0.0.2"},
+		{"[::ffff:10.0.0.1]:1234", "198.51.100.1", "198.51.100.1"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := clientIP(req, trustedProxies); ip != test.expected {
+			t.Errorf("Error, expected %s for %s and %q, got %s", test.expected, test.remoteAddr, test.forwarded, ip)
+		}
+	}
+}
+
+func TestThrottlePrune(t *testing.T) {
+	th := newThrottle(2, time.Minute)
+	th.maxKeys = 10
+	for i := 0; i < 100; i++ {
+		th.Fail(strconv.Itoa(i))
+	}
+	if len(th.attempts) > th.maxKeys {
+		t.Error("Error, the throttle should keep at most", th.maxKeys, "keys, got", len(th.attempts))
+	}
+	if _, ok := th.attempts["99"]; !ok {
+		t.Error("Error, the most recent key should be kept")
+	}
+
+	// Keys without recent attempts are pruned
+	th.attempts = map[string][]time.Time{"old": {time.Now().Add(-time.Hour)}}
+	th.pruned = time.Now().Add(-time.Hour)
+	th.Fail("new")
+	if _, ok := th.attempts["old"]; ok || len(th.attempts) != 1 {
+		t.Error("Error, old keys should be pruned, got", th.attempts)
+	}
+}
+
+// recordingMailer keeps the text of all sent e-mails
+type recordingMailer struct {
+	texts []string
+}
+
+func (m *recordingMailer) Send(msg *permissions.Message) error {
+	m.texts = append(m.texts, msg.Text)
+	return nil
+}
+
+func TestMagicLink(t *testing.T) {
+	userstate := permissions.NewUserStateSimple()
+	userstate.AddUser("grace", "hunter1234", "grace@zombo.com")
+	userstate.MarkConfirmed("grace")
+	defer userstate.RemoveUser("grace")
+	mailer := &recordingMailer{}
+	userstate.SetMailer(mailer)
+	h := New(userstate)
+	mux := http.NewServeMux()
+	h.Mount(mux)
+
+	// The e-mail has a link to /magic, which is served by the mounted handlers
+	if rec := postForm(mux, "/magic", url.Values{"email": {"grace@zombo.com"}}); rec.Code != http.StatusAccepted || len(mailer.texts) != 1 {
+		t.Fatal("Error, a magic link should have been sent:", rec.Code, rec.Body.String())
+	}
+	match := regexp.MustCompile(`/magic\?code=([^\s"&<]+)`).FindStringSubmatch(mailer.texts[0])
+	if match == nil {
+		t.Fatal("Error, the e-mail should have a link to /magic:", mailer.texts[0])
+	}
+	code, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Following the link only shows a button, so that the code is not used up by link checkers
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/magic?code="+url.QueryEscape(code), nil))
+	if rec.Code != http.StatusOK || userstate.IsLoggedIn("grace") || !strings.Contains(rec.Body.String(), `name="code"`) {
+		t.Fatal("Error, following the link should show a form for logging in:", rec.Code, rec.Body.String())
+	}
+	if rec := postFormWithoutCSRF(mux, "/magic", url.Values{"code": {code}}); rec.Code != http.StatusForbidden {
+		t.Error("Error, a form without a CSRF token should be rejected:", rec.Code)
+	}
+	rec = postForm(mux, "/magic", url.Values{"code": {code}})
+	if rec.Code != http.StatusSeeOther || !userstate.IsLoggedIn("grace") {
+		t.Fatal("Error, grace should be logged in:", rec.Code, rec.Body.String())
+	}
+
+	// The code can only be used once
+	userstate.Logout("grace")
+	if rec := postForm(mux, "/magic", url.Values{"code": {code}}); rec.Code != http.StatusBadRequest || userstate.IsLoggedIn("grace") {
+		t.Error("Error, the code should only work once:", rec.Code)
+	}
+
+	// Suspended users can not log in with a magic link
+	userstate.Disable("grace", "suspended")
+	defer userstate.Enable("grace")
+	if rec := postForm(mux, "/magic", url.Values{"email": {"grace@zombo.com"}}); rec.Code != http.StatusAccepted || len(mailer.texts) != 2 {
+		t.Fatal("Error, a magic link should have been sent:", rec.Code)
+	}
+	match = regexp.MustCompile(`/magic\?code=([^\s"&<]+)`).FindStringSubmatch(mailer.texts[1])
+	code, _ = url.QueryUnescape(match[1])
+	if rec := postForm(mux, "/magic", url.Values{"code": {code}}); rec.Code != http.StatusForbidden || userstate.IsLoggedIn("grace") {
+		t.Error("Error, a suspended user should not be logged in:", rec.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import "html/template"
+
+// Page is the data that is given to the templates when rendering a page
+type Page struct {
+	Title     string
+	Error     string // error message for the user, if any
+	Message   string // informational message for the user, if any
+	Next      string // where to go after logging in
+	Code      string // confirmation or password reset code
+	Username  string
+	Email     string
+	CSRFToken string // must be sent in the "csrf_token" field of every form
+}
+
+// The names of the templates that are rendered by the handlers.
+// Each of them can be replaced with SetTemplate.
+const (
+	RegisterTemplate      = "register"      // the registration form
+	LoginTemplate         = "login"         // the login form
+	ResetRequestTemplate  = "reset_request" // the form for requesting a password reset e-mail
+	ResetPasswordTemplate = "reset"         // the form for choosing a new password
+	LogoutTemplate        = "logout"        // the form for logging out
+	MagicRequestTemplate  = "magic_request" // the form for requesting a magic link e-mail
+	MagicLinkTemplate     = "magic"         // the form for logging in with a magic link
+	MessageTemplate       = "message"       // for showing a message or an error
+)
+
+const defaultTemplates = `
+{{define "header"}}<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "register"}}{{template "header" .}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>Username <input name="username" value="{{.Username}}" required></label>
+<label>E-mail <input name="email" type="email" value="{{.Email}}" required></label>
+<label>Password <input name="password" type="password" required></label>
+<label>Confirm password <input name="password2" type="password" required></label>
+<button type="submit">Register</button>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "login"}}{{template "header" .}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="next" value="{{.Next}}">
+<label>Username <input name="username" value="{{.Username}}" required></label>
+<label>Password <input name="password" type="password" required></label>
+<button type="submit">Log in</button>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "reset_request"}}{{template "header" .}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>E-mail <input name="email" type="email" value="{{.Email}}" required></label>
+<button type="submit">Send password reset link</button>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "reset"}}{{template "header" .}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="code" value="{{.Code}}">
+<label>New password <input name="password" type="password" required></label>
+<label>Confirm new password <input name="password2" type="password" required></label>
+<button type="submit">Set new password</button>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "magic_request"}}{{template "header" .}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label>E-mail <input name="email" type="email" value="{{.Email}}" required></label>
+<button type="submit">Send login link</button>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "magic"}}{{template "header" .}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="code" value="{{.Code}}">
+<button type="submit">Log in</button>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "logout"}}{{template "header" .}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit">Log out{{if .Username}} {{.Username}}{{end}}</button>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "message"}}{{template "header" .}}{{template "footer" .}}{{end}}
+`
+
+// newDefaultTemplates parses the built-in templates
+func newDefaultTemplates() *template.Template {
+	return template.Must(template.New("handlers").Parse(defaultTemplates))
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultMaxThrottleKeys is how many usernames and IP addresses the login
+// throttle keeps track of, at most
+const defaultMaxThrottleKeys = 100000
+
+// throttle keeps track of failed attempts per key, within a time window.
+// Keys without recent attempts are pruned once per time window, and if
+// there are still too many keys, the keys with the oldest attempts are
+// forgotten, so that the memory use is bounded.
+type throttle struct {
+	attempts    map[string][]time.Time
+	maxAttempts int
+	maxKeys     int
+	window      time.Duration
+	pruned      time.Time
+	mut         sync.Mutex
+}
+
+func newThrottle(maxAttempts int, window time.Duration) *throttle {
+	return &throttle{attempts: make(map[string][]time.Time), maxAttempts: maxAttempts, maxKeys: defaultMaxThrottleKeys, window: window}
+}
+
+// recent returns the attempts for the given key that are within the time window.
+// The mutex must be held.
+func (t *throttle) recent(key string, now time.Time) []time.Time {
+	attempts := t.attempts[key]
+	i := 0
+	for i < len(attempts) && now.Sub(attempts[i]) > t.window {
+		i++
+	}
+	attempts = attempts[i:]
+	if len(attempts) == 0 {
+		delete(t.attempts, key)
+		return nil
+	}
+	t.attempts[key] = attempts
+	return attempts
+}
+
+// prune removes the keys that have no recent attempts, if the time window
+// has passed since the last time, or if there are too many keys. If there
+// are still too many keys, the tenth of the keys with the oldest last
+// attempts are removed. The mutex must be held.
+func (t *throttle) prune(now time.Time) {
+	if now.Sub(t.pruned) < t.window && len(t.attempts) < t.maxKeys {
+		return
+	}
+	t.pruned = now
+	for key := range t.attempts {
+		t.recent(key, now)
+	}
+	if len(t.attempts) < t.maxKeys {
+		return
+	}
+	keys := slices.Collect(maps.Keys(t.attempts))
+	slices.SortFunc(keys, func(a, b string) int {
+		return t.attempts[a][len(t.attempts[a])-1].Compare(t.attempts[b][len(t.attempts[b])-1])
+	})
+	for _, key := range keys[:len(keys)-t.maxKeys*9/10] {
+		delete(t.attempts, key)
+	}
+}
+
+// Blocked checks if any of the given keys have too many recent failed attempts.
+// If so, it also returns for how long the caller should wait.
+func (t *throttle) Blocked(keys ...string) (bool, time.Duration) {
+	if t.maxAttempts <= 0 {
+		return false, 0
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if attempts := t.recent(key, now); len(attempts) >= t.maxAttempts {
+			return true, t.window - now.Sub(attempts[0])
+		}
+	}
+	return false, 0
+}
+
+// Fail registers a failed attempt for the given keys
+func (t *throttle) Fail(keys ...string) {
+	if t.maxAttempts <= 0 {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	now := time.Now()
+	t.prune(now)
+	for _, key := range keys {
+		t.attempts[key] = append(t.recent(key, now), now)
+	}
+}
+
+// Reset forgets the failed attempts for the given keys
+func (t *throttle) Reset(keys ...string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for _, key := range keys {
+		delete(t.attempts, key)
+	}
+}
@@ -1,8 +1,10 @@
 package permissions
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/base64"
 
 	"golang.org/x/crypto/bcrypt"
 	"io"
@@ -46,3 +48,13 @@ func correctBcrypt(hash []byte, password string) bool {
 func isSha256(hash []byte) bool {
 	return len(hash) == 32
 }
+
+// randomToken returns a random string that is safe to use in URLs, based on
+// the given number of random bytes from crypto/rand
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("Permissions: could not read random bytes")
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
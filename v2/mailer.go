@@ -0,0 +1,180 @@
+package permissions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoMailer is returned if an e-mail should be sent, but no Mailer has been configured
+	ErrNoMailer = errors.New("no mailer has been configured")
+
+	// ErrNoRecipient is returned if an e-mail message has no recipients
+	ErrNoRecipient = errors.New("the e-mail message has no recipients")
+)
+
+// Message is an e-mail message, with a plain text body and an optional HTML body.
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer is an interface for anything that can send e-mail messages.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// SMTPMailer can send e-mail messages by using a SMTP server.
+type SMTPMailer struct {
+	hostPort string    // host:port for the SMTP server
+	from     string    // default sender address
+	auth     smtp.Auth // may be nil
+}
+
+// NewSMTPMailer creates a Mailer that sends e-mail through the SMTP server at
+// hostPort. from is used as the sender if a message has no From address.
+// auth may be nil, for SMTP servers that do not require authentication.
+func NewSMTPMailer(hostPort, from string, auth smtp.Auth) *SMTPMailer {
+	return &SMTPMailer{hostPort, from, auth}
+}
+
+// Send will send the given message by using the SMTP server.
+func (m *SMTPMailer) Send(msg *Message) error {
+	if len(msg.To) == 0 {
+		return ErrNoRecipient
+	}
+	from := msg.From
+	if from == "" {
+		from = m.from
+	}
+	data, err := msg.bytes(from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.hostPort, m.auth, from, msg.To, data)
+}
+
+// LogMailer writes e-mail messages to an io.Writer instead of sending them.
+// Useful when developing, or for testing.
+type LogMailer struct {
+	w   io.Writer
+	mut sync.Mutex
+}
+
+// NewLogMailer creates a Mailer that writes all messages to the given io.Writer.
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{w: w}
+}
+
+// Send will write the given message to the io.Writer.
+func (m *LogMailer) Send(msg *Message) error {
+	if len(msg.To) == 0 {
+		return ErrNoRecipient
+	}
+	data, err := msg.bytes(msg.From)
+	if err != nil {
+		return err
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, err := m.w.Write(data); err != nil {
+		return err
+	}
+	_, err = io.WriteString(m.w, "\r\n")
+	return err
+}
+
+// FileMailer appends e-mail messages to a file instead of sending them.
+// Useful when developing.
+type FileMailer struct {
+	filename string
+	mut      sync.Mutex
+}
+
+// NewFileMailer creates a Mailer that appends all messages to the given file.
+func NewFileMailer(filename string) *FileMailer {
+	return &FileMailer{filename: filename}
+}
+
+// Send will append the given message to the file.
+func (m *FileMailer) Send(msg *Message) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	f, err := os.OpenFile(m.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return NewLogMailer(f).Send(msg)
+}
+
+// bytes returns the message as a MIME encoded e-mail, including headers.
+func (msg *Message) bytes(from string) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	if from != "" {
+		header("From", from)
+	}
+	header("To", strings.Join(msg.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+
+	if msg.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, msg.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeQuotedPrintable writes the given text to w, as quoted-printable
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qw, text); err != nil {
+		return err
+	}
+	return qw.Close()
+}
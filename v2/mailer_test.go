@@ -0,0 +1,300 @@
+package permissions
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn is a minimal in-process SMTP server that accepts one message
+type smtpStandIn struct {
+	listener net.Listener
+	from     string
+	to       []string
+	data     chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: listener, data: make(chan string, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *smtpStandIn) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP stand-in")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			s.from = line
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			s.to = append(s.to, line)
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			lines, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			s.data <- strings.Join(lines, "\n")
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	s := newSMTPStandIn(t)
+	defer s.listener.Close()
+
+	mailer := NewSMTPMailer(s.listener.Addr().String(), "noreply@zombo.com", nil)
+	msg, err := NewEmailTemplates().Render(ConfirmationEmail, &EmailData{
+		SiteName: "Zombo",
+		Username: "bob",
+		Email:    "bob@zombo.com",
+		URL:      "https://zombo.com/confirm?code=abc123",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(msg); err != nil {
+		t.Fatal("Error, could not send e-mail:", err)
+	}
+	data := <-s.data
+	if !strings.Contains(s.from, "noreply@zombo.com") {
+		t.Error("Error, wrong sender:", s.from)
+	}
+	if len(s.to) != 1 || !strings.Contains(s.to[0], "bob@zombo.com") {
+		t.Error("Error, wrong recipients:", s.to)
+	}
+	if !strings.Contains(data, "Subject: Please confirm your account at Zombo") {
+		t.Error("Error, the subject is missing")
+	}
+	if !strings.Contains(data, "multipart/alternative") {
+		t.Error("Error, the e-mail should have both a text and a HTML part")
+	}
+	if !strings.Contains(data, "abc123") {
+		t.Error("Error, the confirmation link is missing")
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	var buf bytes.Buffer
+	mailer := NewLogMailer(&buf)
+	if err := mailer.Send(&Message{Subject: "Hi"}); err != ErrNoRecipient {
+		t.Error("Error, sending a message without recipients should fail")
+	}
+	if err := mailer.Send(&Message{To: []string{"bob@zombo.com"}, Subject: "Hi", Text: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	r := textproto.NewReader(bufio.NewReader(&buf))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("To") != "bob@zombo.com" || header.Get("Subject") != "Hi" {
+		t.Error("Error, unexpected headers:", header)
+	}
+}
+
+func TestEmailTemplates(t *testing.T) {
+	templates := NewEmailTemplates()
+	for _, kind := range []string{ConfirmationEmail, PasswordResetEmail, MagicLinkEmail, SecurityAlertEmail} {
+		msg, err := templates.Render(kind, &EmailData{Username: "bob", Email: "bob@zombo.com", URL: "https://zombo.com/?code=<x>"})
+		if err != nil {
+			t.Error("Error, could not render the", kind, "template:", err)
+			continue
+		}
+		if msg.Subject == "" || msg.Text == "" || msg.HTML == "" {
+			t.Error("Error, the", kind, "template should have a subject, a text and a HTML part")
+		}
+		if strings.Contains(msg.HTML, "<x>") {
+			t.Error("Error, the HTML part should be escaped")
+		}
+	}
+	if _, err := templates.Render("unknown", &EmailData{}); err != ErrUnknownEmailKind {
+		t.Error("Error, rendering an unknown kind of e-mail should fail")
+	}
+	if err := templates.Set(ConfirmationEmail, EmailTemplate{Subject: "Welcome, {{.Username}}", Text: "Go to {{.URL}}"}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := templates.Render(ConfirmationEmail, &EmailData{Username: "bob", URL: "https://zombo.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Welcome, bob" || msg.HTML != "" {
+		t.Error("Error, the custom template was not used:", msg.Subject)
+	}
+}
+
+// recordingMailer keeps all sent messages
+type recordingMailer struct {
+	messages []*Message
+}
+
+func (m *recordingMailer) Send(msg *Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	userstate := NewUserStateSimple()
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+
+	if err := userstate.RequestPasswordReset("bob@zombo.com"); err != ErrNoMailer {
+		t.Error("Error, there should be no mailer by default")
+	}
+
+	mailer := &recordingMailer{}
+	userstate.SetMailer(mailer)
+	userstate.SetSite("Zombo", "https://zombo.com/")
+
+	if err := userstate.RequestPasswordReset("rob@zombo.com"); err != ErrNotFound {
+		t.Error("Error, rob should not exist")
+	}
+	if err := userstate.RequestPasswordReset("bob@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.messages) != 1 {
+		t.Fatal("Error, one password reset e-mail should have been sent")
+	}
+	msg := mailer.messages[0]
+	if msg.To[0] != "bob@zombo.com" {
+		t.Error("Error, the e-mail should be sent to bob")
+	}
+	const prefix = "https://zombo.com/reset?code="
+	start := strings.Index(msg.Text, prefix)
+	if start < 0 {
+		t.Fatal("Error, the e-mail should contain a password reset link")
+	}
+	code := strings.Fields(msg.Text[start+len(prefix):])[0]
+
+	// Only a hash of the code is stored
+	if stored, _ := userstate.users.Get("bob", "passwordResetCode"); stored == "" || stored == code {
+		t.Error("Error, the hash of the code should be stored, not the code itself")
+	}
+
+	// A new code replaces the previous one
+	if err := userstate.RequestPasswordReset("bob@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userstate.ResetPassword(code, "hunter2"); err != ErrInvalidCode {
+		t.Error("Error, the previous code should not be accepted")
+	}
+	msg = mailer.messages[1]
+	start = strings.Index(msg.Text, prefix)
+	code = strings.Fields(msg.Text[start+len(prefix):])[0]
+
+	if _, err := userstate.ResetPassword("wrong", "hunter2"); err != ErrInvalidCode {
+		t.Error("Error, a wrong code should not be accepted")
+	}
+	userstate.SetLoggedIn("bob")
+	username, err := userstate.ResetPassword(code, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "bob" || !userstate.CorrectPassword("bob", "hunter2") {
+		t.Error("Error, the password for bob should have been reset")
+	}
+	if userstate.IsLoggedIn("bob") {
+		t.Error("Error, bob should be logged out after the password reset")
+	}
+	if _, err := userstate.ResetPassword(code, "hunter3"); err != ErrInvalidCode {
+		t.Error("Error, a password reset code should only be usable once")
+	}
+	if len(mailer.messages) != 3 || !strings.Contains(mailer.messages[2].Subject, "Security alert") {
+		t.Error("Error, a security alert should have been sent after the password reset")
+	}
+}
+
+func TestMagicLink(t *testing.T) {
+	userstate := NewUserStateSimple()
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	mailer := &recordingMailer{}
+	userstate.SetMailer(mailer)
+	userstate.SetSite("Zombo", "https://zombo.com")
+
+	magicCode := func() string {
+		if err := userstate.SendMagicLink("bob@zombo.com"); err != nil {
+			t.Fatal(err)
+		}
+		const prefix = "https://zombo.com/magic?code="
+		msg := mailer.messages[len(mailer.messages)-1]
+		return strings.Fields(msg.Text[strings.Index(msg.Text, prefix)+len(prefix):])[0]
+	}
+	code := magicCode()
+	if username, err := userstate.UseMagicLink(code); err != nil || username != "bob" {
+		t.Fatal("Error, the magic link should work once:", username, err)
+	}
+	if _, err := userstate.UseMagicLink(code); err != ErrInvalidCode {
+		t.Error("Error, a magic link should only be usable once")
+	}
+
+	// The code does not work for a new user with the same username
+	code = magicCode()
+	userstate.RemoveUser("bob")
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	if _, err := userstate.UseMagicLink(code); err != ErrInvalidCode {
+		t.Error("Error, the magic link should not work after the user was removed")
+	}
+
+	// The code expires
+	userstate.SetCodeLifetimes(time.Hour, time.Second)
+	code = magicCode()
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := userstate.UseMagicLink(code); err != ErrInvalidCode {
+		t.Error("Error, the magic link should have expired")
+	}
+}
+
+func TestConfirmationEmail(t *testing.T) {
+	userstate := NewUserStateSimple()
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+
+	mailer := &recordingMailer{}
+	userstate.SetMailer(mailer)
+	if err := userstate.SendConfirmationEmail("bob"); err != nil {
+		t.Fatal(err)
+	}
+	code, err := userstate.ConfirmationCode("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.messages) != 1 || !strings.Contains(mailer.messages[0].Text, code) {
+		t.Fatal("Error, the confirmation e-mail should contain the confirmation code")
+	}
+	if err := userstate.ConfirmUserByConfirmationCode(code); err != nil {
+		t.Fatal(err)
+	}
+	if !userstate.IsConfirmed("bob") {
+		t.Error("Error, bob should be confirmed")
+	}
+}
@@ -0,0 +1,137 @@
+package permissions
+
+import (
+	"path"
+	"strings"
+)
+
+// pathPattern is a path rule, split into segments. A path prefix like
+// "/admin" matches "/admin" and everything below it, but not "/administrator".
+//
+// Segments can be globs, like "*" or "*.js", which match one path segment.
+// Wildcards in the style of http.ServeMux patterns are also supported:
+// "{name}" matches one path segment, "{name...}" at the end matches the rest
+// of the path and "{$}" at the end matches only a path that ends with "/".
+// A pattern that starts with "=", like "=/about", matches only that path.
+type pathPattern struct {
+	segments []string // the literal, glob and wildcard segments, after the leading "/"
+	exact    bool     // true if the path must not have more segments than the pattern
+	slash    bool     // true if the pattern ends with "/" or "{name...}", so that the path must continue
+}
+
+// parsePattern splits the given pattern into segments. Literal segments are
+// lowercased, unless caseSensitive is true.
+func parsePattern(pattern string, caseSensitive bool) pathPattern {
+	var p pathPattern
+	if trimmed, ok := strings.CutPrefix(pattern, "="); ok {
+		pattern, p.exact = trimmed, true
+	}
+	if trimmed, ok := strings.CutSuffix(pattern, "/{$}"); ok {
+		pattern, p.exact, p.slash = trimmed+"/", true, true
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	if trimmed, ok := strings.CutSuffix(pattern, "/"); ok || pattern == "" {
+		pattern, p.slash = trimmed, true
+	}
+	if pattern != "" {
+		p.segments = strings.Split(pattern, "/")
+	}
+	if n := len(p.segments); n > 0 && isRestWildcard(p.segments[n-1]) {
+		// "{name...}" matches the rest of the path, just like a pattern that ends with "/"
+		p.segments, p.slash = p.segments[:n-1], true
+	}
+	if !caseSensitive {
+		for i, segment := range p.segments {
+			if !isWildcard(segment) {
+				p.segments[i] = strings.ToLower(segment)
+			}
+		}
+	}
+	return p
+}
+
+// isWildcard checks if the given segment is a "{name}" or "{name...}" wildcard
+func isWildcard(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// isRestWildcard checks if the given segment is a "{name...}" wildcard
+func isRestWildcard(segment string) bool {
+	return isWildcard(segment) && strings.HasSuffix(segment, "...}")
+}
+
+// isGlob checks if the given segment is a glob, like "*" or "*.js"
+func isGlob(segment string) bool {
+	return strings.ContainsAny(segment, "*?[")
+}
+
+// splitPath splits the given path into segments, after the leading "/".
+// "/" gives one empty segment and "/docs/" gives "docs" and an empty segment.
+func splitPath(p string) []string {
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+// match checks if the pattern matches the given path segments
+func (p pathPattern) match(segments []string) bool {
+	if len(segments) < len(p.segments) {
+		return false
+	}
+	for i, ps := range p.segments {
+		s := segments[i]
+		switch {
+		case isWildcard(ps):
+			if s == "" {
+				return false
+			}
+		case isGlob(ps):
+			if matched, err := path.Match(ps, s); s == "" || err != nil || !matched {
+				return false
+			}
+		case ps != s:
+			return false
+		}
+	}
+	return p.matchRest(segments[len(p.segments):])
+}
+
+// matchRest checks if the path segments that follow the segments of the
+// pattern are allowed by the pattern
+func (p pathPattern) matchRest(rest []string) bool {
+	switch {
+	case p.exact && p.slash:
+		return len(rest) == 1 && rest[0] == ""
+	case p.exact:
+		return len(rest) == 0
+	case p.slash:
+		// There must be a "/" after the segments, which gives at least one more segment
+		return len(rest) > 0
+	}
+	return true
+}
+
+// literals returns the number of literal segments in the pattern
+func (p pathPattern) literals() int {
+	n := 0
+	for _, segment := range p.segments {
+		if !isWildcard(segment) && !isGlob(segment) {
+			n++
+		}
+	}
+	return n
+}
+
+// moreSpecific checks if the pattern is more specific than the other one.
+// A pattern with more segments wins. Then a pattern with more literal
+// segments wins. Then a pattern that ends with "/" wins, then an exact pattern.
+func (p pathPattern) moreSpecific(other pathPattern) bool {
+	if len(p.segments) != len(other.segments) {
+		return len(p.segments) > len(other.segments)
+	}
+	if a, b := p.literals(), other.literals(); a != b {
+		return a > b
+	}
+	if p.slash != other.slash {
+		return p.slash
+	}
+	return p.exact && !other.exact
+}
@@ -0,0 +1,61 @@
+package permissions
+
+import "testing"
+
+func TestPathPatternMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/admin", "/admin", true},
+		{"/admin", "/admin/", true},
+		{"/admin", "/admin/users", true},
+		{"/admin", "/administrators-blog", false},
+		{"/ADMIN", "/admin/users", true},
+		{"/admin/", "/admin", false},
+		{"/admin/", "/admin/users", true},
+		{"/js", "/json-secret", false},
+		{"/", "/anything/at/all", true},
+		{"/api/*/settings", "/api/v1/settings", true},
+		{"/api/*/settings", "/api/v1/settings/mail", true},
+		{"/api/*/settings", "/api//settings", false},
+		{"/api/*/settings", "/api/v1/profile", false},
+		{"/img/*.png", "/img/logo.png", true},
+		{"/img/*.png", "/img/logo.svg", false},
+		{"/users/{id}/edit", "/users/42/edit", true},
+		{"/users/{id}/edit", "/users/42", false},
+		{"/files/{path...}", "/files/", true},
+		{"/files/{path...}", "/files/a/b/c", true},
+		{"/files/{path...}", "/files", false},
+		{"/docs/{$}", "/docs/", true},
+		{"/docs/{$}", "/docs/intro", false},
+		{"/{$}", "/", true},
+		{"/{$}", "/index.html", false},
+		{"=/about", "/about", true},
+		{"=/about", "/about/", false},
+		{"=/about", "/about/team", false},
+	} {
+		if got := parsePattern(tc.pattern, false).match(splitPath(tc.path)); got != tc.match {
+			t.Errorf("Error, %q matching %q should be %v", tc.pattern, tc.path, tc.match)
+		}
+	}
+}
+
+func TestPathPatternPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		more, less string
+	}{
+		{"/admin/public", "/admin"},
+		{"/admin", "/"},
+		{"/api/v1/settings", "/api/*/settings"},
+		{"/users/{id}/edit", "/users/{id}"},
+		{"/docs/", "/docs"},
+		{"=/about", "/about"},
+	} {
+		more, less := parsePattern(tc.more, false), parsePattern(tc.less, false)
+		if !more.moreSpecific(less) || less.moreSpecific(more) {
+			t.Errorf("Error, %q should be more specific than %q", tc.more, tc.less)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package permissions
+
+import (
+	"net/http"
+	"strings"
+)
+
+// methodRule is a path prefix that requires a role, for one HTTP method
+type methodRule struct {
+	method string
+	role   string // "admin", "user", "public" or a custom role
+	prefix string
+}
+
+// AddMethodPath registers a path prefix that shall only be reached by users
+// with the given role ("admin", "user", "public" or a custom role), when
+// requested with the given HTTP method. For example:
+//
+//	perm.AddMethodPath("GET", "public", "/docs")
+//	perm.AddMethodPath("POST", "user", "/docs")
+//	perm.AddMethodPath("DELETE", "admin", "/docs")
+//
+// Rules for the method of a request are matched together with the rules that
+// are added with AddAdminPath, AddUserPath, AddPublicPath and AddRolePath, and
+// the most specific rule wins. A rule for the method of a request only wins
+// over another rule if it is at least as specific, so a rule for GET on "/docs"
+// does not make "/docs/admin" public if that is an admin path. A rule for GET
+// also applies to HEAD requests, just like for http.ServeMux.
+func (perm *Permissions) AddMethodPath(method, role, prefix string) {
+	perm.update(func(rules *ruleSet) {
+		rules.methodRules = append(rules.methodRules, methodRule{strings.ToUpper(method), role, prefix})
+	})
+}
+
+// SetAllowOptions can be used for letting CORS preflight requests through, by
+// giving true, so that they can be answered, since browsers never send
+// cookies with them. Only OPTIONS requests with both an Origin and an
+// Access-Control-Request-Method header are let through. By default, OPTIONS
+// requests are checked just like other requests.
+func (perm *Permissions) SetAllowOptions(allowOptions bool) {
+	perm.update(func(rules *ruleSet) {
+		rules.allowOptions = allowOptions
+	})
+}
+
+// isPreflight checks if the given request is a CORS preflight request
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// methodPathRules returns the rules for the given method, in the order they
+// were added, followed by the other path rules, so that rules for the method
+// win over other rules that are equally specific
+func (rules *ruleSet) methodPathRules(method string) []pathRule {
+	var pathRules []pathRule
+	for _, rule := range rules.methodRules {
+		if rule.method == method || (rule.method == http.MethodGet && method == http.MethodHead) {
+			pathRules = append(pathRules, pathRule{ruleName(rule.role), rule.role, []string{rule.prefix}})
+		}
+	}
+	return append(pathRules, rules.pathRules()...)
+}
+
+// ruleName returns the name of the kind of rule that requires the given role
+func ruleName(role string) string {
+	switch role {
+	case "admin", "user", "public":
+		return role
+	}
+	return "role"
+}
@@ -3,7 +3,11 @@ package permissions
 
 import (
 	"net/http"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/xyproto/pinterface/v2"
 )
@@ -15,12 +19,9 @@ const (
 
 // Permissions is a structure that keeps track of the permissions for various path prefixes
 type Permissions struct {
-	state              *UserState
-	adminPathPrefixes  []string
-	userPathPrefixes   []string
-	publicPathPrefixes []string
-	rootIsPublic       bool
-	denied             http.HandlerFunc
+	state *UserState
+	mut   sync.Mutex              // Mutex for changing the rules, one change at a time
+	rules atomic.Pointer[ruleSet] // The current rules and settings, replaced as a whole when changed
 }
 
 // New will initialize a Permissions struct with all the default settings.
@@ -59,12 +60,17 @@ func NewWithRedisConf2(dbindex int, hostPort string) (*Permissions, error) {
 // a few default paths for admin/user/public path prefixes.
 func NewPermissions(state *UserState) *Permissions {
 	// default permissions
-	return &Permissions{state,
-		[]string{"/admin"},         // admin path prefixes
-		[]string{"/repo", "/data"}, // user path prefixes
-		[]string{"/",
+	perm := &Permissions{state: state}
+	perm.rules.Store((&ruleSet{
+		adminPathPrefixes: []string{"/admin"},         // admin path prefixes
+		userPathPrefixes:  []string{"/repo", "/data"}, // user path prefixes
+		publicPathPrefixes: []string{"/",
 			"/login",
 			"/register",
+			"/logout",
+			"/confirm",
+			"/reset",
+			"/magic",
 			"/favicon.ico",
 			"/style",
 			"/img",
@@ -72,18 +78,32 @@ func NewPermissions(state *UserState) *Permissions {
 			"/favicon.ico",
 			"/robots.txt",
 			"/sitemap_index.xml"}, // public
-		true,
-		PermissionDenied}
+		rootIsPublic:     true,
+		denied:           PermissionDenied,
+		rolePathPrefixes: make(map[string][]string),
+		roles:            state.currentRoles(),
+	}).compile())
+	return perm
 }
 
 // SetDenyFunction can be used for specifying a http.HandlerFunc that will be used when the permissions are denied.
 func (perm *Permissions) SetDenyFunction(f http.HandlerFunc) {
-	perm.denied = f
+	perm.update(func(rules *ruleSet) {
+		rules.denied = f
+	})
 }
 
 // DenyFunction returns the current http.HandlerFunc, for when permissions are denied.
 func (perm *Permissions) DenyFunction() http.HandlerFunc {
-	return perm.denied
+	return perm.snapshot().denied
+}
+
+// SetRequireConfirmed can be used for rejecting users that have not been
+// confirmed yet, on all user and admin pages, by giving true.
+func (perm *Permissions) SetRequireConfirmed(requireConfirmed bool) {
+	perm.update(func(rules *ruleSet) {
+		rules.requireConfirmed = requireConfirmed
+	})
 }
 
 // UserState retrieves the UserState struct
@@ -91,116 +111,298 @@ func (perm *Permissions) UserState() pinterface.IUserState {
 	return perm.state
 }
 
-// Clear sets every URL path prefix permission to "public"
+// Clear sets every URL path prefix permission to "public", by removing the
+// admin, user and role rules, and adding "/" as a public path prefix
 func (perm *Permissions) Clear() {
-	perm.adminPathPrefixes = []string{}
-	perm.userPathPrefixes = []string{}
+	perm.update(func(rules *ruleSet) {
+		rules.adminPathPrefixes = []string{}
+		rules.userPathPrefixes = []string{}
+		if !slices.Contains(rules.publicPathPrefixes, "/") {
+			rules.publicPathPrefixes = append(rules.publicPathPrefixes, "/")
+		}
+		rules.rolePathPrefixes = make(map[string][]string)
+		rules.methodRules = nil
+	})
+}
+
+// SetDefaultDeny can be used for rejecting requests for paths that match no
+// rule, by giving true. This removes "/" from the public path prefixes, so
+// that only the root page itself stays public. By default, "/" is a public
+// path prefix, and paths that match no other rule are public. Giving false
+// adds "/" as a public path prefix again.
+func (perm *Permissions) SetDefaultDeny(defaultDeny bool) {
+	perm.update(func(rules *ruleSet) {
+		rules.publicPathPrefixes = slices.DeleteFunc(rules.publicPathPrefixes, func(prefix string) bool { return prefix == "/" })
+		if !defaultDeny {
+			rules.publicPathPrefixes = append([]string{"/"}, rules.publicPathPrefixes...)
+		}
+	})
 }
 
 // AddAdminPath registers a path prefix for URLs that shall only be reached by logged in administrators
 func (perm *Permissions) AddAdminPath(prefix string) {
-	perm.adminPathPrefixes = append(perm.adminPathPrefixes, prefix)
+	perm.AddRolePath("admin", prefix)
 }
 
 // AddUserPath registers a path prefix for URLs that shall only be reached by logged in users
 func (perm *Permissions) AddUserPath(prefix string) {
-	perm.userPathPrefixes = append(perm.userPathPrefixes, prefix)
+	perm.AddRolePath("user", prefix)
 }
 
 // AddPublicPath registers a path prefix for URLs that can be reached by anyone
 func (perm *Permissions) AddPublicPath(prefix string) {
-	perm.publicPathPrefixes = append(perm.publicPathPrefixes, prefix)
+	perm.AddRolePath("public", prefix)
+}
+
+// AddRolePath registers a path prefix for URLs that shall only be reached by
+// logged in users with the given role. The "admin" and "user" roles are the
+// same as AddAdminPath and AddUserPath, while "public" is the same as AddPublicPath.
+func (perm *Permissions) AddRolePath(role, prefix string) {
+	perm.update(func(rules *ruleSet) {
+		rules.setRolePaths(role, append(rules.rolePaths(role), prefix))
+	})
+}
+
+// SetRolePath can be used for setting all URL path prefixes that are for
+// logged in users with the given role.
+func (perm *Permissions) SetRolePath(role string, pathPrefixes []string) {
+	perm.update(func(rules *ruleSet) {
+		rules.setRolePaths(role, slices.Clone(pathPrefixes))
+	})
 }
 
 // SetAdminPath can be used for setting all URL path prefixes that are for the logged in administrator pages.
 func (perm *Permissions) SetAdminPath(pathPrefixes []string) {
-	perm.adminPathPrefixes = pathPrefixes
+	perm.SetRolePath("admin", pathPrefixes)
 }
 
 // SetUserPath can be used for setting all URL path prefixes that are for the logged in user pages.
 func (perm *Permissions) SetUserPath(pathPrefixes []string) {
-	perm.userPathPrefixes = pathPrefixes
+	perm.SetRolePath("user", pathPrefixes)
 }
 
 // SetPublicPath can be used for setting all URL path prefixes that are for the public pages.
 func (perm *Permissions) SetPublicPath(pathPrefixes []string) {
-	perm.publicPathPrefixes = pathPrefixes
-}
-
-// PermissionDenied is the default "permission denied" http handler.
-func PermissionDenied(w http.ResponseWriter, _ *http.Request) {
-	http.Error(w, "Permission denied.", http.StatusForbidden)
+	perm.SetRolePath("public", pathPrefixes)
 }
 
 // Rejected checks if a given request should be rejected.
 func (perm *Permissions) Rejected(_ http.ResponseWriter, req *http.Request) bool {
-	path := req.URL.Path // the path of the url that the user wish to visit
+	return !perm.Decide(req).Allowed
+}
 
-	// If it's not "/" and set to be public regardless of permissions
-	if perm.rootIsPublic && path == "/" {
-		return false
+// RejectReason checks if a given request should be rejected, and why.
+// Returns ReasonNone if the request should not be rejected.
+func (perm *Permissions) RejectReason(req *http.Request) Reason {
+	return perm.Decide(req).Reason
+}
+
+// Decide checks if a given request should be allowed or rejected, and
+// returns a Decision that explains which rule was used and why. The path is
+// cleaned before it is checked, so that "//admin", "/./admin" and
+// "/public/../admin" are all checked as "/admin".
+//
+// Path prefixes match whole path segments, so "/admin" matches "/admin" and
+// "/admin/users", but not "/administrators-blog". Prefixes can also be
+// patterns, like "/api/*/settings", "/users/{id}/edit", "/files/{path...}",
+// "/docs/{$}" (only "/docs/") or "=/about" (only "/about").
+//
+// The most specific matching rule wins: the pattern with the most segments,
+// then the most literal segments, then a pattern that ends with "/", then an
+// exact pattern. If two patterns are equally specific, admin rules win over
+// custom roles, which win over user rules, which win over public rules.
+// Requests that match no rule are rejected, but by default, "/" is a public
+// prefix that matches every path, unless SetDefaultDeny is used.
+//
+// The fields of the user are fetched from Redis in one round trip, and only
+// once for the request, also if the middleware has already fetched them.
+func (perm *Permissions) Decide(req *http.Request) Decision {
+	return perm.decideWith(perm.snapshot(), withUserCache(req))
+}
+
+// decideWith checks if a given request should be allowed or rejected, with the given rules
+func (perm *Permissions) decideWith(rules *ruleSet, req *http.Request) Decision {
+	path, ok := requestPath(req.URL) // the path of the url that the user wish to visit
+	d := Decision{Path: path, Method: req.Method}
+	if !ok {
+		// Reject paths that routers may see differently
+		d.Path = req.URL.EscapedPath()
+		return d.reject("path", "", "", ReasonForbidden)
 	}
 
-	// Make sure to compare paths in a case-insensitive way,
-	// because some operating systems uses case-insensitive filesystems.
-	lowerPath := strings.ToLower(path)
+	// Let CORS preflight requests through, since browsers send them without cookies
+	if rules.allowOptions && isPreflight(req) {
+		return d.allow("options", "", "")
+	}
 
-	// Reject if it is an admin page and user does not have admin permissions
-	for _, prefix := range perm.adminPathPrefixes {
-		if strings.HasPrefix(lowerPath, strings.ToLower(prefix)) {
-			if !perm.state.AdminRights(req) {
-				// Reject
-				return true
-			}
-		}
+	// If it's not "/" and set to be public regardless of permissions
+	if rules.rootIsPublic && path == "/" {
+		return d.allow("root", "/", "")
+	}
+
+	// Make sure to compare paths in a case-insensitive way, unless
+	// case-sensitive matching is enabled with SetCaseSensitive, because
+	// some operating systems uses case-insensitive filesystems.
+	if !rules.caseSensitive {
+		path = strings.ToLower(path)
 	}
+	segments := splitPath(path)
 
-	// Reject if it's a user page and the user does not have user rights
-	for _, prefix := range perm.userPathPrefixes {
-		if strings.HasPrefix(lowerPath, strings.ToLower(prefix)) {
-			if !perm.state.UserRights(req) {
-				// Reject
-				return true
-			}
+	// Find the most specific rule that matches the path. The rules for the
+	// method of the request are compiled together with the other rules.
+	paths, ok := rules.methodPaths[req.Method]
+	if !ok {
+		paths = rules.paths
+	}
+	rule, pattern, ok := paths.lookup(segments)
+	if !ok {
+		// Reject
+		if perm.userReason(rules, req, &d, "user") == ReasonNone {
+			return d.reject("default", "", "", ReasonForbidden)
 		}
+		return d.reject("default", "", "", ReasonUnauthenticated)
 	}
 
 	// Don't reject if it's a public page
-	for _, prefix := range perm.publicPathPrefixes {
-		if strings.HasPrefix(lowerPath, strings.ToLower(prefix)) {
-			// Don't reject
-			return false
-		}
+	if rule.role == "public" {
+		return d.allow("public", pattern, "")
+	}
+
+	// Reject if the user does not have the required role
+	if r := perm.userReason(rules, req, &d, rule.role); r != ReasonNone {
+		return d.reject(rule.name, pattern, rule.role, r)
+	}
+	return d.allow(rule.name, pattern, rule.role)
+}
+
+// pathRule is a list of path patterns that require a role
+type pathRule struct {
+	name     string // "admin", "role", "user" or "public"
+	role     string
+	patterns []string
+}
+
+// pathRules returns the admin rule, then the rules for custom roles (sorted
+// by role name), then the user rule and then the public rule. If two
+// patterns are equally specific, the first one wins.
+func (rules *ruleSet) pathRules() []pathRule {
+	pathRules := make([]pathRule, 0, len(rules.rolePathPrefixes)+3)
+	pathRules = append(pathRules, pathRule{"admin", "admin", rules.adminPathPrefixes})
+	roles := make([]string, 0, len(rules.rolePathPrefixes))
+	for role := range rules.rolePathPrefixes {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		pathRules = append(pathRules, pathRule{"role", role, rules.rolePathPrefixes[role]})
+	}
+	pathRules = append(pathRules, pathRule{"user", "user", rules.userPathPrefixes})
+	return append(pathRules, pathRule{"public", "public", rules.publicPathPrefixes})
+}
+
+// rolePaths returns the path prefixes for the given role
+func (rules *ruleSet) rolePaths(role string) []string {
+	switch role {
+	case "admin":
+		return rules.adminPathPrefixes
+	case "user":
+		return rules.userPathPrefixes
+	case "public":
+		return rules.publicPathPrefixes
+	}
+	return rules.rolePathPrefixes[role]
+}
+
+// setRolePaths sets the path prefixes for the given role
+func (rules *ruleSet) setRolePaths(role string, prefixes []string) {
+	switch role {
+	case "admin":
+		rules.adminPathPrefixes = prefixes
+	case "user":
+		rules.userPathPrefixes = prefixes
+	case "public":
+		rules.publicPathPrefixes = prefixes
+	default:
+		rules.rolePathPrefixes[role] = prefixes
 	}
+}
+
+// userReason checks if the current user is logged in and has the given role
+// ("user", "admin" or a custom role), either directly or by inheriting it
+// from another role. Returns ReasonNone if so, or else the reason for
+// rejecting. The username from the cookie is stored in the given Decision.
+func (perm *Permissions) userReason(rules *ruleSet, req *http.Request, d *Decision, role string) Reason {
+	username, r := perm.loginReason(rules, req, d)
+	if r != ReasonNone {
+		return r
+	}
+	if !rules.roles.recordRoles(perm.state.requestUser(req, username))[role] {
+		return ReasonForbidden
+	}
+	return ReasonNone
+}
 
-	// Reject
-	return true
+// loginReason checks if the current user is logged in, and not locked,
+// disabled, expired or unconfirmed. Returns the username and ReasonNone if so, or else the reason
+// for rejecting. The username from the cookie is stored in the given Decision.
+func (perm *Permissions) loginReason(rules *ruleSet, req *http.Request, d *Decision) (string, Reason) {
+	username, u, err := perm.state.cookieUser(req)
+	d.Username = username
+	if err != nil {
+		return username, ReasonUnauthenticated
+	}
+	if !u.loggedIn() {
+		return username, ReasonUnauthenticated
+	}
+	if u.locked() {
+		return username, ReasonLocked
+	}
+	if u.disabled() {
+		return username, ReasonDisabled
+	}
+	if u.expired() {
+		return username, ReasonExpired
+	}
+	if rules.requireConfirmed && !u.confirmed() {
+		return username, ReasonUnconfirmed
+	}
+	return username, ReasonNone
 }
 
 // Middleware handler (compatible with Negroni)
 func (perm *Permissions) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	// Use the same rules for the whole request, even if they are replaced meanwhile
+	rules := perm.snapshot()
+	// Fetch each user only once, for the whole request
+	req = withUserCache(req)
 	// Check if the user has the right admin/user rights
-	if perm.Rejected(w, req) {
-		// Get and call the Permission Denied function
-		perm.DenyFunction()(w, req)
+	d := perm.decide(rules, w, req)
+	if !d.Allowed {
+		// Redirect to the login page, or call the Permission Denied function
+		perm.deny(rules, w, req, d.Reason)
 		// Reject the request by not calling the next handler below
 		return
 	}
-	// Call the next middleware handler
-	next(w, req)
+	// Call the next middleware handler, with the logged in user in the context
+	next(w, perm.withPrincipal(rules, req, d))
 }
 
 // Middleware handler (compatible with Chi)
 func (perm *Permissions) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Use the same rules for the whole request, even if they are replaced meanwhile
+		rules := perm.snapshot()
+		// Fetch each user only once, for the whole request
+		req = withUserCache(req)
 		// Check if the user has the right admin/user rights
-		if perm.Rejected(w, req) {
-			// Get and call the Permission Denied function
-			perm.DenyFunction()(w, req)
+		d := perm.decide(rules, w, req)
+		if !d.Allowed {
+			// Redirect to the login page, or call the Permission Denied function
+			perm.deny(rules, w, req, d.Reason)
 			// Reject the request by not calling the next handler below
 			return
 		}
-		// Call the next middleware handler
-		next.ServeHTTP(w, req)
+		// Call the next middleware handler, with the logged in user in the context
+		next.ServeHTTP(w, perm.withPrincipal(rules, req, d))
 	})
 }
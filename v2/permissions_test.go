@@ -1,7 +1,13 @@
 package permissions
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/xyproto/pinterface/v2"
 )
@@ -10,3 +16,420 @@ func TestInterface(_ *testing.T) {
 	// Check that the value qualifies for the interface
 	var _ pinterface.IPermissions = New()
 }
+
+// loginCookies logs in the given user and returns the cookies that were set
+func loginCookies(t *testing.T, userstate *UserState, username string) []*http.Cookie {
+	rec := httptest.NewRecorder()
+	if err := userstate.Login(rec, username); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()
+}
+
+func TestLoginRedirect(t *testing.T) {
+	perm := New()
+	perm.SetLoginURL("/login")
+	userstate := perm.UserState().(*UserState)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	handler := perm.Middleware(ok)
+
+	// An anonymous browser is redirected to the login page
+	req := httptest.NewRequest(http.MethodGet, "/admin/users?page=2", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatal("Error, an anonymous browser should be redirected to the login page:", rec.Code)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || location.Path != "/login" {
+		t.Fatal("Error, wrong redirect:", rec.Header().Get("Location"))
+	}
+	next, valid := userstate.VerifyReturnPath(location.Query().Get("next"))
+	if !valid || next != "/admin/users?page=2" {
+		t.Error("Error, the next parameter should be a signed path back to the page:", next)
+	}
+
+	// An anonymous API client gets 401
+	req = httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("Error, an anonymous API client should get 401 with WWW-Authenticate:", rec.Code)
+	}
+
+	// A logged in user without admin rights gets 403
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	req = httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.Header.Set("Accept", "text/html")
+	for _, c := range loginCookies(t, userstate, "bob") {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Error("Error, a logged in user without admin rights should get 403:", rec.Code)
+	}
+}
+
+func TestSignedReturnPath(t *testing.T) {
+	userstate := NewUserStateSimple()
+	signed := userstate.SignReturnPath("/data")
+	if path, ok := userstate.VerifyReturnPath(signed); !ok || path != "/data" {
+		t.Error("Error, the signed path should be valid")
+	}
+	tampered := userstate.SignReturnPath("/data")
+	tampered = strings.Replace(tampered, tampered[:4], "Ly9l", 1)
+	if _, ok := userstate.VerifyReturnPath(tampered); ok {
+		t.Error("Error, a tampered path should not be valid")
+	}
+	if _, ok := userstate.VerifyReturnPath(userstate.SignReturnPath("//evil.com")); ok {
+		t.Error("Error, a path to another site should never be valid")
+	}
+	for _, s := range []string{"/", "/data?x=1", "/data/%20page", "/search?q=%2F%2Fevil.com"} {
+		if !LocalPath(s) {
+			t.Errorf("Error, %q should be a local path", s)
+		}
+	}
+	for _, s := range []string{
+		"", "data", "//evil.com", "/\\evil.com", "https://evil.com/",
+		"\t", "\n", "%09", "/\t/evil.com", "/data\n", "/data\x7f", "/\x00/evil.com",
+		"/%09/evil.com", "/%2F/evil.com", "/%2f/evil.com", "/%5Cevil.com",
+	} {
+		if LocalPath(s) {
+			t.Errorf("Error, %q should not be a local path", s)
+		}
+	}
+}
+
+func TestRejectReason(t *testing.T) {
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	cookies := loginCookies(t, userstate, "bob")
+
+	request := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		return req
+	}
+
+	if r := perm.RejectReason(httptest.NewRequest(http.MethodGet, "/data", nil)); r != ReasonUnauthenticated {
+		t.Error("Error, an anonymous visitor should be unauthenticated, not", r)
+	}
+	if r := perm.RejectReason(request("/data")); r != ReasonNone {
+		t.Error("Error, bob should be allowed to visit /data, not", r)
+	}
+	if r := perm.RejectReason(request("/admin")); r != ReasonForbidden {
+		t.Error("Error, bob should be forbidden to visit /admin, not", r)
+	}
+
+	perm.SetRequireConfirmed(true)
+	if r := perm.RejectReason(request("/data")); r != ReasonUnconfirmed {
+		t.Error("Error, bob should be unconfirmed, not", r)
+	}
+	userstate.MarkConfirmed("bob")
+	if r := perm.RejectReason(request("/data")); r != ReasonNone {
+		t.Error("Error, bob should be allowed to visit /data when confirmed, not", r)
+	}
+
+	userstate.Lock("bob", time.Minute)
+	if r := perm.RejectReason(request("/data")); r != ReasonLocked {
+		t.Error("Error, bob should be locked, not", r)
+	}
+	userstate.Unlock("bob")
+	if r := perm.RejectReason(request("/data")); r != ReasonNone {
+		t.Error("Error, bob should be allowed to visit /data when unlocked, not", r)
+	}
+}
+
+func TestPermissionDeniedNegotiation(t *testing.T) {
+	perm := New()
+	handler := perm.Middleware(http.NotFoundHandler())
+	for accept, contentType := range map[string]string{
+		"":                                  "text/plain; charset=utf-8",
+		"*/*":                               "text/plain; charset=utf-8",
+		"text/html,*/*;q=0.8":               "text/html; charset=utf-8",
+		"application/json":                  "application/problem+json",
+		"application/problem+json":          "application/problem+json",
+		"text/html;q=0.5, application/json": "application/problem+json",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Error, expected 403 for Accept %q, got %d", accept, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("Error, expected %q for Accept %q, got %q", contentType, accept, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var problem Problem
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Status != http.StatusForbidden || problem.Reason != "unauthenticated" || problem.Instance != "/admin" {
+		t.Errorf("Error, unexpected problem details: %+v", problem)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	cookies := loginCookies(t, userstate, "bob")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/settings", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	d := perm.Decide(req)
+	if d.Allowed || d.Rule != "admin" || d.Prefix != "/admin" || d.Role != "admin" || d.Username != "bob" || d.Reason != ReasonForbidden {
+		t.Errorf("Error, unexpected decision: %+v", d)
+	}
+	if s := d.String(); s != `reject path="/admin/settings" rule=admin method=GET prefix="/admin" role=admin user="bob" reason=forbidden` {
+		t.Error("Error, unexpected explanation:", s)
+	}
+
+	d = perm.Decide(httptest.NewRequest(http.MethodGet, "/js/app.js", nil))
+	if !d.Allowed || d.Rule != "public" || d.Prefix != "/js" {
+		t.Errorf("Error, unexpected decision: %+v", d)
+	}
+
+	perm.SetDebug(true)
+	rec := httptest.NewRecorder()
+	perm.Middleware(http.NotFoundHandler()).ServeHTTP(rec, req)
+	if rec.Header().Get(DecisionHeader) != perm.Decide(req).String() {
+		t.Error("Error, the decision should be explained in a header when debugging")
+	}
+}
+
+func TestRolePath(t *testing.T) {
+	perm := New()
+	perm.AddRolePath("editor", "/edit")
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	defer userstate.RemoveRole("bob", "editor")
+
+	req := httptest.NewRequest(http.MethodGet, "/edit/page", nil)
+	for _, c := range loginCookies(t, userstate, "bob") {
+		req.AddCookie(c)
+	}
+	if d := perm.Decide(req); d.Allowed || d.Rule != "role" || d.Role != "editor" || d.Reason != ReasonForbidden {
+		t.Errorf("Error, bob should not be allowed to edit: %+v", d)
+	}
+	userstate.AddRole("bob", "editor")
+	if d := perm.Decide(req); !d.Allowed || d.Role != "editor" {
+		t.Errorf("Error, bob should be allowed to edit: %+v", d)
+	}
+}
+
+func TestRolePathInheritance(t *testing.T) {
+	perm := New()
+	perm.AddRolePath("editor", "/edit")
+	userstate := perm.UserState().(*UserState)
+	userstate.AddRoleInheritance("admin", "editor")
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	userstate.SetAdminStatus("bob")
+
+	req := httptest.NewRequest(http.MethodGet, "/edit/page", nil)
+	for _, c := range loginCookies(t, userstate, "bob") {
+		req.AddCookie(c)
+	}
+	if d := perm.Decide(req); !d.Allowed {
+		t.Errorf("Error, an administrator should inherit the editor role: %+v", d)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	userstate.GrantPermission("editor", "repo:write")
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	handler := perm.Require("repo:write")(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	serve := func(loggedIn bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/repos", nil)
+		if loggedIn {
+			for _, c := range loginCookies(t, userstate, "bob") {
+				req.AddCookie(c)
+			}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(false); rec.Code != http.StatusForbidden {
+		t.Error("Error, an anonymous visitor should be rejected:", rec.Code)
+	}
+	if rec := serve(true); rec.Code != http.StatusForbidden {
+		t.Error("Error, bob lacks the repo:write permission:", rec.Code)
+	}
+	userstate.AddRole("bob", "editor")
+	defer userstate.RemoveRole("bob", "editor")
+	if rec := serve(true); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Error("Error, bob should have the repo:write permission:", rec.Code)
+	}
+}
+
+func TestMethodPath(t *testing.T) {
+	perm := New()
+	perm.AddMethodPath("GET", "public", "/docs")
+	perm.AddMethodPath("POST", "user", "/docs")
+	perm.AddMethodPath("DELETE", "admin", "/docs")
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	cookies := loginCookies(t, userstate, "bob")
+
+	for _, tc := range []struct {
+		method   string
+		loggedIn bool
+		allowed  bool
+	}{
+		{http.MethodGet, false, true},
+		{http.MethodHead, false, true},
+		{http.MethodPost, false, false},
+		{http.MethodPost, true, true},
+		{http.MethodDelete, true, false},
+	} {
+		req := httptest.NewRequest(tc.method, "/docs/intro", nil)
+		if tc.loggedIn {
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+		}
+		if d := perm.Decide(req); d.Allowed != tc.allowed {
+			t.Errorf("Error, unexpected decision for %s (logged in: %v): %s", tc.method, tc.loggedIn, d)
+		}
+	}
+
+	// A broad rule for a method does not win over a more specific admin rule
+	perm.AddMethodPath("GET", "public", "/")
+	perm.AddAdminPath("/docs/admin")
+	for _, path := range []string{"/docs/admin", "/docs/admin/users", "/admin"} {
+		if d := perm.Decide(httptest.NewRequest(http.MethodGet, path, nil)); d.Allowed || d.Rule != "admin" {
+			t.Errorf("Error, GET %s should need admin rights: %s", path, d)
+		}
+	}
+	if d := perm.Decide(httptest.NewRequest(http.MethodGet, "/docs/intro", nil)); !d.Allowed {
+		t.Error("Error, GET /docs/intro should still be public:", d)
+	}
+
+	// OPTIONS requests are checked like any other request, by default
+	perm.AddMethodPath("OPTIONS", "admin", "/docs")
+	if perm.Decide(httptest.NewRequest(http.MethodOptions, "/docs", nil)).Allowed {
+		t.Error("Error, the OPTIONS request should be rejected")
+	}
+}
+
+func TestAllowOptions(t *testing.T) {
+	perm := New()
+	perm.SetAllowOptions(true)
+	preflight := func(path string, headers ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return req
+	}
+
+	// Only CORS preflight requests are let through
+	if d := perm.Decide(preflight("/admin", "Origin", "https://example.com", "Access-Control-Request-Method", "POST")); !d.Allowed || d.Rule != "options" {
+		t.Error("Error, the CORS preflight request should be allowed:", d)
+	}
+	for _, req := range []*http.Request{
+		preflight("/admin"),
+		preflight("/admin", "Origin", "https://example.com"),
+		preflight("/admin", "Access-Control-Request-Method", "POST"),
+	} {
+		if d := perm.Decide(req); d.Allowed {
+			t.Error("Error, an OPTIONS request that is not a CORS preflight request should be checked like other requests:", d)
+		}
+	}
+
+	perm.SetAllowOptions(false)
+	if d := perm.Decide(preflight("/admin", "Origin", "https://example.com", "Access-Control-Request-Method", "POST")); d.Allowed {
+		t.Error("Error, the CORS preflight request should be rejected:", d)
+	}
+}
+
+func TestDefaultDeny(t *testing.T) {
+	perm := New()
+	paths := map[string]bool{"/": true, "/login": true, "/js/app.js": true, "/json-secret": false, "/anything": false, "/secret/page": false}
+
+	// By default, paths that match no other rule are public
+	for path := range paths {
+		if d := perm.Decide(httptest.NewRequest(http.MethodGet, path, nil)); !d.Allowed {
+			t.Errorf("Error, %s should be public by default: %s", path, d)
+		}
+	}
+
+	// Only the root page itself and the public paths stay public
+	perm.SetDefaultDeny(true)
+	for path, allowed := range paths {
+		if d := perm.Decide(httptest.NewRequest(http.MethodGet, path, nil)); d.Allowed != allowed {
+			t.Errorf("Error, unexpected decision for %s: %s", path, d)
+		}
+	}
+	perm.SetDefaultDeny(false)
+	if d := perm.Decide(httptest.NewRequest(http.MethodGet, "/anything", nil)); !d.Allowed {
+		t.Error("Error, /anything should be public again:", d)
+	}
+
+	// Clear makes every path public
+	perm.SetDefaultDeny(true)
+	perm.Clear()
+	if d := perm.Decide(httptest.NewRequest(http.MethodGet, "/secret/page", nil)); !d.Allowed {
+		t.Error("Error, every path should be public after Clear:", d)
+	}
+}
+
+func TestMostSpecificRule(t *testing.T) {
+	perm := New()
+	perm.AddPublicPath("/admin/help")
+	perm.AddAdminPath("/data/{id}/audit")
+
+	for _, tc := range []struct {
+		path    string
+		allowed bool
+		rule    string
+	}{
+		{"/administrators-blog", true, "public"},
+		{"/admin/users", false, "admin"},
+		{"/admin/help/faq", true, "public"},
+		{"/data/42", false, "user"},
+		{"/data/42/audit", false, "admin"},
+	} {
+		d := perm.Decide(httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if d.Allowed != tc.allowed || d.Rule != tc.rule {
+			t.Errorf("Error, unexpected decision for %s: %s", tc.path, d)
+		}
+	}
+
+	// Exact rules only match the path itself
+	perm.SetPublicPath([]string{"/login", "=/about"})
+	if d := perm.Decide(httptest.NewRequest(http.MethodGet, "/about/team", nil)); d.Allowed || d.Rule != "default" {
+		t.Errorf("Error, only /about should be public: %s", d)
+	}
+}
@@ -0,0 +1,575 @@
+package permissions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// PolicyVersion is the version of the policy documents that can be loaded
+const PolicyVersion = 1
+
+// Policy is a declarative set of rules, that can be loaded from a YAML, JSON
+// or TOML document with LoadPolicy or LoadPolicyFile. For example:
+//
+//	version: 1
+//	login_url: /login
+//	public: ["/", "/login", "/style"]
+//	roles:
+//	  editor:
+//	    inherits: [user]
+//	    permissions: ["repo:write"]
+//	rules:
+//	  - path: /admin
+//	    role: admin
+//	  - path: /edit
+//	    role: editor
+//	  - path: /docs
+//	    role: user
+//	    methods: [POST, PUT]
+//	deny:
+//	  forbidden: my-forbidden-page
+type Policy struct {
+	Version          int                   `json:"version" toml:"version"`
+	LoginURL         string                `json:"login_url,omitempty" toml:"login_url,omitempty"`
+	RequireConfirmed bool                  `json:"require_confirmed,omitempty" toml:"require_confirmed,omitempty"`
+	CaseSensitive    bool                  `json:"case_sensitive,omitempty" toml:"case_sensitive,omitempty"`
+	Public           []string              `json:"public,omitempty" toml:"public,omitempty"`
+	Roles            map[string]PolicyRole `json:"roles,omitempty" toml:"roles,omitempty"`
+	Rules            []PolicyRule          `json:"rules,omitempty" toml:"rules,omitempty"`
+	Deny             map[string]string     `json:"deny,omitempty" toml:"deny,omitempty"` // from a reason, or "default", to the name of a deny handler
+}
+
+// PolicyRole is a custom role in a Policy
+type PolicyRole struct {
+	Inherits    []string `json:"inherits,omitempty" toml:"inherits,omitempty"`
+	Permissions []string `json:"permissions,omitempty" toml:"permissions,omitempty"`
+}
+
+// PolicyRule is a path pattern that requires a role in a Policy, optionally
+// only for the given HTTP methods
+type PolicyRule struct {
+	Path    string   `json:"path" toml:"path"`
+	Role    string   `json:"role" toml:"role"`
+	Methods []string `json:"methods,omitempty" toml:"methods,omitempty"`
+}
+
+// PolicyError is a problem with a policy document
+type PolicyError struct {
+	File    string // the name of the policy file, if any
+	Line    int    // the line number, or 0 if not known
+	Field   string // the field in the document, like "rules[2].role", if known
+	Message string
+}
+
+// Error returns the problem, with the file, line number and field, if known
+func (e *PolicyError) Error() string {
+	var sb strings.Builder
+	switch {
+	case e.File != "" && e.Line > 0:
+		fmt.Fprintf(&sb, "%s:%d: ", e.File, e.Line)
+	case e.File != "":
+		sb.WriteString(e.File + ": ")
+	case e.Line > 0:
+		fmt.Fprintf(&sb, "line %d: ", e.Line)
+	}
+	if e.Field != "" {
+		sb.WriteString(e.Field + ": ")
+	}
+	sb.WriteString(e.Message)
+	return sb.String()
+}
+
+// The names of the supported policy document formats
+const (
+	policyYAML = "yaml"
+	policyJSON = "json"
+	policyTOML = "toml"
+)
+
+// tomlKeyValue matches the first line of a TOML document that starts with a key
+var tomlKeyValue = regexp.MustCompile(`^[A-Za-z0-9_."'-]+\s*=`)
+
+// denyReasons are the reasons that can be given in the deny section of a policy
+var denyReasons = map[string]Reason{
+	"default":                      ReasonNone,
+	ReasonUnauthenticated.String(): ReasonUnauthenticated,
+	ReasonForbidden.String():       ReasonForbidden,
+	ReasonLocked.String():          ReasonLocked,
+	ReasonUnconfirmed.String():     ReasonUnconfirmed,
+	ReasonDisabled.String():        ReasonDisabled,
+	ReasonExpired.String():         ReasonExpired,
+}
+
+// policyMethods are the HTTP methods that can be used in policy rules
+var policyMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+	http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// AddDenyHandler registers a http.HandlerFunc with a name, so that it can be
+// used in the deny section of a policy document. The name "default" refers to
+// PermissionDenied, unless another handler is registered with that name.
+func (perm *Permissions) AddDenyHandler(name string, f http.HandlerFunc) {
+	perm.update(func(rules *ruleSet) {
+		if rules.denyHandlers == nil {
+			rules.denyHandlers = make(map[string]http.HandlerFunc)
+		}
+		rules.denyHandlers[name] = f
+	})
+}
+
+// denyHandler returns the deny handler with the given name, or nil
+func (rules *ruleSet) denyHandler(name string) http.HandlerFunc {
+	if f, ok := rules.denyHandlers[name]; ok {
+		return f
+	}
+	if name == "default" {
+		return PermissionDenied
+	}
+	return nil
+}
+
+// LoadPolicyFile reads a policy document from the given file, and replaces
+// all rules with the rules in the policy. The format is given by the file
+// extension (".yaml", ".yml", ".json" or ".toml"), or else detected from
+// the contents. Returns the problems with the document, including line
+// numbers, if it is not valid. The rules are not changed if there are problems.
+func (perm *Permissions) LoadPolicyFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var format string
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		format = policyYAML
+	case ".json":
+		format = policyJSON
+	case ".toml":
+		format = policyTOML
+	default:
+		format = detectPolicyFormat(data)
+	}
+	return withPolicyFile(perm.loadPolicy(data, format), filename)
+}
+
+// LoadPolicy reads a policy document in the YAML, JSON or TOML format, and
+// replaces all rules with the rules in the policy. The format is detected
+// from the contents. Returns the problems with the document, including line
+// numbers, if it is not valid. The rules are not changed if there are problems.
+func (perm *Permissions) LoadPolicy(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return perm.loadPolicy(data, detectPolicyFormat(data))
+}
+
+// loadPolicy decodes, validates and applies a policy document in the given format
+func (perm *Permissions) loadPolicy(data []byte, format string) error {
+	policy, lineOf, err := decodePolicy(data, format)
+	if err != nil {
+		return err
+	}
+	problems := perm.snapshot().validatePolicy(policy)
+	for _, problem := range problems {
+		problem.Line = lineOf(problem.Field)
+	}
+	if len(problems) > 0 {
+		return joinPolicyErrors(problems)
+	}
+	return perm.ApplyPolicy(policy)
+}
+
+// ApplyPolicy replaces all rules, custom role settings and deny functions
+// with the ones in the given policy. The root page is only public if the
+// policy says so. Returns the problems with the policy, if it is not valid.
+// The rules are not changed if there are problems.
+//
+// The rules and the custom role settings are replaced all at once, so
+// requests that are being handled meanwhile use either the old or the new
+// policy, never a mix of them.
+func (perm *Permissions) ApplyPolicy(policy *Policy) error {
+	if problems := perm.snapshot().validatePolicy(policy); len(problems) > 0 {
+		return joinPolicyErrors(problems)
+	}
+	graph, err := roleGraph(policy.hierarchy())
+	if err != nil {
+		return err
+	}
+	permissions := make(map[string][]string, len(policy.Roles))
+	for name, role := range policy.Roles {
+		permissions[name] = role.Permissions
+	}
+	rolePermissions, err := rolePermissionSets(permissions)
+	if err != nil {
+		return err
+	}
+
+	var (
+		adminPaths, userPaths []string
+		publicPaths           = append([]string{}, policy.Public...)
+		rolePaths             = make(map[string][]string)
+		methodRules           []methodRule
+	)
+	for _, rule := range policy.Rules {
+		if len(rule.Methods) > 0 {
+			for _, method := range rule.Methods {
+				methodRules = append(methodRules, methodRule{strings.ToUpper(method), rule.Role, rule.Path})
+			}
+			continue
+		}
+		switch rule.Role {
+		case "admin":
+			adminPaths = append(adminPaths, rule.Path)
+		case "user":
+			userPaths = append(userPaths, rule.Path)
+		case "public":
+			publicPaths = append(publicPaths, rule.Path)
+		default:
+			rolePaths[rule.Role] = append(rolePaths[rule.Role], rule.Path)
+		}
+	}
+
+	// The role settings are published together with the rules. They are
+	// stored in the user state while the rules are being changed, so that
+	// snapshot waits for the new rules instead of using the old rules with them.
+	perm.state.roleMut.Lock()
+	defer perm.state.roleMut.Unlock()
+	roles := &roleSettings{graph: graph, permissions: rolePermissions}
+	perm.update(func(rules *ruleSet) {
+		perm.state.roles.Store(roles)
+		rules.roles = roles
+		rules.adminPathPrefixes = adminPaths
+		rules.userPathPrefixes = userPaths
+		rules.publicPathPrefixes = publicPaths
+		rules.rolePathPrefixes = rolePaths
+		rules.methodRules = methodRules
+		rules.rootIsPublic = false
+		rules.loginURL = policy.LoginURL
+		rules.requireConfirmed = policy.RequireConfirmed
+		rules.caseSensitive = policy.CaseSensitive
+		rules.denied = PermissionDenied
+		rules.reasonDenied = make(map[Reason]http.HandlerFunc)
+		for reason, name := range policy.Deny {
+			if r := denyReasons[reason]; r == ReasonNone {
+				rules.denied = rules.denyHandler(name)
+			} else {
+				rules.reasonDenied[r] = rules.denyHandler(name)
+			}
+		}
+	})
+	return nil
+}
+
+// hierarchy returns the role hierarchy of the policy, where admin inherits user
+func (policy *Policy) hierarchy() map[string][]string {
+	hierarchy := map[string][]string{"admin": {"user"}}
+	for name, role := range policy.Roles {
+		hierarchy[name] = append(hierarchy[name], role.Inherits...)
+	}
+	return hierarchy
+}
+
+// validatePolicy checks the given policy, with the deny handlers that are
+// registered in the rule set, and returns all problems with it
+func (rules *ruleSet) validatePolicy(policy *Policy) []*PolicyError {
+	var problems []*PolicyError
+	fail := func(field, format string, args ...any) {
+		problems = append(problems, &PolicyError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if policy.Version != PolicyVersion {
+		fail("version", "unsupported version %d, expected %d", policy.Version, PolicyVersion)
+	}
+	if _, err := url.Parse(policy.LoginURL); err != nil {
+		fail("login_url", "invalid URL %q", policy.LoginURL)
+	}
+
+	roles := map[string]bool{"admin": true, "user": true}
+	for name := range policy.Roles {
+		roles[name] = true
+	}
+	hierarchy := policy.hierarchy()
+	for _, name := range sortedKeys(roles) {
+		role, ok := policy.Roles[name]
+		if !ok {
+			continue
+		}
+		field := "roles." + policyKey(name)
+		if name != "user" && !validRole(name) {
+			fail(field, "invalid role name %q", name)
+		}
+		for i, inherited := range role.Inherits {
+			if !roles[inherited] {
+				fail(fmt.Sprintf("%s.inherits[%d]", field, i), "unknown role %q", inherited)
+			}
+		}
+		if impliedRoles(hierarchy, name)[name] {
+			fail(field+".inherits", "role %q inherits itself", name)
+		}
+		for i, permission := range role.Permissions {
+			if !validPermission(permission) {
+				fail(fmt.Sprintf("%s.permissions[%d]", field, i), "invalid permission %q", permission)
+			}
+		}
+	}
+
+	for i, pattern := range policy.Public {
+		if !validPolicyPath(pattern) {
+			fail(fmt.Sprintf("public[%d]", i), "path %q must start with \"/\"", pattern)
+		}
+	}
+
+	for i, rule := range policy.Rules {
+		field := fmt.Sprintf("rules[%d]", i)
+		if !validPolicyPath(rule.Path) {
+			fail(field+".path", "path %q must start with \"/\"", rule.Path)
+		}
+		switch {
+		case rule.Role == "":
+			fail(field, "missing role")
+		case rule.Role != "public" && !roles[rule.Role]:
+			fail(field+".role", "unknown role %q", rule.Role)
+		}
+		for j, method := range rule.Methods {
+			if !policyMethods[strings.ToUpper(method)] {
+				fail(fmt.Sprintf("%s.methods[%d]", field, j), "unknown method %q", method)
+			}
+		}
+	}
+
+	reasons := make([]string, 0, len(policy.Deny))
+	for reason := range policy.Deny {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		field := "deny." + policyKey(reason)
+		if _, ok := denyReasons[reason]; !ok {
+			fail(field, "unknown reason %q", reason)
+		}
+		if name := policy.Deny[reason]; rules.denyHandler(name) == nil {
+			fail(field, "unknown deny handler %q", name)
+		}
+	}
+	return problems
+}
+
+// validPolicyPath checks if the given path pattern starts with "/" or "=/"
+func validPolicyPath(pattern string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(pattern, "="), "/")
+}
+
+// policyKey returns the given map key as it appears in a field name,
+// quoted if it is not just letters, digits, "_" and "-"
+func policyKey(key string) string {
+	if key != "" && !strings.ContainsFunc(key, func(r rune) bool {
+		return !(r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		return key
+	}
+	return "'" + key + "'"
+}
+
+// joinPolicyErrors joins the given problems into one error
+func joinPolicyErrors(problems []*PolicyError) error {
+	errs := make([]error, len(problems))
+	for i, problem := range problems {
+		errs[i] = problem
+	}
+	return errors.Join(errs...)
+}
+
+// withPolicyFile sets the filename of all policy errors in the given error
+func withPolicyFile(err error, filename string) error {
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	} else {
+		errs = []error{err}
+	}
+	for _, e := range errs {
+		var problem *PolicyError
+		if errors.As(e, &problem) {
+			problem.File = filename
+		}
+	}
+	return err
+}
+
+// detectPolicyFormat guesses the format of a policy document from its first line
+func detectPolicyFormat(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "{"):
+			return policyJSON
+		case strings.HasPrefix(line, "["), tomlKeyValue.MatchString(line):
+			return policyTOML
+		}
+		return policyYAML
+	}
+	return policyYAML
+}
+
+// decodePolicy decodes a policy document in the given format. Also returns a
+// function that finds the line number of a field, like "rules[2].role".
+func decodePolicy(data []byte, format string) (*Policy, func(string) int, error) {
+	var policy Policy
+	switch format {
+	case policyTOML:
+		if err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(&policy); err != nil {
+			return nil, nil, tomlPolicyError(err)
+		}
+		return &policy, tomlLines(data), nil
+	default:
+		// JSON is decoded as YAML, which gives the same line numbers in errors
+		if err := yaml.UnmarshalWithOptions(data, &policy, yaml.DisallowUnknownField()); err != nil {
+			return nil, nil, yamlPolicyError(err)
+		}
+		return &policy, yamlLines(data), nil
+	}
+}
+
+// yamlPolicyError converts a YAML decoding error to a PolicyError
+func yamlPolicyError(err error) error {
+	var yamlErr yaml.Error
+	if !errors.As(err, &yamlErr) {
+		return &PolicyError{Message: err.Error()}
+	}
+	problem := &PolicyError{Message: yamlErr.GetMessage()}
+	if token := yamlErr.GetToken(); token != nil && token.Position != nil {
+		problem.Line = token.Position.Line
+	}
+	return problem
+}
+
+// tomlPolicyError converts a TOML decoding error to one or more PolicyErrors
+func tomlPolicyError(err error) error {
+	var missing *toml.StrictMissingError
+	if errors.As(err, &missing) {
+		problems := make([]*PolicyError, len(missing.Errors))
+		for i := range missing.Errors {
+			line, _ := missing.Errors[i].Position()
+			problems[i] = &PolicyError{Line: line, Field: strings.Join(missing.Errors[i].Key(), "."), Message: "unknown field"}
+		}
+		return joinPolicyErrors(problems)
+	}
+	var decodeErr *toml.DecodeError
+	if errors.As(err, &decodeErr) {
+		line, _ := decodeErr.Position()
+		return &PolicyError{Line: line, Message: strings.TrimPrefix(decodeErr.Error(), "toml: ")}
+	}
+	return &PolicyError{Message: err.Error()}
+}
+
+// yamlLines returns a function that finds the line number of a field in the
+// given YAML or JSON document, or 0 if it is not found
+func yamlLines(data []byte) func(string) int {
+	file, err := parser.ParseBytes(data, 0)
+	return func(field string) int {
+		if err != nil || field == "" {
+			return 0
+		}
+		path, err := yaml.PathString("$." + field)
+		if err != nil {
+			return 0
+		}
+		node, err := path.FilterFile(file)
+		if err != nil || node == nil || node.GetToken() == nil || node.GetToken().Position == nil {
+			return 0
+		}
+		return node.GetToken().Position.Line
+	}
+}
+
+// tomlLines returns a function that finds the line number of a field in the
+// given TOML document, or 0 if it is not found
+func tomlLines(data []byte) func(string) int {
+	var p unstable.Parser
+	p.Reset(data)
+	lines := make(map[string]int)
+	arrayTables := make(map[string]int)
+	lineOf := func(r unstable.Range) int {
+		return p.Shape(r).Start.Line
+	}
+	table := ""
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			table = tomlKey(e.Key())
+			if e.Kind == unstable.ArrayTable {
+				i := arrayTables[table]
+				arrayTables[table]++
+				table = fmt.Sprintf("%s[%d]", table, i)
+			}
+			if key := e.Child(); key != nil {
+				lines[table] = lineOf(key.Raw)
+			}
+		case unstable.KeyValue:
+			field := tomlKey(e.Key())
+			if table != "" {
+				field = table + "." + field
+			}
+			tomlValueLines(lines, field, e.Value(), lineOf(e.Raw), lineOf)
+		}
+	}
+	return func(field string) int {
+		return lines[field]
+	}
+}
+
+// tomlValueLines stores the line numbers of the given TOML value, and of the
+// elements and keys in it, if it is an array or an inline table
+func tomlValueLines(lines map[string]int, field string, value *unstable.Node, line int, lineOf func(unstable.Range) int) {
+	lines[field] = line
+	switch value.Kind {
+	case unstable.Array:
+		i := 0
+		for it := value.Children(); it.Next(); i++ {
+			element := it.Node()
+			elementLine := line
+			if element.Raw.Length > 0 {
+				elementLine = lineOf(element.Raw)
+			}
+			tomlValueLines(lines, fmt.Sprintf("%s[%d]", field, i), element, elementLine, lineOf)
+		}
+	case unstable.InlineTable:
+		for it := value.Children(); it.Next(); {
+			kv := it.Node()
+			kvLine := line
+			if kv.Raw.Length > 0 {
+				kvLine = lineOf(kv.Raw)
+			}
+			tomlValueLines(lines, field+"."+tomlKey(kv.Key()), kv.Value(), kvLine, lineOf)
+		}
+	}
+}
+
+// tomlKey returns the given TOML key as a field name, like "roles.editor"
+func tomlKey(it unstable.Iterator) string {
+	var parts []string
+	for it.Next() {
+		parts = append(parts, policyKey(string(it.Node().Data)))
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,214 @@
+package permissions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const yamlPolicy = `# Access rules
+version: 1
+login_url: /login
+public: ["/", "/login"]
+roles:
+  editor:
+    inherits: [user]
+    permissions: ["repo:write"]
+rules:
+  - path: /admin
+    role: admin
+  - path: /edit
+    role: editor
+  - path: /docs
+    role: user
+    methods: [POST]
+deny:
+  forbidden: teapot
+`
+
+const jsonPolicy = `{
+  "version": 1,
+  "login_url": "/login",
+  "public": ["/", "/login"],
+  "roles": {"editor": {"inherits": ["user"], "permissions": ["repo:write"]}},
+  "rules": [
+    {"path": "/admin", "role": "admin"},
+    {"path": "/edit", "role": "editor"},
+    {"path": "/docs", "role": "user", "methods": ["POST"]}
+  ],
+  "deny": {"forbidden": "teapot"}
+}
+`
+
+const tomlPolicy = `version = 1
+login_url = "/login"
+public = ["/", "/login"]
+
+[roles.editor]
+inherits = ["user"]
+permissions = ["repo:write"]
+
+[[rules]]
+path = "/admin"
+role = "admin"
+
+[[rules]]
+path = "/edit"
+role = "editor"
+
+[[rules]]
+path = "/docs"
+role = "user"
+methods = ["POST"]
+
+[deny]
+forbidden = "teapot"
+`
+
+func teapot(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusTeapot)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	for format, doc := range map[string]string{"yaml": yamlPolicy, "json": jsonPolicy, "toml": tomlPolicy} {
+		perm := New()
+		perm.AddDenyHandler("teapot", teapot)
+		if err := perm.LoadPolicy(strings.NewReader(doc)); err != nil {
+			t.Fatalf("Error, the %s policy should be valid: %v", format, err)
+		}
+		if !reflect.DeepEqual(perm.snapshot().adminPathPrefixes, []string{"/admin"}) || !reflect.DeepEqual(perm.snapshot().rolePathPrefixes, map[string][]string{"editor": {"/edit"}}) {
+			t.Errorf("Error, unexpected rules from the %s policy: %v %v", format, perm.snapshot().adminPathPrefixes, perm.snapshot().rolePathPrefixes)
+		}
+		if len(perm.snapshot().methodRules) != 1 || perm.snapshot().methodRules[0] != (methodRule{"POST", "user", "/docs"}) {
+			t.Errorf("Error, unexpected method rules from the %s policy: %v", format, perm.snapshot().methodRules)
+		}
+		if perm.LoginURL() != "/login" || perm.snapshot().rootIsPublic {
+			t.Errorf("Error, unexpected settings from the %s policy", format)
+		}
+		userstate := perm.UserState().(*UserState)
+		if implied := userstate.ImpliedRoles("editor"); !reflect.DeepEqual(implied, []string{"user"}) {
+			t.Errorf("Error, unexpected implied roles from the %s policy: %v", format, implied)
+		}
+		if granted := userstate.RolePermissions("editor"); !reflect.DeepEqual(granted, []string{"repo:write"}) {
+			t.Errorf("Error, unexpected permissions from the %s policy: %v", format, granted)
+		}
+		if d := perm.Decide(httptest.NewRequest(http.MethodGet, "/data", nil)); !d.Allowed {
+			t.Errorf("Error, /data should be public with the %s policy: %s", format, d)
+		}
+	}
+}
+
+func TestPolicyDenyHandler(t *testing.T) {
+	perm := New()
+	perm.AddDenyHandler("teapot", teapot)
+	if err := perm.LoadPolicy(strings.NewReader(yamlPolicy)); err != nil {
+		t.Fatal(err)
+	}
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	for _, c := range loginCookies(t, userstate, "bob") {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	perm.Middleware(http.NotFoundHandler()).ServeHTTP(rec, req)
+	if rec.Code != http.StatusTeapot {
+		t.Error("Error, the deny handler from the policy should be used:", rec.Code)
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		format, doc string
+		line        int
+		field       string
+	}{
+		{"yaml", "version: 1\nrules:\n  - path: /admin\n    role: admin\n  - path: /edit\n    role: editr\n", 6, "rules[1].role"},
+		{"yaml", "version: 1\npublic: [/]\nrole: admin\n", 3, ""},
+		{"yaml", "version: 2\n", 1, "version"},
+		{"json", "{\n  \"version\": 1,\n  \"rules\": [\n    {\"path\": \"admin\", \"role\": \"admin\"}\n  ]\n}\n", 4, "rules[0].path"},
+		{"toml", "version = 1\n\n[[rules]]\npath = \"/docs\"\nrole = \"user\"\nmethods = [\"GET\", \"FETCH\"]\n", 6, "rules[0].methods[1]"},
+		{"toml", "version = 1\n\n[roles.editor]\ninherits = [\"writer\"]\n", 4, "roles.editor.inherits[0]"},
+		{"toml", "version = 1\nlogin = \"/login\"\n", 2, "login"},
+	} {
+		perm := New()
+		err := perm.LoadPolicy(strings.NewReader(tc.doc))
+		var problem *PolicyError
+		if !errors.As(err, &problem) {
+			t.Errorf("Error, the %s policy should be invalid: %v\n%s", tc.format, err, tc.doc)
+			continue
+		}
+		if problem.Line != tc.line || problem.Field != tc.field {
+			t.Errorf("Error, expected a problem with %q at line %d in the %s policy, got: %v", tc.field, tc.line, tc.format, err)
+		}
+		// The rules should not have changed
+		if !reflect.DeepEqual(perm.snapshot().adminPathPrefixes, []string{"/admin"}) || !perm.snapshot().rootIsPublic {
+			t.Error("Error, the rules should not change when a policy is invalid")
+		}
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "policy.yml")
+	if err := os.WriteFile(filename, []byte("version: 1\nrules:\n  - path: /x\n    role: nobody\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err := New().LoadPolicyFile(filename)
+	if err == nil || err.Error() != filename+":4: rules[0].role: unknown role \"nobody\"" {
+		t.Error("Error, unexpected error:", err)
+	}
+}
+
+func TestApplyPolicyAtomically(t *testing.T) {
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	if err := userstate.GrantPermission("editor", "repo:read"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.SetRolePermissions(nil)
+	before := perm.snapshot()
+
+	// A policy that can not be applied changes neither the rules nor the roles
+	cycle := "version: 1\nroles:\n  editor:\n    inherits: [writer]\n  writer:\n    inherits: [editor]\nrules:\n  - path: /edit\n    role: editor\n"
+	var problem *PolicyError
+	if err := perm.LoadPolicy(strings.NewReader(cycle)); !errors.As(err, &problem) {
+		t.Error("Error, expected a problem with the role inheritance, got", err)
+	}
+	if after := perm.snapshot(); after.roles != before.roles || !after.rootIsPublic {
+		t.Error("Error, nothing should change when a policy can not be applied")
+	}
+
+	// The rules and the roles are replaced together, and requests that use
+	// the old rules also use the old roles
+	perm.AddDenyHandler("teapot", teapot)
+	if err := perm.LoadPolicy(strings.NewReader(yamlPolicy)); err != nil {
+		t.Fatal(err)
+	}
+	after := perm.snapshot()
+	if !before.roles.permissions["editor"]["repo:read"] || before.roles.permissions["editor"]["repo:write"] || len(before.rolePathPrefixes) != 0 {
+		t.Error("Error, the old snapshot should keep the old roles and rules")
+	}
+	if !after.roles.permissions["editor"]["repo:write"] || after.roles.permissions["editor"]["repo:read"] || len(after.rolePathPrefixes) != 1 {
+		t.Error("Error, the new snapshot should have the roles and rules of the policy")
+	}
+
+	// Reading the current rules and roles neither locks nor allocates
+	if allocs := testing.AllocsPerRun(100, func() { perm.snapshot() }); allocs != 0 {
+		t.Error("Error, reading the rules should not allocate, got", allocs)
+	}
+
+	// Roles that are changed on the user state are used by the next request
+	if err := userstate.GrantPermission("editor", "repo:admin"); err != nil {
+		t.Fatal(err)
+	}
+	if latest := perm.snapshot(); !latest.roles.permissions["editor"]["repo:admin"] || len(latest.rolePathPrefixes) != 1 {
+		t.Error("Error, the snapshot should have the new roles and the rules of the policy")
+	}
+}
@@ -0,0 +1,72 @@
+package permissions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+)
+
+// Principal is the logged in user of a request, as found by the middleware
+type Principal struct {
+	Username  string   // the username from the login cookie
+	Roles     []string // the sorted names of all roles of the user, including "user" and inherited roles
+	Admin     bool     // true if the user has the "admin" role, directly or by inheriting it
+	SessionID string   // identifies the login cookie, and changes every time the user logs in
+}
+
+// HasRole checks if the principal has the given role, either directly or by inheriting it
+func (p *Principal) HasRole(role string) bool {
+	_, found := slices.BinarySearch(p.Roles, role)
+	return found
+}
+
+// principalKey is the context key for the Principal of a request
+type principalKey struct{}
+
+// NewContext returns a copy of the given context that carries the given Principal.
+// This is done by the middleware, but can also be useful when testing handlers.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the Principal that the middleware stored in the
+// context of a request, and true. Returns nil and false if there is none,
+// for instance because the requested page is public, or because no
+// Permissions middleware has handled the request.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// withPrincipal returns the request with the Principal for the given
+// decision stored in the context, if the decision is for a logged in user.
+// A Principal for the same user that is already in the context is reused.
+func (perm *Permissions) withPrincipal(rules *ruleSet, req *http.Request, d Decision) *http.Request {
+	if !d.Allowed || d.Username == "" {
+		return req
+	}
+	if p, ok := FromContext(req.Context()); ok && p.Username == d.Username {
+		return req
+	}
+	roles := sortedKeys(rules.roles.recordRoles(perm.state.requestUser(req, d.Username)))
+	p := &Principal{
+		Username:  d.Username,
+		Roles:     roles,
+		Admin:     slices.Contains(roles, "admin"),
+		SessionID: sessionID(req),
+	}
+	return req.WithContext(NewContext(req.Context(), p))
+}
+
+// sessionID returns an identifier for the login cookie of the given request,
+// without revealing the cookie itself, or "" if there is no login cookie
+func sessionID(req *http.Request) string {
+	c, err := req.Cookie("user")
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(c.Value))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,78 @@
+package permissions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestFromContext(t *testing.T) {
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	userstate.AddRole("bob", "editor")
+	defer userstate.RemoveRole("bob", "editor")
+
+	var (
+		principal *Principal
+		found     bool
+	)
+	handler := perm.Middleware(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		principal, found = FromContext(req.Context())
+	}))
+	serve := func(path string, cookies []*http.Cookie) {
+		principal, found = nil, false
+		req := cookieRequest(cookies)
+		req.URL.Path = path
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Public pages do not look up the user
+	cookies := loginCookies(t, userstate, "bob")
+	serve("/login", cookies)
+	if found {
+		t.Error("Error, there should be no principal for a public page")
+	}
+
+	serve("/data/1", cookies)
+	if !found {
+		t.Fatal("Error, there should be a principal for a user page")
+	}
+	if principal.Username != "bob" || principal.Admin {
+		t.Errorf("Error, unexpected principal: %+v", principal)
+	}
+	if !slices.Equal(principal.Roles, []string{"editor", "user"}) || !principal.HasRole("editor") || principal.HasRole("admin") {
+		t.Errorf("Error, unexpected roles: %v", principal.Roles)
+	}
+	if principal.SessionID == "" || principal.SessionID != sessionID(cookieRequest(cookies)) {
+		t.Error("Error, the session ID should identify the login cookie:", principal.SessionID)
+	}
+
+	userstate.SetAdminStatus("bob")
+	defer userstate.RemoveAdminStatus("bob")
+	serve("/admin", loginCookies(t, userstate, "bob"))
+	if !found || !principal.Admin || !principal.HasRole("admin") {
+		t.Errorf("Error, bob should be an admin: %+v", principal)
+	}
+
+	// A principal from the context can be used in tests of other handlers
+	ctx := NewContext(context.Background(), &Principal{Username: "alice"})
+	if p, ok := FromContext(ctx); !ok || p.Username != "alice" {
+		t.Error("Error, the principal should be in the context")
+	}
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("Error, there should be no principal in an empty context")
+	}
+}
+
+// cookieRequest returns a request with the given cookies
+func cookieRequest(cookies []*http.Cookie) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
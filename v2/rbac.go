@@ -0,0 +1,158 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidPermission is returned if a permission string is empty or contains whitespace
+var ErrInvalidPermission = errors.New("invalid permission")
+
+// validPermission checks if the given permission string can be granted
+func validPermission(permission string) bool {
+	return permission != "" && !strings.ContainsAny(permission, " \t\r\n")
+}
+
+// GrantPermission grants a permission, like "repo:read", to every user that
+// has the given role, either directly or by inheriting it. A permission that
+// ends with "*", like "repo:*", grants every permission with that prefix.
+func (state *UserState) GrantPermission(role, permission string) error {
+	if role == "" {
+		return ErrInvalidRole
+	}
+	if !validPermission(permission) {
+		return ErrInvalidPermission
+	}
+	state.roleMut.Lock()
+	defer state.roleMut.Unlock()
+	roles := state.roles.Load().clone()
+	if roles.permissions[role] == nil {
+		roles.permissions[role] = make(map[string]bool)
+	}
+	roles.permissions[role][permission] = true
+	state.roles.Store(roles)
+	return nil
+}
+
+// SetRolePermissions replaces all permissions that are granted to roles,
+// given as a map from role names to lists of permissions.
+func (state *UserState) SetRolePermissions(permissions map[string][]string) error {
+	rolePermissions, err := rolePermissionSets(permissions)
+	if err != nil {
+		return err
+	}
+	state.roleMut.Lock()
+	roles := state.roles.Load().clone()
+	roles.permissions = rolePermissions
+	state.roles.Store(roles)
+	state.roleMut.Unlock()
+	return nil
+}
+
+// rolePermissionSets returns the given permissions of each role as sets
+func rolePermissionSets(permissions map[string][]string) (map[string]map[string]bool, error) {
+	rolePermissions := make(map[string]map[string]bool, len(permissions))
+	for role, granted := range permissions {
+		if role == "" {
+			return nil, ErrInvalidRole
+		}
+		rolePermissions[role] = make(map[string]bool, len(granted))
+		for _, permission := range granted {
+			if !validPermission(permission) {
+				return nil, ErrInvalidPermission
+			}
+			rolePermissions[role][permission] = true
+		}
+	}
+	return rolePermissions, nil
+}
+
+// RevokePermission revokes a permission that has been granted to the given role.
+func (state *UserState) RevokePermission(role, permission string) {
+	state.roleMut.Lock()
+	defer state.roleMut.Unlock()
+	if !state.roles.Load().permissions[role][permission] {
+		return
+	}
+	roles := state.roles.Load().clone()
+	delete(roles.permissions[role], permission)
+	state.roles.Store(roles)
+}
+
+// RolePermissions returns the sorted permissions that are granted directly
+// to the given role, not including the permissions of inherited roles.
+func (state *UserState) RolePermissions(role string) []string {
+	return sortedKeys(state.currentRoles().permissions[role])
+}
+
+// Can checks if the given user has the given permission, through any of the
+// roles the user has, directly or by inheriting them.
+func (state *UserState) Can(username, permission string) bool {
+	can, _ := state.CanContext(context.Background(), username, permission)
+	return can
+}
+
+// can checks if any of the given roles has been granted the given permission
+func (roles *roleSettings) can(given map[string]bool, permission string) bool {
+	if !validPermission(permission) {
+		return false
+	}
+	for role := range given {
+		for granted := range roles.permissions[role] {
+			if permissionMatches(granted, permission) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// permissionMatches checks if a granted permission covers the wanted permission
+func permissionMatches(granted, wanted string) bool {
+	if prefix, ok := strings.CutSuffix(granted, "*"); ok {
+		return strings.HasPrefix(wanted, prefix)
+	}
+	return granted == wanted
+}
+
+// Require returns middleware that only lets through logged in users that
+// have the given permission. Other requests are handled just like requests
+// that are rejected by the Permissions middleware. This is useful for
+// protecting individual handlers, for instance when the same path is used
+// for several operations in a JSON API.
+func (perm *Permissions) Require(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Use the same rules for the whole request, even if they are replaced meanwhile
+			rules := perm.snapshot()
+			// Fetch each user only once, for the whole request
+			req = withUserCache(req)
+			path, ok := requestPath(req.URL)
+			if !ok {
+				path = req.URL.EscapedPath()
+			}
+			d := Decision{Path: path, Method: req.Method, Permission: permission}
+			username, r := perm.loginReason(rules, req, &d)
+			if !ok {
+				r = ReasonForbidden
+			}
+			if r == ReasonNone && !rules.roles.can(rules.roles.recordRoles(perm.state.requestUser(req, username)), permission) {
+				r = ReasonForbidden
+			}
+			if r != ReasonNone {
+				d = d.reject("permission", "", "", r)
+			} else {
+				d = d.allow("permission", "", "")
+			}
+			explain(rules, w, req, d)
+			if !d.Allowed {
+				// Redirect to the login page, or call the Permission Denied function
+				perm.deny(rules, w, req, d.Reason)
+				return
+			}
+			next.ServeHTTP(w, perm.withPrincipal(rules, req, d))
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package permissions
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SetLoginURL sets the URL of the login page (like "/login").
+// When set, the middleware redirects anonymous visitors with browsers to the
+// login page, with a signed "next" query parameter that points back to the
+// page they tried to visit. Anonymous API clients get 401 Unauthorized with a
+// WWW-Authenticate header. Logged in users that lack the required rights still
+// get the deny function. Set it to "" to use the deny function for everyone.
+func (perm *Permissions) SetLoginURL(loginURL string) {
+	perm.update(func(rules *ruleSet) {
+		rules.loginURL = loginURL
+	})
+}
+
+// LoginURL returns the URL of the login page, or "" if not set.
+func (perm *Permissions) LoginURL() string {
+	return perm.snapshot().loginURL
+}
+
+// deny handles a rejected request with the given rules, depending on why it was rejected
+func (perm *Permissions) deny(rules *ruleSet, w http.ResponseWriter, req *http.Request, r Reason) {
+	req = req.WithContext(context.WithValue(req.Context(), reasonKey{}, r))
+	if f, ok := rules.reasonDenied[r]; ok {
+		f(w, req)
+		return
+	}
+	if r != ReasonUnauthenticated || rules.loginURL == "" {
+		rules.denied(w, req)
+		return
+	}
+	if !acceptsHTML(req) {
+		w.Header().Set("WWW-Authenticate", `Cookie realm="Restricted", form-action="`+rules.loginURL+`", cookie-name="user"`)
+		writeDenial(w, req, http.StatusUnauthorized, r)
+		return
+	}
+	loginURL, err := url.Parse(rules.loginURL)
+	if err != nil {
+		rules.denied(w, req)
+		return
+	}
+	query := loginURL.Query()
+	query.Set("next", perm.state.SignReturnPath(req.URL.RequestURI()))
+	loginURL.RawQuery = query.Encode()
+	http.Redirect(w, req, loginURL.String(), http.StatusFound)
+}
+
+// acceptsHTML checks if the client accepts HTML, which is what browsers do
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// LocalPath checks if the given URL is a path on this site, and not a link
+// to another site, like "//example.com" or "https://example.com". Paths with
+// control characters are rejected, since browsers drop some of them, so that
+// "/\t/example.com" is followed as "//example.com". So are paths that are links
+// to another site when they are decoded, like "/%2F/example.com".
+func LocalPath(s string) bool {
+	if !localPrefix(s) || hasControl(s) {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return false
+	}
+	return localPrefix(u.Path) && !hasControl(u.Path)
+}
+
+// localPrefix checks if the given path starts with one slash, and not with
+// "//" or "/\", which browsers treat as a link to another site
+func localPrefix(s string) bool {
+	return strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") && !strings.HasPrefix(s, "/\\")
+}
+
+// hasControl checks if the given string contains ASCII control characters
+func hasControl(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// returnPathSignature returns the signature for the given path, using the cookie secret
+func (state *UserState) returnPathSignature(path string) []byte {
+	mac := hmac.New(sha256.New, []byte(state.cookieSecret))
+	mac.Write([]byte("next:" + path))
+	return mac.Sum(nil)
+}
+
+// SignReturnPath signs the given local path (like "/data?page=2"), so that it
+// can be passed to the login page and back without being tampered with.
+func (state *UserState) SignReturnPath(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path)) + "." + base64.RawURLEncoding.EncodeToString(state.returnPathSignature(path))
+}
+
+// VerifyReturnPath checks a path that was signed with SignReturnPath.
+// Returns the path and true if the signature is correct and the path is local.
+func (state *UserState) VerifyReturnPath(signed string) (string, bool) {
+	encodedPath, encodedSignature, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", false
+	}
+	path, err := base64.RawURLEncoding.DecodeString(encodedPath)
+	if err != nil {
+		return "", false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(signature, state.returnPathSignature(string(path))) || !LocalPath(string(path)) {
+		return "", false
+	}
+	return string(path), true
+}
@@ -0,0 +1,251 @@
+package permissions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// aliasKey is the prefix of the Redis keys that point from the old username
+// of a renamed user to the new one, "alias:" + old username. An alias
+// expires by itself.
+const aliasKey = "alias"
+
+// maxAliasHops is how many aliases are followed, for a user that has been
+// renamed several times within the alias lifetime
+const maxAliasHops = 8
+
+// aliasUserKey returns the Redis key for the alias of the given old username
+func aliasUserKey(username string) string {
+	return aliasKey + ":" + username
+}
+
+// renamedUser is what is read about a user before the user is renamed or
+// deleted, for passing the keys to a Lua script
+type renamedUser struct {
+	email             string   // the e-mail address of the user
+	aliasesField      string   // the "aliases" field of the user, as it is stored
+	aliases           []string // the earlier usernames of the user, that may still be aliases
+	passwordResetCode string   // the hash of the password reset code of the user, if any
+	magicLinkCode     string   // the hash of the magic link code of the user, if any
+}
+
+// readRenamedUser reads the e-mail address, the earlier usernames and the
+// hashes of the codes of the given user
+func (state *UserState) readRenamedUser(ctx context.Context, username string) (*renamedUser, error) {
+	fields, err := redis.Strings(state.do(ctx, "HMGET", userKey(username), "email", "aliases", "passwordResetCode", "magicLinkCode"))
+	if err != nil {
+		return nil, err
+	}
+	u := &renamedUser{email: fields[0], aliasesField: fields[1], passwordResetCode: fields[2], magicLinkCode: fields[3]}
+	if u.aliasesField != "" {
+		if err := json.Unmarshal([]byte(u.aliasesField), &u.aliases); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// aliasKeys returns the Redis keys for the aliases of the earlier usernames
+func (u *renamedUser) aliasKeys() []any {
+	keys := make([]any, len(u.aliases))
+	for i, alias := range u.aliases {
+		keys[i] = aliasUserKey(alias)
+	}
+	return keys
+}
+
+// renameUserScript moves a user to a new username, with all the fields, the
+// entries in the sets of usernames and unconfirmed users and the entry in the
+// e-mail index. The new username must not be taken, also not by an alias or
+// a tombstone. Leaves an alias that expires after the given number of
+// milliseconds, if it is not 0. The aliases of earlier usernames are moved
+// to the new username too, and keep their expiry time. Returns "changed" if
+// the e-mail address or the earlier usernames of the user are not the given
+// ones, since the keys are then out of date.
+//
+// The username that a sha256 password hash was made with is kept in the
+// "passwordUsername" field, since it is needed for checking the password.
+// The earlier usernames are kept in the "aliases" field, as a JSON list, for
+// moving or removing their aliases.
+// If the eighth argument is "true", a new username that looks like the
+// username of another user, by having the same skeleton, is taken too.
+//
+// The number of keys is given first, since the user may have several aliases.
+//
+// KEYS: usernames, users:<old>, users:<new>, unconfirmed, emails, alias:<old>, alias:<new>, deleted:<hash of new>, skeletons, alias:<earlier username>...
+// ARGV: old username, new username, e-mail address, e-mail index key, alias lifetime, skeleton of old, skeleton of new, reject confusable usernames, aliases field, new aliases field
+var renameUserScript = redis.NewScript(-1, `
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 0 then
+	return "missing"
+end
+if redis.call("SISMEMBER", KEYS[1], ARGV[2]) == 1 or redis.call("EXISTS", KEYS[7]) == 1 or redis.call("EXISTS", KEYS[8]) == 1 then
+	return "exists"
+end
+local lookalike = redis.call("HGET", KEYS[9], ARGV[7])
+if lookalike and (lookalike == ARGV[1] or redis.call("SISMEMBER", KEYS[1], lookalike) == 0) then
+	lookalike = false
+end
+if lookalike and ARGV[8] == "true" then
+	return "confusable"
+end
+if (redis.call("HGET", KEYS[2], "email") or "") ~= ARGV[3] or (redis.call("HGET", KEYS[2], "aliases") or "") ~= ARGV[9] then
+	return "changed"
+end
+redis.call("SREM", KEYS[1], ARGV[1])
+redis.call("SADD", KEYS[1], ARGV[2])
+redis.call("DEL", KEYS[3])
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	redis.call("RENAME", KEYS[2], KEYS[3])
+	redis.call("HSETNX", KEYS[3], "passwordUsername", ARGV[1])
+	redis.call("HSET", KEYS[3], "renamedFrom", ARGV[1])
+	if ARGV[10] ~= "" then
+		redis.call("HSET", KEYS[3], "aliases", ARGV[10])
+	else
+		redis.call("HDEL", KEYS[3], "aliases")
+	end
+end
+for i = 10, #KEYS do
+	if redis.call("GET", KEYS[i]) == ARGV[1] then
+		local ttl = redis.call("PTTL", KEYS[i])
+		if ttl > 0 then
+			redis.call("SET", KEYS[i], ARGV[2], "PX", ttl)
+		end
+	end
+end
+if redis.call("SREM", KEYS[4], ARGV[1]) == 1 then
+	redis.call("SADD", KEYS[4], ARGV[2])
+end
+if ARGV[4] ~= "" and redis.call("HGET", KEYS[5], ARGV[4]) == ARGV[1] then
+	redis.call("HSET", KEYS[5], ARGV[4], ARGV[2])
+end
+if redis.call("HGET", KEYS[9], ARGV[6]) == ARGV[1] then
+	redis.call("HDEL", KEYS[9], ARGV[6])
+end
+if not lookalike then
+	redis.call("HSET", KEYS[9], ARGV[7], ARGV[2])
+end
+redis.call("DEL", KEYS[6])
+if tonumber(ARGV[5]) > 0 then
+	redis.call("SET", KEYS[6], ARGV[2], "PX", ARGV[5])
+end
+return "ok"
+`)
+
+// SetAliasLifetime sets for how long the old username of a renamed user
+// keeps working, for login cookies, and can not be used by another user. The
+// default is 24 hours, which is as long as login cookies last by default, and
+// 0 leaves no alias.
+func (state *UserState) SetAliasLifetime(lifetime time.Duration) {
+	state.aliasLifetime = lifetime
+}
+
+// RenameUser gives a user a new username, in one atomic operation. All the
+// fields of the user, like the password hash, the login status and the
+// roles, are moved, and so are the entries in the list of unconfirmed users
+// and in the e-mail index. The new username must be allowed by the username
+// profile and normalized already, like for CreateUser. Returns ErrNotFound if
+// the user does not exist, ErrUserExists if the new username is taken, or
+// ErrUsernameConfusable if it looks like the username of another user.
+//
+// The old username is kept as an alias for the alias lifetime, so that login
+// cookies for the old username keep working, and so that nobody else can take
+// the old username in the meantime. The aliases of earlier usernames are
+// moved to the new username.
+func (state *UserState) RenameUser(ctx context.Context, oldUsername, newUsername string) error {
+	rejectConfusable, err := state.checkNewUsername(newUsername)
+	if err != nil {
+		return err
+	}
+	if oldUsername == newUsername {
+		return ErrUserExists
+	}
+	tombstoneKey, err := state.deletedUserKey(ctx, newUsername)
+	if err != nil {
+		return err
+	}
+	for {
+		u, err := state.readRenamedUser(ctx, oldUsername)
+		if err != nil {
+			return err
+		}
+		newAliases, err := state.newAliasesField(ctx, oldUsername, u.aliases)
+		if err != nil {
+			return err
+		}
+		keys := append([]any{9 + len(u.aliases),
+			usernamesKey, userKey(oldUsername), userKey(newUsername), unconfirmedKey, emailsKey,
+			aliasUserKey(oldUsername), aliasUserKey(newUsername), tombstoneKey, skeletonsKey}, u.aliasKeys()...)
+		result, err := redis.String(state.script(ctx, renameUserScript, append(keys,
+			oldUsername, newUsername, u.email, emailIndexKey(u.email), state.aliasLifetime.Milliseconds(),
+			skeleton(oldUsername), skeleton(newUsername), rejectConfusable, u.aliasesField, newAliases)...))
+		if err != nil {
+			return err
+		}
+		switch result {
+		case "changed":
+			// The e-mail address or the aliases were changed right before the user was renamed
+			continue
+		case "missing":
+			return ErrNotFound
+		case "exists":
+			return ErrUserExists
+		case "confusable":
+			return ErrUsernameConfusable
+		}
+		state.invalidateUser(oldUsername, true)
+		state.invalidateUser(newUsername, true)
+		return nil
+	}
+}
+
+// newAliasesField returns the "aliases" field for the new username of the
+// given user, with the earlier usernames that are still aliases for the user,
+// and the old username, if it is kept as an alias. Returns "" if there are none.
+func (state *UserState) newAliasesField(ctx context.Context, oldUsername string, aliases []string) (string, error) {
+	var kept []string
+	if len(aliases) > 0 {
+		keys := make([]any, len(aliases))
+		for i, alias := range aliases {
+			keys[i] = aliasUserKey(alias)
+		}
+		targets, err := redis.Strings(state.do(ctx, "MGET", keys...))
+		if err != nil {
+			return "", err
+		}
+		for i, target := range targets {
+			if target == oldUsername {
+				kept = append(kept, aliases[i])
+			}
+		}
+	}
+	if state.aliasLifetime > 0 {
+		kept = append(kept, oldUsername)
+	}
+	if len(kept) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(kept)
+	return string(b), err
+}
+
+// cookieUser returns the username from the login cookie, and the fields of
+// the user. The alias of a user that has been renamed is followed.
+func (state *UserState) cookieUser(req *http.Request) (string, *userRecord, error) {
+	username, err := state.UsernameCookie(req)
+	if err != nil {
+		return "", &userRecord{}, err
+	}
+	u := state.requestUser(req, username)
+	for range maxAliasHops {
+		if u.exists || u.alias == "" {
+			break
+		}
+		username = u.alias
+		u = state.requestUser(req, username)
+	}
+	return username, u, nil
+}
@@ -0,0 +1,127 @@
+package permissions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestRenameUser(t *testing.T) {
+	ctx := context.Background()
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	userstate.SetTombstoneLifetime(0)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.DeleteUser(ctx, "bob")
+	defer userstate.DeleteUser(ctx, "robert")
+	userstate.AddUnconfirmed("bob", "abc123")
+	userstate.SetAdminStatus("bob")
+	userstate.AddRole("bob", "editor")
+	cookies := loginCookies(t, userstate, "bob")
+
+	if err := userstate.RenameUser(ctx, "bob", "robert"); err != nil {
+		t.Fatal(err)
+	}
+	if userstate.HasUser("bob") || !userstate.HasUser("robert") {
+		t.Error("Error, bob should have been renamed to robert")
+	}
+	if !userstate.CorrectPassword("robert", "hunter1") || !userstate.IsAdmin("robert") || !userstate.IsLoggedIn("robert") {
+		t.Error("Error, the password, admin status and login status should have been moved")
+	}
+	if !slices.Equal(userstate.Roles("robert"), []string{"admin", "editor"}) {
+		t.Error("Error, the roles should have been moved, got", userstate.Roles("robert"))
+	}
+	if code, _ := userstate.ConfirmationCode("robert"); code != "abc123" {
+		t.Error("Error, the confirmation code should have been moved, got", code)
+	}
+	if unconfirmed, _ := userstate.AllUnconfirmedUsernames(); !slices.Contains(unconfirmed, "robert") || slices.Contains(unconfirmed, "bob") {
+		t.Error("Error, robert should be unconfirmed instead of bob, got", unconfirmed)
+	}
+	if username, err := userstate.HasEmail("bob@zombo.com"); err != nil || username != "robert" {
+		t.Error("Error, expected robert to have the e-mail address, got", username, err)
+	}
+
+	// Old login cookies keep working, for the new username
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if username, err := userstate.UsernameCookie(req); err != nil || username != "bob" {
+		t.Error("Error, the cookie should only be read, and have the old username, got", username, err)
+	}
+	if d := perm.Decide(req); !d.Allowed || d.Username != "robert" {
+		t.Error("Error, robert should be allowed to visit /admin with the old cookie:", d)
+	}
+
+	// The old username can not be taken while the alias exists
+	if err := userstate.CreateUser(ctx, "bob", "hunter2", "bob2@zombo.com"); err != ErrUserExists {
+		t.Error("Error, expected ErrUserExists, got", err)
+	}
+	userstate.AddUser("alice", "hunter1", "alice@zombo.com")
+	defer userstate.DeleteUser(ctx, "alice")
+	for _, username := range []string{"bob", "robert"} {
+		if err := userstate.RenameUser(ctx, "alice", username); err != ErrUserExists {
+			t.Errorf("Error, expected ErrUserExists when renaming alice to %s, got %v", username, err)
+		}
+	}
+	if err := userstate.RenameUser(ctx, "nobody", "somebody"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+
+	// The aliases of earlier usernames are moved when the user is renamed again
+	if err := userstate.RenameUser(ctx, "robert", "bobby"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.DeleteUser(ctx, "bobby")
+	for _, username := range []string{"bob", "robert"} {
+		if target, err := redis.String(userstate.do(ctx, "GET", aliasUserKey(username))); err != nil || target != "bobby" {
+			t.Errorf("Error, expected the alias of %s to point to bobby, got %q and %v", username, target, err)
+		}
+	}
+	if d := perm.Decide(req); !d.Allowed || d.Username != "bobby" {
+		t.Error("Error, expected the old cookie to be for bobby:", d)
+	}
+
+	// Deleting the user also removes the aliases
+	if err := userstate.DeleteUser(ctx, "bobby"); err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"bob", "robert"} {
+		if err := userstate.CreateUser(ctx, username, "hunter2", username+"2@zombo.com"); err != nil {
+			t.Errorf("Error, %s should be available again: %v", username, err)
+		}
+	}
+}
+
+func TestRenameUserSha256(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	userstate.SetTombstoneLifetime(0)
+	userstate.SetAliasLifetime(0)
+	if err := userstate.SetPasswordAlgo("sha256"); err != nil {
+		t.Fatal(err)
+	}
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.DeleteUser(ctx, "bob")
+	defer userstate.DeleteUser(ctx, "robert")
+	defer userstate.DeleteUser(ctx, "bobby")
+
+	// The password hash is made with the first username
+	if err := userstate.RenameUser(ctx, "bob", "robert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.RenameUser(ctx, "robert", "bobby"); err != nil {
+		t.Fatal(err)
+	}
+	if !userstate.CorrectPassword("bobby", "hunter1") || userstate.CorrectPassword("bobby", "hunter2") {
+		t.Error("Error, the password of bobby should be hunter1")
+	}
+	userstate.SetPassword("bobby", "hunter2")
+	if !userstate.CorrectPassword("bobby", "hunter2") {
+		t.Error("Error, the new password of bobby should be hunter2")
+	}
+}
@@ -0,0 +1,138 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// userRecord is a copy of the fields of one user, fetched from Redis in one round trip
+type userRecord struct {
+	exists bool              // true if the user is in the set of usernames
+	fields map[string]string // all fields of the user, like "loggedin" and "admin"
+	alias  string            // the new username, if the user has been renamed
+}
+
+// userCache holds the users that have been fetched while handling one request
+type userCache struct {
+	mut   sync.Mutex
+	users map[string]*userRecord
+}
+
+// userCacheKey is the context key for the userCache of a request
+type userCacheKey struct{}
+
+// withUserCache returns the request with an empty userCache in the context,
+// or the request itself if it already has one
+func withUserCache(req *http.Request) *http.Request {
+	if _, ok := req.Context().Value(userCacheKey{}).(*userCache); ok {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), userCacheKey{}, &userCache{users: make(map[string]*userRecord)}))
+}
+
+// requestUser returns the fields of the given user. If the request has a
+// userCache, the user is only fetched once for the whole request. The user
+// cache of the process is used, if it is enabled.
+func (state *UserState) requestUser(req *http.Request, username string) *userRecord {
+	cache, ok := req.Context().Value(userCacheKey{}).(*userCache)
+	if !ok {
+		return state.cachedUser(req.Context(), username)
+	}
+	cache.mut.Lock()
+	defer cache.mut.Unlock()
+	if u, ok := cache.users[username]; ok {
+		return u
+	}
+	u := state.cachedUser(req.Context(), username)
+	cache.users[username] = u
+	return u
+}
+
+// fetchUser checks if the given user exists and gets all the fields of the
+// user, with HGETALL, and the alias of the username, in one round trip. Returns a user that does not exist,
+// and the error, if there are errors.
+func (state *UserState) fetchUser(ctx context.Context, username string) (*userRecord, error) {
+	replies, err := state.exec(ctx,
+		cmd("SISMEMBER", usernamesKey, username),
+		cmd("HGETALL", userKey(username)),
+		cmd("GET", aliasUserKey(username)),
+	)
+	if err != nil {
+		return &userRecord{}, err
+	}
+	exists, err := redis.Bool(replies[0], nil)
+	if err != nil {
+		return &userRecord{}, err
+	}
+	fields, err := redis.StringMap(replies[1], nil)
+	if err != nil {
+		return &userRecord{}, err
+	}
+	alias, err := redis.String(replies[2], nil)
+	if err != nil && !errors.Is(err, redis.ErrNil) {
+		return &userRecord{}, err
+	}
+	return &userRecord{exists: exists, fields: fields, alias: alias}, nil
+}
+
+// boolean returns true if the user exists and the given field is "true"
+func (u *userRecord) boolean(fieldname string) bool {
+	return u.exists && u.fields[fieldname] == "true"
+}
+
+// loggedIn checks if the user is logged in, like IsLoggedIn
+func (u *userRecord) loggedIn() bool {
+	return u.boolean("loggedin")
+}
+
+// admin checks if the user is an administrator, like IsAdmin
+func (u *userRecord) admin() bool {
+	return u.boolean("admin")
+}
+
+// confirmed checks if the user has been confirmed, like IsConfirmed
+func (u *userRecord) confirmed() bool {
+	return u.boolean("confirmed")
+}
+
+// locked checks if the user is locked out, like IsLocked
+func (u *userRecord) locked() bool {
+	unixTime, err := strconv.ParseInt(u.fields["lockedUntil"], 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Unix() < unixTime
+}
+
+// roles returns the sorted names of the roles that the user has been given,
+// including "admin" for administrators, like Roles
+func (u *userRecord) roles() []string {
+	roles := []string{}
+	if u.admin() {
+		roles = append(roles, "admin")
+	}
+	for fieldname, value := range u.fields {
+		if role, ok := strings.CutPrefix(fieldname, rolePrefix); ok && u.exists && value == "true" {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// recordRoles returns all roles of the given user, including "user" and
+// every inherited role, like EffectiveRoles
+func (roles *roleSettings) recordRoles(u *userRecord) map[string]bool {
+	if !u.exists {
+		return map[string]bool{}
+	}
+	return roles.effectiveRoles(append(u.roles(), "user"))
+}
@@ -0,0 +1,97 @@
+package permissions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRequestUser(t *testing.T) {
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	userstate.SetAdminStatus("bob")
+	defer userstate.RemoveAdminStatus("bob")
+	userstate.AddRole("bob", "editor")
+	defer userstate.RemoveRole("bob", "editor")
+	userstate.Lock("bob", time.Minute)
+	defer userstate.Unlock("bob")
+
+	// The fields that are fetched in one round trip agree with the other functions
+	u, err := userstate.fetchUser(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.exists || u.admin() != userstate.IsAdmin("bob") || u.locked() != userstate.IsLocked("bob") || u.confirmed() != userstate.IsConfirmed("bob") {
+		t.Errorf("Error, unexpected fields: %v", u.fields)
+	}
+	if !slices.Equal(u.roles(), userstate.Roles("bob")) {
+		t.Errorf("Error, expected the roles %v, got %v", userstate.Roles("bob"), u.roles())
+	}
+	if !slices.Equal(sortedKeys(userstate.currentRoles().recordRoles(u)), userstate.EffectiveRoles("bob")) {
+		t.Errorf("Error, expected the effective roles %v, got %v", userstate.EffectiveRoles("bob"), sortedKeys(userstate.currentRoles().recordRoles(u)))
+	}
+	if u, _ := userstate.fetchUser(context.Background(), "nobody"); u.exists || u.loggedIn() || len(u.roles()) != 0 {
+		t.Error("Error, a user that does not exist should have no fields")
+	}
+
+	// The user is only fetched once for a request
+	req := withUserCache(httptest.NewRequest(http.MethodGet, "/", nil))
+	userstate.SetLoggedIn("bob")
+	if !userstate.requestUser(req, "bob").loggedIn() {
+		t.Error("Error, bob should be logged in")
+	}
+	userstate.SetLoggedOut("bob")
+	if !userstate.requestUser(req, "bob").loggedIn() {
+		t.Error("Error, bob should still be logged in for the same request")
+	}
+	if userstate.requestUser(withUserCache(httptest.NewRequest(http.MethodGet, "/", nil)), "bob").loggedIn() {
+		t.Error("Error, bob should be logged out for a new request")
+	}
+}
+
+// adminRequest returns a request for an admin page, from a logged in admin
+func adminRequest(b *testing.B, userstate *UserState) *http.Request {
+	rec := httptest.NewRecorder()
+	if err := userstate.Login(rec, "bob"); err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func BenchmarkAdminRequest(b *testing.B) {
+	perm := New()
+	userstate := perm.UserState().(*UserState)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	userstate.SetAdminStatus("bob")
+	defer userstate.RemoveAdminStatus("bob")
+	req := adminRequest(b, userstate)
+
+	// One round trip for each check, like before the fields were fetched together
+	b.Run("separate", func(b *testing.B) {
+		for b.Loop() {
+			username, err := userstate.UsernameCookie(req)
+			if err != nil || !userstate.IsLoggedIn(username) || userstate.IsLocked(username) || !userstate.HasEffectiveRole(username, "admin") {
+				b.Fatal("bob should be let through")
+			}
+		}
+	})
+
+	// One round trip for the whole request
+	b.Run("pipelined", func(b *testing.B) {
+		for b.Loop() {
+			if perm.Rejected(nil, req) {
+				b.Fatal("bob should be let through")
+			}
+		}
+	})
+}
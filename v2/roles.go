@@ -0,0 +1,223 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// rolePrefix is the prefix for the user fields that store custom roles
+const rolePrefix = "role:"
+
+// ErrInvalidRole is returned if a role name is empty, contains colons or
+// whitespace, or is one of the implicit roles "user" and "public"
+var ErrInvalidRole = errors.New("invalid role name")
+
+// validRole checks if the given role name can be stored for a user
+func validRole(role string) bool {
+	if role == "" || role == "user" || role == "public" {
+		return false
+	}
+	return !strings.ContainsFunc(role, func(r rune) bool {
+		return r == ':' || unicode.IsSpace(r)
+	})
+}
+
+// AddRole gives the given user a named role, like "editor" or "billing".
+// Adding the "admin" role is the same as calling SetAdminStatus.
+func (state *UserState) AddRole(username, role string) error {
+	return state.AddRoleContext(context.Background(), username, role)
+}
+
+// RemoveRole removes a named role from the given user.
+// Removing the "admin" role is the same as calling RemoveAdminStatus.
+func (state *UserState) RemoveRole(username, role string) error {
+	return state.RemoveRoleContext(context.Background(), username, role)
+}
+
+// HasRole checks if the given user has the given role. All users have the
+// "user" role, while the "admin" role is the same as IsAdmin.
+func (state *UserState) HasRole(username, role string) bool {
+	hasRole, _ := state.HasRoleContext(context.Background(), username, role)
+	return hasRole
+}
+
+// Roles returns the sorted names of the roles that the given user has been
+// given, including "admin" for administrators. The implicit "user" role is
+// not included. Returns an empty list if the user has no roles, or if there
+// are errors.
+func (state *UserState) Roles(username string) []string {
+	roles, err := state.RolesContext(context.Background(), username)
+	if err != nil {
+		return []string{}
+	}
+	return roles
+}
+
+// ErrRoleCycle is returned if a role inheritance would make a role inherit itself
+var ErrRoleCycle = errors.New("role inheritance cycle")
+
+// AddRoleInheritance lets every user with the given role also have the
+// inherited role, and every role that the inherited role implies. For
+// example, "admin" can inherit "editor", while "editor" inherits "user".
+// By default, "admin" inherits "user". Returns ErrRoleCycle if the inherited
+// role already inherits the given role.
+func (state *UserState) AddRoleInheritance(role, inherited string) error {
+	if role == "" || inherited == "" {
+		return ErrInvalidRole
+	}
+	state.roleMut.Lock()
+	defer state.roleMut.Unlock()
+	if role == inherited || impliedRoles(state.roles.Load().graph, inherited)[role] {
+		return ErrRoleCycle
+	}
+	for _, existing := range state.roles.Load().graph[role] {
+		if existing == inherited {
+			return nil
+		}
+	}
+	roles := state.roles.Load().clone()
+	roles.graph[role] = append(roles.graph[role], inherited)
+	state.roles.Store(roles)
+	return nil
+}
+
+// SetRoleHierarchy replaces all role inheritances. The given map is from a
+// role to the roles it inherits. Returns ErrRoleCycle, and keeps the current
+// hierarchy, if a role would inherit itself.
+func (state *UserState) SetRoleHierarchy(hierarchy map[string][]string) error {
+	graph, err := roleGraph(hierarchy)
+	if err != nil {
+		return err
+	}
+	state.roleMut.Lock()
+	roles := state.roles.Load().clone()
+	roles.graph = graph
+	state.roles.Store(roles)
+	state.roleMut.Unlock()
+	return nil
+}
+
+// roleGraph returns a copy of the given role hierarchy. Returns ErrRoleCycle
+// if a role would inherit itself.
+func roleGraph(hierarchy map[string][]string) (map[string][]string, error) {
+	graph := make(map[string][]string, len(hierarchy))
+	for role, inherited := range hierarchy {
+		if role == "" {
+			return nil, ErrInvalidRole
+		}
+		for _, r := range inherited {
+			if r == "" {
+				return nil, ErrInvalidRole
+			}
+		}
+		graph[role] = append([]string{}, inherited...)
+	}
+	for role := range graph {
+		if impliedRoles(graph, role)[role] {
+			return nil, ErrRoleCycle
+		}
+	}
+	return graph, nil
+}
+
+// ImpliedRoles returns the sorted names of all roles that the given role
+// inherits, directly or indirectly. The given role is not included.
+func (state *UserState) ImpliedRoles(role string) []string {
+	return sortedKeys(impliedRoles(state.currentRoles().graph, role))
+}
+
+// EffectiveRoles returns the sorted names of all roles the given user has,
+// including "user" and every inherited role. Returns an empty list if the
+// user does not exist.
+func (state *UserState) EffectiveRoles(username string) []string {
+	roles, err := state.EffectiveRolesContext(context.Background(), username)
+	if err != nil {
+		return []string{}
+	}
+	return roles
+}
+
+// HasEffectiveRole checks if the given user has the given role, either
+// directly or by inheriting it from another role.
+func (state *UserState) HasEffectiveRole(username, role string) bool {
+	hasRole, _ := state.HasEffectiveRoleContext(context.Background(), username, role)
+	return hasRole
+}
+
+// roleSettings holds the role inheritances and the permissions that are
+// granted to roles. The settings are never changed, only replaced, so that
+// the role settings and the rules of a policy can be replaced together.
+type roleSettings struct {
+	graph       map[string][]string        // Which roles each role implies, for role inheritance
+	permissions map[string]map[string]bool // Which permissions are granted to each role
+}
+
+// newRoleSettings returns the default role settings, where administrators
+// inherit the user role
+func newRoleSettings() *roleSettings {
+	return &roleSettings{graph: map[string][]string{"admin": {"user"}}}
+}
+
+// clone returns a copy of the role settings, that can be modified
+func (roles *roleSettings) clone() *roleSettings {
+	c := &roleSettings{
+		graph:       make(map[string][]string, len(roles.graph)),
+		permissions: make(map[string]map[string]bool, len(roles.permissions)),
+	}
+	for role, inherited := range roles.graph {
+		c.graph[role] = slices.Clone(inherited)
+	}
+	for role, granted := range roles.permissions {
+		c.permissions[role] = maps.Clone(granted)
+	}
+	return c
+}
+
+// currentRoles returns the current role settings, which must not be modified
+func (state *UserState) currentRoles() *roleSettings {
+	return state.roles.Load()
+}
+
+// effectiveRoles returns the given roles together with all inherited roles
+func (roles *roleSettings) effectiveRoles(given []string) map[string]bool {
+	effective := make(map[string]bool)
+	for _, role := range given {
+		effective[role] = true
+		for implied := range impliedRoles(roles.graph, role) {
+			effective[implied] = true
+		}
+	}
+	return effective
+}
+
+// impliedRoles returns all roles that the given role inherits, directly or
+// indirectly, by traversing the given role graph
+func impliedRoles(graph map[string][]string, role string) map[string]bool {
+	implied := make(map[string]bool)
+	queue := append([]string{}, graph[role]...)
+	for len(queue) > 0 {
+		r := queue[0]
+		queue = queue[1:]
+		if implied[r] {
+			continue
+		}
+		implied[r] = true
+		queue = append(queue, graph[r]...)
+	}
+	return implied
+}
+
+// sortedKeys returns the keys of the given set, sorted
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,125 @@
+package permissions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	userstate := NewUserStateSimple()
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+
+	if !userstate.HasRole("bob", "user") {
+		t.Error("Error, all users should have the user role")
+	}
+	if userstate.HasRole("bob", "editor") {
+		t.Error("Error, bob should not be an editor yet")
+	}
+	if err := userstate.AddRole("bob", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.AddRole("bob", "billing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.AddRole("bob", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if !userstate.HasRole("bob", "editor") || !userstate.IsAdmin("bob") {
+		t.Error("Error, bob should be an editor and an administrator")
+	}
+	if roles := userstate.Roles("bob"); !reflect.DeepEqual(roles, []string{"admin", "billing", "editor"}) {
+		t.Error("Error, unexpected roles:", roles)
+	}
+	if err := userstate.RemoveRole("bob", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.RemoveRole("bob", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if roles := userstate.Roles("bob"); !reflect.DeepEqual(roles, []string{"billing"}) {
+		t.Error("Error, unexpected roles:", roles)
+	}
+	userstate.RemoveRole("bob", "billing")
+
+	for _, role := range []string{"", "user", "public", "a:b", "a b"} {
+		if err := userstate.AddRole("bob", role); err != ErrInvalidRole {
+			t.Errorf("Error, %q should not be a valid role name", role)
+		}
+	}
+}
+
+func TestRoleHierarchy(t *testing.T) {
+	userstate := NewUserStateSimple()
+	if err := userstate.AddRoleInheritance("admin", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.AddRoleInheritance("editor", "writer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.AddRoleInheritance("writer", "admin"); err != ErrRoleCycle {
+		t.Error("Error, a role inheritance cycle should be detected")
+	}
+	if err := userstate.AddRoleInheritance("editor", "editor"); err != ErrRoleCycle {
+		t.Error("Error, a role should not be able to inherit itself")
+	}
+	if implied := userstate.ImpliedRoles("admin"); !reflect.DeepEqual(implied, []string{"editor", "user", "writer"}) {
+		t.Error("Error, unexpected implied roles:", implied)
+	}
+
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	userstate.AddRole("bob", "editor")
+	defer userstate.RemoveRole("bob", "editor")
+
+	if roles := userstate.EffectiveRoles("bob"); !reflect.DeepEqual(roles, []string{"editor", "user", "writer"}) {
+		t.Error("Error, unexpected effective roles:", roles)
+	}
+	if !userstate.HasEffectiveRole("bob", "writer") || userstate.HasEffectiveRole("bob", "admin") {
+		t.Error("Error, bob should be a writer, but not an administrator")
+	}
+
+	if err := userstate.SetRoleHierarchy(map[string][]string{"a": {"b"}, "b": {"a"}}); err != ErrRoleCycle {
+		t.Error("Error, a role inheritance cycle should be detected")
+	}
+	if err := userstate.SetRoleHierarchy(map[string][]string{"admin": {"user"}}); err != nil {
+		t.Fatal(err)
+	}
+	if userstate.HasEffectiveRole("bob", "writer") {
+		t.Error("Error, bob should no longer be a writer")
+	}
+}
+
+func TestPermissionStrings(t *testing.T) {
+	userstate := NewUserStateSimple()
+	if err := userstate.GrantPermission("editor", "repo write"); err != ErrInvalidPermission {
+		t.Error("Error, a permission with whitespace should be rejected")
+	}
+	userstate.GrantPermission("editor", "repo:write")
+	userstate.GrantPermission("user", "repo:read")
+	userstate.GrantPermission("admin", "billing:*")
+	if perms := userstate.RolePermissions("editor"); !reflect.DeepEqual(perms, []string{"repo:write"}) {
+		t.Error("Error, unexpected role permissions:", perms)
+	}
+
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	userstate.AddRole("bob", "editor")
+	defer userstate.RemoveRole("bob", "editor")
+	defer userstate.RemoveAdminStatus("bob")
+
+	if !userstate.Can("bob", "repo:write") || !userstate.Can("bob", "repo:read") {
+		t.Error("Error, bob should be able to read and write repositories")
+	}
+	if userstate.Can("bob", "billing:refund") || userstate.Can("nobody", "repo:read") {
+		t.Error("Error, only administrators should have billing permissions")
+	}
+	userstate.SetAdminStatus("bob")
+	if !userstate.Can("bob", "billing:refund") {
+		t.Error("Error, the billing:* permission should cover billing:refund")
+	}
+	userstate.RevokePermission("editor", "repo:write")
+	if userstate.Can("bob", "repo:write") {
+		t.Error("Error, the permission should have been revoked")
+	}
+}
@@ -0,0 +1,106 @@
+package permissions
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// ruleSet is a snapshot of the rules and settings of a Permissions struct.
+// A ruleSet is never modified after it has been made current. Changes are
+// made to a copy, which then atomically replaces the current ruleSet, so that
+// a request always sees either all or none of the changes, and so that rules
+// can be changed while requests are being handled, without locking.
+type ruleSet struct {
+	adminPathPrefixes  []string
+	userPathPrefixes   []string
+	publicPathPrefixes []string
+	rootIsPublic       bool
+	denied             http.HandlerFunc
+	loginURL           string
+	requireConfirmed   bool
+	debug              bool
+	rolePathPrefixes   map[string][]string
+	methodRules        []methodRule
+	allowOptions       bool
+	caseSensitive      bool
+	reasonDenied       map[Reason]http.HandlerFunc
+	denyHandlers       map[string]http.HandlerFunc
+
+	// The rules, compiled for matching, when the rule set is made current.
+	// The tries for methods with method rules also contain the other rules.
+	paths       *ruleTrie
+	methodPaths map[string]*ruleTrie
+
+	// The role settings of the user state, published together with the
+	// rules, so that ApplyPolicy can replace both in one step
+	roles *roleSettings
+}
+
+// clone returns a copy of the rule set, that can be modified
+func (rules *ruleSet) clone() *ruleSet {
+	c := *rules
+	c.adminPathPrefixes = slices.Clone(rules.adminPathPrefixes)
+	c.userPathPrefixes = slices.Clone(rules.userPathPrefixes)
+	c.publicPathPrefixes = slices.Clone(rules.publicPathPrefixes)
+	c.rolePathPrefixes = make(map[string][]string, len(rules.rolePathPrefixes))
+	for role, prefixes := range rules.rolePathPrefixes {
+		c.rolePathPrefixes[role] = slices.Clone(prefixes)
+	}
+	c.methodRules = slices.Clone(rules.methodRules)
+	c.reasonDenied = maps.Clone(rules.reasonDenied)
+	c.denyHandlers = maps.Clone(rules.denyHandlers)
+	c.paths, c.methodPaths = nil, nil
+	return &c
+}
+
+// compile compiles the path rules and method rules for matching
+func (rules *ruleSet) compile() *ruleSet {
+	rules.paths = compileRules(rules.pathRules(), rules.caseSensitive)
+	rules.methodPaths = make(map[string]*ruleTrie)
+	for _, rule := range rules.methodRules {
+		methods := []string{rule.method}
+		if rule.method == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+		}
+		for _, method := range methods {
+			if _, ok := rules.methodPaths[method]; !ok {
+				rules.methodPaths[method] = compileRules(rules.methodPathRules(method), rules.caseSensitive)
+			}
+		}
+	}
+	return rules
+}
+
+// snapshot returns the current rules and settings, which must not be
+// modified, together with the current role settings of the user state.
+// If the role settings have been changed directly on the user state since
+// the rules were published, the rules are published again with them, once.
+func (perm *Permissions) snapshot() *ruleSet {
+	rules := perm.rules.Load()
+	if rules.roles == perm.state.currentRoles() {
+		return rules
+	}
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	rules = perm.rules.Load()
+	if roles := perm.state.currentRoles(); rules.roles != roles {
+		c := *rules
+		c.roles = roles
+		rules = &c
+		perm.rules.Store(rules)
+	}
+	return rules
+}
+
+// update changes a copy of the current rules and settings with the given
+// function, and then makes the copy current. Changes are made one at a time,
+// so that no change is lost.
+func (perm *Permissions) update(f func(rules *ruleSet)) {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	rules := perm.rules.Load().clone()
+	rules.roles = perm.state.currentRoles()
+	f(rules)
+	perm.rules.Store(rules.compile())
+}
@@ -0,0 +1,54 @@
+package permissions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentUpdates(t *testing.T) {
+	perm := New()
+	perm.SetLoginURL("")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Anonymous requests for admin pages are rejected, whatever the public paths are
+				if !perm.Rejected(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/admin/users", nil)) {
+					t.Error("an anonymous request for /admin/users was let through")
+					return
+				}
+				perm.Rejected(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/news/1", nil))
+			}
+		}()
+	}
+
+	for i := range 500 {
+		if i%2 == 0 {
+			perm.SetPublicPath([]string{"/", "/news"})
+		} else {
+			perm.SetPublicPath([]string{"/"})
+		}
+		perm.AddUserPath("/profile")
+		perm.AddMethodPath(http.MethodPost, "admin", "/news")
+		perm.SetCaseSensitive(i%3 == 0)
+		perm.SetDenyFunction(PermissionDenied)
+	}
+	close(stop)
+	wg.Wait()
+
+	// No change was lost
+	if n := len(perm.snapshot().userPathPrefixes); n != 2+500 {
+		t.Errorf("expected %d user paths, got %d", 2+500, n)
+	}
+}
@@ -0,0 +1,144 @@
+package permissions
+
+import (
+	"path"
+)
+
+// ruleTrie holds path rules, compiled into a trie with one level per path
+// segment, so that a path can be matched without parsing or lowercasing
+// the patterns and without checking every pattern.
+type ruleTrie struct {
+	root trieNode
+	size int
+}
+
+// trieNode is one segment of the patterns in a ruleTrie
+type trieNode struct {
+	literals map[string]*trieNode // children for literal segments
+	patterns []trieEdge           // children for glob and wildcard segments
+	entries  []*trieEntry         // patterns that end at this node
+}
+
+// trieEdge is a child of a trieNode, for a glob or wildcard segment
+type trieEdge struct {
+	segment  string
+	wildcard bool
+	node     *trieNode
+}
+
+// trieEntry is a compiled pattern, together with the rule it belongs to
+type trieEntry struct {
+	rule     pathRule
+	raw      string // the pattern, as it was given
+	pattern  pathPattern
+	literals int // the number of literal segments in the pattern
+	order    int // the position of the pattern, for breaking ties
+}
+
+// compileRules compiles the patterns of the given rules into a trie.
+// Literal segments are lowercased once, here, unless caseSensitive is true.
+func compileRules(rules []pathRule, caseSensitive bool) *ruleTrie {
+	t := &ruleTrie{}
+	for _, rule := range rules {
+		for _, raw := range rule.patterns {
+			pattern := parsePattern(raw, caseSensitive)
+			node := &t.root
+			for _, segment := range pattern.segments {
+				node = node.child(segment)
+			}
+			node.entries = append(node.entries, &trieEntry{
+				rule:     rule,
+				raw:      raw,
+				pattern:  pattern,
+				literals: pattern.literals(),
+				order:    t.size,
+			})
+			t.size++
+		}
+	}
+	return t
+}
+
+// child returns the child node for the given pattern segment, and adds it if needed
+func (n *trieNode) child(segment string) *trieNode {
+	if !isWildcard(segment) && !isGlob(segment) {
+		if n.literals == nil {
+			n.literals = make(map[string]*trieNode)
+		}
+		child, ok := n.literals[segment]
+		if !ok {
+			child = &trieNode{}
+			n.literals[segment] = child
+		}
+		return child
+	}
+	for _, edge := range n.patterns {
+		if edge.segment == segment {
+			return edge.node
+		}
+	}
+	child := &trieNode{}
+	n.patterns = append(n.patterns, trieEdge{segment, isWildcard(segment), child})
+	return child
+}
+
+// lookup finds the rule with the most specific pattern that matches the
+// given path segments. If several patterns are equally specific, the one
+// that was compiled first wins. Returns false if no pattern matches.
+func (t *ruleTrie) lookup(segments []string) (pathRule, string, bool) {
+	if t == nil || t.size == 0 {
+		return pathRule{}, "", false
+	}
+	var best *trieEntry
+	t.root.walk(segments, 0, &best)
+	if best == nil {
+		return pathRule{}, "", false
+	}
+	return best.rule, best.raw, true
+}
+
+// walk checks the patterns that end at this node, and then the children
+// that match the segment at position i
+func (n *trieNode) walk(segments []string, i int, best **trieEntry) {
+	for _, e := range n.entries {
+		if e.pattern.matchRest(segments[i:]) && e.better(*best) {
+			*best = e
+		}
+	}
+	if i >= len(segments) {
+		return
+	}
+	s := segments[i]
+	if child, ok := n.literals[s]; ok {
+		child.walk(segments, i+1, best)
+	}
+	if s == "" {
+		// Globs and wildcards never match an empty segment
+		return
+	}
+	for _, edge := range n.patterns {
+		if !edge.wildcard {
+			if matched, err := path.Match(edge.segment, s); err != nil || !matched {
+				continue
+			}
+		}
+		edge.node.walk(segments, i+1, best)
+	}
+}
+
+// better checks if the entry is more specific than the other one, which may be nil
+func (e *trieEntry) better(other *trieEntry) bool {
+	switch {
+	case other == nil:
+		return true
+	case len(e.pattern.segments) != len(other.pattern.segments):
+		return len(e.pattern.segments) > len(other.pattern.segments)
+	case e.literals != other.literals:
+		return e.literals > other.literals
+	case e.pattern.slash != other.pattern.slash:
+		return e.pattern.slash
+	case e.pattern.exact != other.pattern.exact:
+		return e.pattern.exact
+	}
+	return e.order < other.order
+}
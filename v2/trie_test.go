@@ -0,0 +1,125 @@
+package permissions
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// linearBestRule is the matcher that was used before the rules were
+// compiled into a trie. It parses every pattern and checks them all.
+func linearBestRule(rules []pathRule, segments []string, caseSensitive bool) (pathRule, string, bool) {
+	var (
+		found      pathRule
+		foundRaw   string
+		foundMatch pathPattern
+		ok         bool
+	)
+	for _, rule := range rules {
+		for _, raw := range rule.patterns {
+			pattern := parsePattern(raw, caseSensitive)
+			if pattern.match(segments) && (!ok || pattern.moreSpecific(foundMatch)) {
+				found, foundRaw, foundMatch, ok = rule, raw, pattern, true
+			}
+		}
+	}
+	return found, foundRaw, ok
+}
+
+// benchmarkRules returns rules with n patterns in total, in the style of
+// a policy with many tenant and API paths
+func benchmarkRules(n int) []pathRule {
+	roles := []string{"admin", "editor", "user", "public"}
+	patterns := make([][]string, len(roles))
+	for i := range n {
+		var pattern string
+		switch i % 5 {
+		case 0:
+			pattern = fmt.Sprintf("/tenants/Tenant%d", i)
+		case 1:
+			pattern = fmt.Sprintf("/api/v1/resource%d/{id}", i)
+		case 2:
+			pattern = fmt.Sprintf("/static/%d/*.js", i)
+		case 3:
+			pattern = fmt.Sprintf("=/pages/page%d", i)
+		default:
+			pattern = fmt.Sprintf("/files/%d/{path...}", i)
+		}
+		patterns[i%len(roles)] = append(patterns[i%len(roles)], pattern)
+	}
+	rules := make([]pathRule, len(roles))
+	for i, role := range roles {
+		rules[i] = pathRule{ruleName(role), role, patterns[i]}
+	}
+	return rules
+}
+
+// benchmarkPaths returns paths that match some of the rules from benchmarkRules, and a path that matches none
+func benchmarkPaths(n int) []string {
+	return []string{
+		fmt.Sprintf("/tenants/tenant%d/settings", n/2/5*5),
+		fmt.Sprintf("/api/v1/resource%d/42", n/3/5*5+1),
+		fmt.Sprintf("/static/%d/app.js", n-3),
+		fmt.Sprintf("/files/%d/a/b/c.txt", n-1),
+		"/nothing/matches/this",
+	}
+}
+
+func TestRuleTrie(t *testing.T) {
+	rules := append(benchmarkRules(200),
+		pathRule{"admin", "admin", []string{"/admin", "/docs/{$}", "/API/*/settings"}},
+		pathRule{"user", "user", []string{"/docs/", "/api/{version}/settings"}},
+		pathRule{"public", "public", []string{"/", "/admin/help", "/docs"}},
+	)
+	paths := []string{
+		"/", "/admin", "/admin/", "/admin/help", "/admin/help/faq", "/administrators",
+		"/docs", "/docs/", "/docs/intro", "/api/v2/settings", "/api/v2/settings/x",
+		"/pages/page3", "/pages/page3/", "/pages/page8", "/static/2/app.js", "/static/2/app.css",
+		"/files/4", "/files/4/", "/files/4/a/b", "/tenants/tenant0", "/tenants/tenant0/x",
+		"/api/v1/resource1/", "/api/v1/resource1/7", "/api/v1/resource1/7/8",
+	}
+	paths = append(paths, benchmarkPaths(200)...)
+	for _, caseSensitive := range []bool{false, true} {
+		trie := compileRules(rules, caseSensitive)
+		for _, p := range paths {
+			if !caseSensitive {
+				p = strings.ToLower(p)
+			}
+			segments := splitPath(p)
+			wantRule, wantPattern, wantOK := linearBestRule(rules, segments, caseSensitive)
+			gotRule, gotPattern, gotOK := trie.lookup(segments)
+			if gotOK != wantOK || gotPattern != wantPattern || gotRule.role != wantRule.role {
+				t.Errorf("%s (case sensitive %v): expected %s %q %v, got %s %q %v", p, caseSensitive,
+					wantRule.role, wantPattern, wantOK, gotRule.role, gotPattern, gotOK)
+			}
+		}
+	}
+
+	// An empty trie matches nothing
+	var empty *ruleTrie
+	if _, _, ok := empty.lookup(splitPath("/")); ok {
+		t.Error("an empty trie should not match anything")
+	}
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		rules := benchmarkRules(n)
+		paths := benchmarkPaths(n)
+		segments := make([][]string, len(paths))
+		for i, p := range paths {
+			segments[i] = splitPath(p)
+		}
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				linearBestRule(rules, segments[i%len(segments)], false)
+			}
+		})
+		trie := compileRules(rules, false)
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				trie.lookup(segments[i%len(segments)])
+			}
+		})
+	}
+}
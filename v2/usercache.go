@@ -0,0 +1,359 @@
+package permissions
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/xyproto/simpleredis/v2"
+)
+
+// UserCacheChannel is the Redis channel that changed usernames are published
+// on, so that every process that has a user cache can drop them
+const UserCacheChannel = "permissions:users"
+
+// allUsers is published when all users may have changed
+const allUsers = "*"
+
+// ErrInvalidCacheSize is returned if a user cache is enabled with a size that is not positive
+var ErrInvalidCacheSize = errors.New("the size of the user cache must be positive")
+
+// userLRU is an in-process cache of user records, that drops the least
+// recently used user when it is full, and users that have been cached for
+// longer than the maximum staleness
+type userLRU struct {
+	mut          sync.Mutex
+	size         int
+	maxStaleness time.Duration
+	entries      map[string]*list.Element // the elements of order, by username
+	order        *list.List               // the cached users, most recently used first
+	generation   uint64                   // increased every time users are dropped
+	listening    bool                     // true while changes are being received
+	stopped      chan struct{}            // closed when the cache is disabled
+	done         chan struct{}            // closed when the listener has returned
+}
+
+// lruEntry is a cached user record, together with when it was fetched
+type lruEntry struct {
+	username string
+	u        *userRecord
+	fetched  time.Time
+}
+
+// EnableUserCache keeps up to size users in a cache in this process, in
+// front of Redis, for services that check many more requests than they
+// change users. Users are cached for at most maxStaleness.
+//
+// Every change that is made through a UserState publishes the username on
+// the UserCacheChannel Redis channel, and every process with a user cache
+// drops that user from its cache. The maximum staleness limits for how long
+// a user can be out of date if a message is missed. If the connection for
+// receiving the changes is lost, nothing is cached until it is back.
+//
+// Most changes are published in the background. Logging out, removing admin
+// rights and removing users bypass this: the change is published before the
+// function returns, so that the user is no longer let through by any process
+// that is listening.
+//
+// The cache is only used by the middleware and the other functions that
+// check requests. Functions like IsLoggedIn and IsAdmin always use Redis.
+func (state *UserState) EnableUserCache(size int, maxStaleness time.Duration) error {
+	if size <= 0 {
+		return ErrInvalidCacheSize
+	}
+	psc, err := state.subscribe()
+	if err != nil {
+		return err
+	}
+	lru := &userLRU{
+		size:         size,
+		maxStaleness: maxStaleness,
+		entries:      make(map[string]*list.Element),
+		order:        list.New(),
+		listening:    true,
+		stopped:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go lru.listen(psc, state.subscribe)
+	if old := state.userCache.Swap(lru); old != nil {
+		old.stop()
+	}
+	return nil
+}
+
+// DisableUserCache stops caching users in this process
+func (state *UserState) DisableUserCache() {
+	if old := state.userCache.Swap(nil); old != nil {
+		old.stop()
+	}
+}
+
+// subscribe opens a new connection, that is subscribed to the UserCacheChannel
+func (state *UserState) subscribe() (redis.PubSubConn, error) {
+	conn, err := (*redis.Pool)(state.pool).Dial()
+	if err != nil {
+		return redis.PubSubConn{}, err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(UserCacheChannel); err != nil {
+		conn.Close()
+		return redis.PubSubConn{}, err
+	}
+	return psc, nil
+}
+
+// listen drops the users that are published on the UserCacheChannel, until
+// the cache is stopped. If the connection is lost, all users are dropped and
+// nothing is cached until a new connection has been subscribed.
+func (lru *userLRU) listen(psc redis.PubSubConn, subscribe func() (redis.PubSubConn, error)) {
+	defer close(lru.done)
+	received := make(chan error, 1)
+	receive := func(psc redis.PubSubConn) {
+		for {
+			switch v := psc.ReceiveWithTimeout(0).(type) {
+			case redis.Message:
+				lru.remove(string(v.Data))
+			case error:
+				received <- v
+				return
+			}
+		}
+	}
+	go receive(psc)
+	for {
+		select {
+		case <-lru.stopped:
+			psc.Close()
+			<-received
+			return
+		case err := <-received:
+			psc.Close()
+			lru.setListening(false)
+			log.Printf("permissions: lost the connection for user cache changes: %v", err)
+		}
+		// Try to subscribe again, once per second
+		for {
+			select {
+			case <-lru.stopped:
+				return
+			case <-time.After(time.Second):
+			}
+			var err error
+			if psc, err = subscribe(); err == nil {
+				break
+			}
+		}
+		lru.setListening(true)
+		go receive(psc)
+	}
+}
+
+// setListening drops all users, and starts or stops caching users
+func (lru *userLRU) setListening(listening bool) {
+	lru.remove(allUsers)
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	lru.listening = listening
+}
+
+// stop stops listening for changes and waits for the listener to return
+func (lru *userLRU) stop() {
+	close(lru.stopped)
+	<-lru.done
+}
+
+// get returns the cached user, if it has been cached for less than the
+// maximum staleness. Also returns the current generation, which must be
+// given to put if the user is fetched.
+func (lru *userLRU) get(username string, now time.Time) (*userRecord, uint64, bool) {
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	e, ok := lru.entries[username]
+	if !ok || !lru.listening {
+		return nil, lru.generation, false
+	}
+	entry := e.Value.(*lruEntry)
+	if now.Sub(entry.fetched) >= lru.maxStaleness {
+		lru.order.Remove(e)
+		delete(lru.entries, username)
+		return nil, lru.generation, false
+	}
+	lru.order.MoveToFront(e)
+	return entry.u, lru.generation, true
+}
+
+// put caches the given user, unless users have been dropped since the given
+// generation, since the user may then have changed after it was fetched
+func (lru *userLRU) put(username string, u *userRecord, generation uint64, fetched time.Time) {
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	if generation != lru.generation || !lru.listening {
+		return
+	}
+	if e, ok := lru.entries[username]; ok {
+		e.Value = &lruEntry{username, u, fetched}
+		lru.order.MoveToFront(e)
+		return
+	}
+	lru.entries[username] = lru.order.PushFront(&lruEntry{username, u, fetched})
+	if lru.order.Len() > lru.size {
+		oldest := lru.order.Back()
+		lru.order.Remove(oldest)
+		delete(lru.entries, oldest.Value.(*lruEntry).username)
+	}
+}
+
+// remove drops the given user from the cache, or all users for allUsers
+func (lru *userLRU) remove(username string) {
+	lru.mut.Lock()
+	defer lru.mut.Unlock()
+	lru.generation++
+	if username == allUsers {
+		lru.entries = make(map[string]*list.Element)
+		lru.order.Init()
+		return
+	}
+	if e, ok := lru.entries[username]; ok {
+		lru.order.Remove(e)
+		delete(lru.entries, username)
+	}
+}
+
+// cachedUser returns the fields of the given user, from the user cache if
+// it is enabled and has the user, or else from Redis
+func (state *UserState) cachedUser(ctx context.Context, username string) *userRecord {
+	lru := state.userCache.Load()
+	if lru == nil {
+		u, _ := state.fetchUser(ctx, username)
+		return u
+	}
+	now := time.Now()
+	u, generation, ok := lru.get(username, now)
+	if ok {
+		return u
+	}
+	u, err := state.fetchUser(ctx, username)
+	if err == nil {
+		lru.put(username, u, generation, now)
+	}
+	return u
+}
+
+// invalidateUser drops the given user from the user cache of this process,
+// and publishes the username so that other processes do the same. If wait
+// is false, the username is published in the background.
+func (state *UserState) invalidateUser(username string, wait bool) {
+	lru := state.userCache.Load()
+	if lru == nil {
+		return
+	}
+	lru.remove(username)
+	if !wait {
+		go state.publishUser(username)
+		return
+	}
+	state.publishUser(username)
+}
+
+// publishUser publishes the given username on the UserCacheChannel
+func (state *UserState) publishUser(username string) {
+	conn := state.pool.Get(state.dbindex)
+	defer conn.Close()
+	if _, err := conn.Do("PUBLISH", UserCacheChannel, username); err != nil {
+		log.Printf("permissions: could not publish a change to %s: %v", username, err)
+	}
+}
+
+// revokes checks if setting the given field to the given value takes rights
+// away from a user, by logging out, removing admin rights or a role, locking,
+// disabling or setting an expiry time. A blank value is a removed field.
+// The change is then published before returning, so that no other process
+// lets the user through afterwards.
+func revokes(key, value string) bool {
+	switch key {
+	case "loggedin", "admin", "confirmed":
+		return value != "true"
+	case "disabled":
+		return value == "true"
+	case "lockedUntil", "expiresAt":
+		return value != ""
+	}
+	return strings.HasPrefix(key, rolePrefix) && value != "true"
+}
+
+// userHashMap is the hash map of users, that drops changed users from the user cache
+type userHashMap struct {
+	*simpleredis.HashMap
+	state *UserState
+}
+
+// Set sets a field of the given user
+func (m *userHashMap) Set(username, key, value string) error {
+	defer m.state.invalidateUser(username, revokes(key, value))
+	return m.HashMap.Set(username, key, value)
+}
+
+// SetExpire sets a field of the given user, that is removed after the given duration
+func (m *userHashMap) SetExpire(username, key, value string, expire time.Duration) error {
+	defer m.state.invalidateUser(username, revokes(key, value))
+	return m.HashMap.SetExpire(username, key, value, expire)
+}
+
+// DelKey removes a field of the given user
+func (m *userHashMap) DelKey(username, key string) error {
+	defer m.state.invalidateUser(username, revokes(key, ""))
+	return m.HashMap.DelKey(username, key)
+}
+
+// Del removes all fields of the given user
+func (m *userHashMap) Del(username string) error {
+	defer m.state.invalidateUser(username, true)
+	return m.HashMap.Del(username)
+}
+
+// Remove removes all users
+func (m *userHashMap) Remove() error {
+	defer m.state.invalidateUser(allUsers, true)
+	return m.HashMap.Remove()
+}
+
+// Clear removes all users
+func (m *userHashMap) Clear() error {
+	defer m.state.invalidateUser(allUsers, true)
+	return m.HashMap.Clear()
+}
+
+// usernameSet is the set of all usernames, that drops added and removed users from the user cache
+type usernameSet struct {
+	*simpleredis.Set
+	state *UserState
+}
+
+// Add adds the given username
+func (s *usernameSet) Add(username string) error {
+	defer s.state.invalidateUser(username, false)
+	return s.Set.Add(username)
+}
+
+// Del removes the given username
+func (s *usernameSet) Del(username string) error {
+	defer s.state.invalidateUser(username, true)
+	return s.Set.Del(username)
+}
+
+// Remove removes all usernames
+func (s *usernameSet) Remove() error {
+	defer s.state.invalidateUser(allUsers, true)
+	return s.Set.Remove()
+}
+
+// Clear removes all usernames
+func (s *usernameSet) Clear() error {
+	defer s.state.invalidateUser(allUsers, true)
+	return s.Set.Clear()
+}
@@ -0,0 +1,145 @@
+package permissions
+
+import (
+	"container/list"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUserLRU(t *testing.T) {
+	lru := &userLRU{size: 2, maxStaleness: time.Minute, entries: make(map[string]*list.Element), order: list.New(), listening: true}
+	now := time.Now()
+	bob, alice, eve := &userRecord{exists: true}, &userRecord{exists: true}, &userRecord{exists: true}
+
+	_, generation, _ := lru.get("bob", now)
+	lru.put("bob", bob, generation, now)
+	lru.put("alice", alice, generation, now)
+	if u, _, ok := lru.get("bob", now); !ok || u != bob {
+		t.Error("Error, bob should be cached")
+	}
+
+	// alice is the least recently used user, and is dropped when the cache is full
+	lru.put("eve", eve, generation, now)
+	if _, _, ok := lru.get("alice", now); ok {
+		t.Error("Error, alice should have been dropped")
+	}
+	if _, _, ok := lru.get("bob", now); !ok {
+		t.Error("Error, bob should still be cached")
+	}
+
+	// Users are not cached for longer than the maximum staleness
+	if _, _, ok := lru.get("bob", now.Add(time.Minute)); ok {
+		t.Error("Error, bob should be too stale")
+	}
+
+	// A user that was fetched before users were dropped is not cached, since it may be out of date
+	_, generation, _ = lru.get("alice", now)
+	lru.remove("nobody")
+	lru.put("alice", alice, generation, now)
+	if _, _, ok := lru.get("alice", now); ok {
+		t.Error("Error, alice should not have been cached")
+	}
+
+	// Nothing is cached while changes are not received
+	_, generation, _ = lru.get("alice", now)
+	lru.put("alice", alice, generation, now)
+	lru.setListening(false)
+	if _, _, ok := lru.get("alice", now); ok {
+		t.Error("Error, alice should not be cached while not listening")
+	}
+}
+
+func TestUserCache(t *testing.T) {
+	// Two processes that share the same Redis server
+	first, second := NewUserStateSimple(), NewUserStateSimple()
+	if err := first.EnableUserCache(100, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer first.DisableUserCache()
+	if err := second.EnableUserCache(100, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer second.DisableUserCache()
+	if err := second.EnableUserCache(0, time.Minute); err != ErrInvalidCacheSize {
+		t.Error("Error, expected ErrInvalidCacheSize, got", err)
+	}
+
+	first.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer first.RemoveUser("bob")
+	first.SetAdminStatus("bob")
+	defer first.RemoveAdminStatus("bob")
+	first.SetLoggedIn("bob")
+	waitFor(t, "bob to be an admin", func() bool {
+		u := second.cachedUser(context.Background(), "bob")
+		return u.loggedIn() && u.admin()
+	})
+
+	// Changes that are not made through a UserState are not seen, until the user is too stale
+	time.Sleep(200 * time.Millisecond) // let the changes that are published in the background arrive
+	second.cachedUser(context.Background(), "bob")
+	if err := first.Users().(*userHashMap).HashMap.Set("bob", "confirmed", "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Users().DelKey("bob", "confirmed")
+	if second.cachedUser(context.Background(), "bob").confirmed() {
+		t.Error("Error, the cached user should not have changed")
+	}
+
+	// Removing admin rights and logging out are seen by the other process
+	first.RemoveAdminStatus("bob")
+	waitFor(t, "bob to no longer be an admin", func() bool {
+		return !second.cachedUser(context.Background(), "bob").admin()
+	})
+	first.Logout("bob")
+	waitFor(t, "bob to be logged out", func() bool {
+		return !second.cachedUser(context.Background(), "bob").loggedIn()
+	})
+	if !second.cachedUser(context.Background(), "bob").confirmed() {
+		t.Error("Error, bob should have been fetched again")
+	}
+
+	// Other changes are also seen, in the background
+	first.AddRole("bob", "editor")
+	defer first.RemoveRole("bob", "editor")
+	waitFor(t, "bob to be an editor", func() bool {
+		return second.currentRoles().recordRoles(second.cachedUser(context.Background(), "bob"))["editor"]
+	})
+
+	// Users are fetched again when they are too stale
+	if err := second.EnableUserCache(100, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	second.cachedUser(context.Background(), "bob")
+	if err := first.Users().(*userHashMap).HashMap.Set("bob", "loggedin", "true"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "bob to be logged in again", func() bool {
+		return second.cachedUser(context.Background(), "bob").loggedIn()
+	})
+}
+
+func TestRevokes(t *testing.T) {
+	for _, tc := range []struct {
+		key, value string
+		revokes    bool
+	}{
+		{"loggedin", "false", true},
+		{"loggedin", "true", false},
+		{"admin", "", true},
+		{"confirmed", "false", true},
+		{"role:editor", "", true},
+		{"role:editor", "true", false},
+		{"disabled", "true", true},
+		{"disabled", "", false},
+		{"lockedUntil", "1700000000", true},
+		{"lockedUntil", "", false},
+		{"expiresAt", "1700000000", true},
+		{"expiresAt", "", false},
+		{"email", "bob@zombo.com", false},
+	} {
+		if revokes(tc.key, tc.value) != tc.revokes {
+			t.Errorf("Error, expected revokes(%q, %q) to be %v", tc.key, tc.value, tc.revokes)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package permissions
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redacted replaces the values of secret fields in exported user data
+const redacted = "[redacted]"
+
+// pseudonymSecretKey is the Redis key for the secret that pseudonyms and
+// tombstones are made with, unless it is set with SetPseudonymSecret
+const pseudonymSecretKey = "pseudonymsecret"
+
+// secretFields are the fields of a user that are never exported
+var secretFields = map[string]bool{
+	"password":          true,
+	"token":             true,
+	"confirmationCode":  true,
+	"passwordResetCode": true,
+	"magicLinkCode":     true,
+}
+
+// isSecretField checks if the given field of a user holds a secret, like a
+// password hash or a code that is sent by e-mail
+func isSecretField(fieldname string) bool {
+	if secretFields[fieldname] {
+		return true
+	}
+	lower := strings.ToLower(fieldname)
+	return strings.Contains(lower, "password") || strings.Contains(lower, "token") || strings.Contains(lower, "secret")
+}
+
+// UserData is everything that is stored for a user, as returned by
+// ExportUserData. Secrets, like the password hash, are redacted.
+type UserData struct {
+	Username       string            `json:"username"`
+	Properties     map[string]string `json:"properties"`      // all fields of the user, see Properties
+	Roles          []string          `json:"roles"`           // the roles that are given to the user
+	EffectiveRoles []string          `json:"effective_roles"` // the roles that the user has, including inherited roles
+	LoggedIn       bool              `json:"logged_in"`       // the user is logged in, which is the login session on the server
+	Unconfirmed    bool              `json:"unconfirmed"`     // the user is in the list of unconfirmed users
+	ExportedAt     time.Time         `json:"exported_at"`
+}
+
+// ExportUserData returns everything that is stored for the given user as
+// JSON, for instance for a data access request. The values of secrets, like
+// the password hash and confirmation codes, are redacted. Returns ErrNotFound
+// if nothing is stored for the user.
+//
+// Audit logs are not kept by this package, so applications that have them
+// need to export the events for the user themselves.
+func (state *UserState) ExportUserData(ctx context.Context, username string) ([]byte, error) {
+	replies, err := state.exec(ctx,
+		cmd("SISMEMBER", usernamesKey, username),
+		cmd("HGETALL", userKey(username)),
+		cmd("SISMEMBER", unconfirmedKey, username),
+	)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := redis.Bool(replies[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := redis.StringMap(replies[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	unconfirmed, err := redis.Bool(replies[2], nil)
+	if err != nil {
+		return nil, err
+	}
+	if !exists && len(fields) == 0 {
+		return nil, ErrNotFound
+	}
+	u := &userRecord{exists: exists, fields: fields}
+	data := &UserData{
+		Username:       username,
+		Properties:     make(map[string]string, len(fields)),
+		Roles:          u.roles(),
+		EffectiveRoles: sortedKeys(state.currentRoles().recordRoles(u)),
+		LoggedIn:       u.loggedIn(),
+		Unconfirmed:    unconfirmed,
+		ExportedAt:     time.Now().UTC(),
+	}
+	for fieldname, value := range fields {
+		if isSecretField(fieldname) {
+			value = redacted
+		}
+		data.Properties[fieldname] = value
+	}
+	return json.MarshalIndent(data, "", "  ")
+}
+
+// SetPseudonymSecret sets the secret that pseudonyms and the tombstones of
+// deleted users are made with. By default, a random secret is made the first
+// time it is needed, and stored in Redis, so that it stays the same after a
+// restart and for all servers that use the same Redis database. Set a secret
+// that is kept elsewhere if the pseudonyms should not be possible to link to
+// the usernames for someone that can read the Redis database. Changing the
+// secret changes all the pseudonyms.
+func (state *UserState) SetPseudonymSecret(secret string) {
+	state.pseudonymMut.Lock()
+	defer state.pseudonymMut.Unlock()
+	state.pseudonymSecret = secret
+}
+
+// pseudonymSecretContext returns the pseudonym secret, and reads it from
+// Redis, or makes a random one and stores it, if it is not set yet
+func (state *UserState) pseudonymSecretContext(ctx context.Context) (string, error) {
+	state.pseudonymMut.Lock()
+	defer state.pseudonymMut.Unlock()
+	if state.pseudonymSecret != "" {
+		return state.pseudonymSecret, nil
+	}
+	// Only the first server that stores a secret wins
+	if _, err := state.do(ctx, "SET", pseudonymSecretKey, randomToken(32), "NX"); err != nil {
+		return "", err
+	}
+	secret, err := redis.String(state.do(ctx, "GET", pseudonymSecretKey))
+	if err != nil {
+		return "", err
+	}
+	state.pseudonymSecret = secret
+	return secret, nil
+}
+
+// keyedHash returns a hash of the given string, that is made with the pseudonym secret
+func (state *UserState) keyedHash(ctx context.Context, s string) ([]byte, error) {
+	secret, err := state.pseudonymSecretContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(s))
+	return mac.Sum(nil), nil
+}
+
+// PseudonymContext returns a stable pseudonym for the given username, like
+// "user-3f5c0e6a9b1d2c4e", that can replace the username in logs. The
+// pseudonym is made with the pseudonym secret (see SetPseudonymSecret), and
+// stays the same for as long as the pseudonym secret does.
+func (state *UserState) PseudonymContext(ctx context.Context, username string) (string, error) {
+	sum, err := state.keyedHash(ctx, "pseudonym:"+username)
+	if err != nil {
+		return "", err
+	}
+	return "user-" + hex.EncodeToString(sum[:8]), nil
+}
+
+// Pseudonym returns a stable pseudonym for the given username, like
+// "user-3f5c0e6a9b1d2c4e", that can replace the username in logs.
+func (state *UserState) Pseudonym(username string) (string, error) {
+	return state.PseudonymContext(context.Background(), username)
+}
+
+// EraseUserData removes everything that is stored for the given user, like
+// DeleteUser, for instance for a request for erasure, including the aliases
+// of all the earlier usernames of the user and the pending password reset
+// and magic link codes, so that no key contains the username afterwards.
+// The tombstone that keeps the username from being used again right away
+// does not contain the username either. Returns the pseudonym of the user, that applications can use to replace
+// the username in their own logs, like audit logs, that are not kept by this
+// package. Returns ErrNotFound if nothing is stored for the user.
+func (state *UserState) EraseUserData(ctx context.Context, username string) (string, error) {
+	pseudonym, err := state.PseudonymContext(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	if err := state.DeleteUser(ctx, username); err != nil {
+		return "", err
+	}
+	return pseudonym, nil
+}
@@ -0,0 +1,193 @@
+package permissions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestExportUserData(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	userstate.AddUnconfirmed("bob", "abc123")
+	defer userstate.RemoveUnconfirmed("bob")
+	userstate.AddRole("bob", "editor")
+	defer userstate.RemoveRole("bob", "editor")
+	userstate.Users().Set("bob", "apiToken", "s3cr3t")
+	defer userstate.Users().DelKey("bob", "apiToken")
+
+	passwordHash, err := userstate.PasswordHash("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := userstate.ExportUserData(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"s3cr3t", "abc123", passwordHash} {
+		if strings.Contains(string(exported), secret) {
+			t.Errorf("Error, the secret %q should have been redacted: %s", secret, exported)
+		}
+	}
+	var data UserData
+	if err := json.Unmarshal(exported, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Username != "bob" || data.Properties["email"] != "bob@zombo.com" || data.Properties["password"] != redacted || !data.Unconfirmed {
+		t.Errorf("Error, unexpected data: %s", exported)
+	}
+	if !slices.Equal(data.Roles, []string{"editor"}) || !slices.Contains(data.EffectiveRoles, "user") {
+		t.Errorf("Error, unexpected roles: %v and %v", data.Roles, data.EffectiveRoles)
+	}
+	if _, err := userstate.ExportUserData(ctx, "nobody"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+}
+
+func TestEraseUserData(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	userstate.SetTombstoneLifetime(time.Minute)
+	userstate.AddUser("bob", "hunter1", "bob@zombo.com")
+	defer userstate.RemoveUser("bob")
+	defer userstate.DiscardUser(ctx, "bobby")
+
+	// The aliases of all the earlier usernames are removed too
+	if err := userstate.RenameUser(ctx, "bob", "robert"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.RenameUser(ctx, "robert", "bobby"); err != nil {
+		t.Fatal(err)
+	}
+	pseudonym, err := userstate.EraseUserData(ctx, "bobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"bob", "robert"} {
+		if exists, err := redis.Bool(userstate.do(ctx, "EXISTS", aliasUserKey(username))); err != nil || exists {
+			t.Errorf("Error, the alias of %s should have been removed: %v", username, err)
+		}
+	}
+	if _, err := userstate.ExportUserData(ctx, "bobby"); err != ErrNotFound {
+		t.Error("Error, nothing should be stored for bobby, got", err)
+	}
+	if _, err := userstate.EraseUserData(ctx, "bobby"); err != ErrNotFound {
+		t.Error("Error, expected ErrNotFound, got", err)
+	}
+
+	// The tombstone can not be found without the pseudonym secret
+	tombstone, err := userstate.deletedUserKey(ctx, "bobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.do(ctx, "DEL", tombstone)
+	sum := sha256.Sum256([]byte("bobby"))
+	if deleted, err := userstate.IsDeletedContext(ctx, "bobby"); err != nil || !deleted {
+		t.Error("Error, bobby should have a tombstone:", err)
+	}
+	if exists, err := redis.Bool(userstate.do(ctx, "EXISTS", deletedKey+":"+hex.EncodeToString(sum[:]))); err != nil || exists {
+		t.Error("Error, the tombstone should not be an unkeyed hash of the username:", err)
+	}
+
+	// The pseudonym stays the same for a new UserState, with another cookie secret
+	other := NewUserStateSimple()
+	other.SetCookieSecret("another secret")
+	if p, err := other.Pseudonym("bobby"); err != nil || p != pseudonym {
+		t.Errorf("Error, expected the pseudonym %s, got %s and %v", pseudonym, p, err)
+	}
+	if p, _ := userstate.Pseudonym("alice"); p == pseudonym || strings.Contains(pseudonym, "bob") {
+		t.Error("Error, unexpected pseudonym:", pseudonym)
+	}
+	other.SetPseudonymSecret("a secret that is kept elsewhere")
+	if p, err := other.Pseudonym("bobby"); err != nil || p == pseudonym {
+		t.Error("Error, the pseudonym should depend on the pseudonym secret:", p, err)
+	}
+}
+
+// keysWith returns the Redis keys whose names or values contain the given string
+func keysWith(t *testing.T, userstate *UserState, s string) []string {
+	ctx := context.Background()
+	keys, err := redis.Strings(userstate.do(ctx, "KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, key := range keys {
+		kind, err := redis.String(userstate.do(ctx, "TYPE", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		switch kind {
+		case "string":
+			value, _ := redis.String(userstate.do(ctx, "GET", key))
+			values = []string{value}
+		case "hash":
+			values, _ = redis.Strings(userstate.do(ctx, "HGETALL", key))
+		case "set":
+			values, _ = redis.Strings(userstate.do(ctx, "SMEMBERS", key))
+		case "list":
+			values, _ = redis.Strings(userstate.do(ctx, "LRANGE", key, 0, -1))
+		}
+		if strings.Contains(key, s) || slices.ContainsFunc(values, func(value string) bool { return strings.Contains(value, s) }) {
+			found = append(found, key)
+		}
+	}
+	return found
+}
+
+func TestEraseUserDataEverywhere(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	userstate.SetTombstoneLifetime(time.Minute)
+	userstate.AddUser("zelda", "hunter1", "zelda@zombo.com")
+	defer userstate.DiscardUser(ctx, "zeldina")
+	userstate.AddUnconfirmed("zelda", "abc123")
+
+	// A pending password reset still has the earlier username, after the user is renamed
+	resetCode, err := userstate.setCode(ctx, "zelda", "passwordResetCode", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.RenameUser(ctx, "zelda", "zeldina"); err != nil {
+		t.Fatal(err)
+	}
+	magicCode, err := userstate.setCode(ctx, "zeldina", "magicLinkCode", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := keysWith(t, userstate, "zeld"); len(found) == 0 {
+		t.Fatal("Error, the username should be stored before the user is erased")
+	}
+
+	if _, err := userstate.EraseUserData(ctx, "zeldina"); err != nil {
+		t.Fatal(err)
+	}
+	tombstone, err := userstate.deletedUserKey(ctx, "zeldina")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.do(ctx, "DEL", tombstone)
+	if found := keysWith(t, userstate, "zeld"); len(found) != 0 {
+		t.Error("Error, no key should contain the username after it has been erased, got", found)
+	}
+
+	// The codes do not work for a new user with the same username
+	userstate.SetTombstoneLifetime(0)
+	userstate.AddUser("zeldina", "hunter1", "zeldina@zombo.com")
+	if _, err := userstate.UseMagicLink(magicCode); err != ErrInvalidCode {
+		t.Error("Error, expected ErrInvalidCode for the magic link, got", err)
+	}
+	if _, err := userstate.ResetPassword(resetCode, "hunter2"); err != ErrInvalidCode {
+		t.Error("Error, expected ErrInvalidCode for the password reset, got", err)
+	}
+}
@@ -0,0 +1,258 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+)
+
+//go:generate go run gen_confusables.go
+
+var (
+	// ErrUsernameTooShort is returned if the given username is shorter than the username profile allows
+	ErrUsernameTooShort = errors.New("the username is too short")
+
+	// ErrUsernameTooLong is returned if the given username is longer than the username profile allows
+	ErrUsernameTooLong = errors.New("the username is too long")
+
+	// ErrUsernameMixedScripts is returned if the given username mixes letters from scripts that are not normally used together
+	ErrUsernameMixedScripts = errors.New("the username mixes letters from different alphabets")
+
+	// ErrUsernameReserved is returned if the given username is on the list of reserved usernames
+	ErrUsernameReserved = errors.New("the username is reserved")
+
+	// ErrUsernameConfusable is returned if the given username can be confused with the username of another user
+	ErrUsernameConfusable = errors.New("the username is too similar to the username of another user")
+
+	// ErrUsernameNotNormalized is returned if the given username is not the normalized username that NormalizeUsername returns
+	ErrUsernameNotNormalized = errors.New("the username is not normalized")
+)
+
+// skeletonsKey is the Redis key for the hash from the skeletons of usernames
+// to the usernames, for finding usernames that can be confused
+const skeletonsKey = "skeletons"
+
+// UsernameProfile is a set of rules for usernames. Usernames are first
+// enforced with the UsernameCaseMapped profile from PRECIS (RFC 8265), which
+// maps fullwidth characters to their normal width, maps the username to
+// lowercase, normalizes it to NFC and rejects spaces, control characters and
+// right-to-left text that is mixed up in a confusing way. Then the rules of
+// the profile are checked.
+//
+// Usernames that are mapped to the same normalized username are the same
+// user, so "Bob", "BOB" and "ｂｏｂ" can not be three different users.
+// Usernames that only look alike, like "mary" and "rnary", or a Latin "paypal"
+// and one that is written with Cyrillic letters, have the same skeleton, as
+// defined by Unicode Technical Standard #39, and are not allowed either.
+type UsernameProfile struct {
+	MinLength         int      // the minimum number of characters, after normalization
+	MaxLength         int      // the maximum number of characters, after normalization, or 0 for no limit
+	Punctuation       string   // the punctuation and symbols that are allowed, besides letters, marks and digits
+	CasePreserved     bool     // keep the case of usernames, with the UsernameCasePreserved profile instead
+	AllowMixedScripts bool     // allow letters from scripts that are not normally used together, like Latin and Cyrillic
+	AllowConfusables  bool     // allow usernames that look like the username of another user
+	Reserved          []string // usernames that are not allowed, also usernames that look like them
+}
+
+// NewUsernameProfile returns the default username profile, that allows
+// letters from any script, digits and underscore, from 1 to 64 characters,
+// and reserves some usernames, like "admin", "root" and "support".
+func NewUsernameProfile() *UsernameProfile {
+	return &UsernameProfile{
+		MinLength:   1,
+		MaxLength:   64,
+		Punctuation: "_",
+		Reserved: []string{
+			"admin", "administrator", "root", "support", "system",
+			"postmaster", "hostmaster", "webmaster", "abuse", "security",
+		},
+	}
+}
+
+// scriptCombinations are the scripts that may be mixed in a username, since
+// they are used together for writing Japanese, Chinese and Korean. This is
+// the "highly restrictive" level of Unicode Technical Standard #39.
+var scriptCombinations = [][]*unicode.RangeTable{
+	{unicode.Latin, unicode.Han, unicode.Hiragana, unicode.Katakana},
+	{unicode.Latin, unicode.Han, unicode.Bopomofo},
+	{unicode.Latin, unicode.Han, unicode.Hangul},
+}
+
+// scriptOf returns the script of the given rune, or nil for characters that
+// are used with every script, like digits and combining marks
+func scriptOf(r rune) *unicode.RangeTable {
+	if unicode.In(r, unicode.Common, unicode.Inherited) {
+		return nil
+	}
+	for _, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return table
+		}
+	}
+	return nil
+}
+
+// mixedScripts checks if the given username has letters from scripts that
+// are not normally used together, like a Cyrillic "а" in a Latin "admin"
+func mixedScripts(username string) bool {
+	var scripts []*unicode.RangeTable
+	for _, r := range username {
+		if script := scriptOf(r); script != nil && !containsTable(scripts, script) {
+			scripts = append(scripts, script)
+		}
+	}
+	if len(scripts) <= 1 {
+		return false
+	}
+NEXT:
+	for _, combination := range scriptCombinations {
+		for _, script := range scripts {
+			if !containsTable(combination, script) {
+				continue NEXT // check the next combination
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// skeleton returns the skeleton of the given username, as defined by Unicode
+// Technical Standard #39. Usernames that look alike have the same skeleton,
+// for instance "rnary" and "mary", or "pаypаl" with Cyrillic letters and
+// "paypal". The skeleton is only for comparing, and is not a username.
+func skeleton(username string) string {
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(username) {
+		if replacement, ok := confusables[r]; ok {
+			sb.WriteString(replacement)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return norm.NFD.String(sb.String())
+}
+
+// containsTable checks if the given tables contain the given table
+func containsTable(tables []*unicode.RangeTable, table *unicode.RangeTable) bool {
+	for _, t := range tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize checks the given username against the rules of the profile, and
+// returns the normalized username, which is the form that should be stored
+// and looked up. Returns ErrInvalidUsername, ErrUsernameTooShort,
+// ErrUsernameTooLong, ErrUsernameMixedScripts or ErrUsernameReserved if the
+// username is not allowed. Usernames that look like a reserved username, like
+// "adrnin", are reserved too.
+//
+// Usernames that look like the username of another user are rejected by
+// CreateUser and RenameUser, since that depends on the existing users.
+func (p *UsernameProfile) Normalize(username string) (string, error) {
+	profile := precis.UsernameCaseMapped
+	if p.CasePreserved {
+		profile = precis.UsernameCasePreserved
+	}
+	normalized, err := profile.String(username)
+	if err != nil {
+		if username == "" {
+			return "", ErrUsernameTooShort
+		}
+		return "", ErrInvalidUsername
+	}
+	for _, r := range normalized {
+		if !unicode.In(r, unicode.L, unicode.M, unicode.Nd) && !strings.ContainsRune(p.Punctuation, r) {
+			return "", ErrInvalidUsername
+		}
+	}
+	length := utf8.RuneCountInString(normalized)
+	if length < p.MinLength {
+		return "", ErrUsernameTooShort
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return "", ErrUsernameTooLong
+	}
+	if !p.AllowMixedScripts && mixedScripts(normalized) {
+		return "", ErrUsernameMixedScripts
+	}
+	if len(p.Reserved) > 0 {
+		// Compare the skeletons of the usernames in lowercase
+		folded, err := precis.UsernameCaseMapped.String(normalized)
+		if err != nil {
+			return "", ErrInvalidUsername
+		}
+		folded = skeleton(folded)
+		for _, reserved := range p.Reserved {
+			if r, err := precis.UsernameCaseMapped.String(reserved); err == nil && skeleton(r) == folded {
+				return "", ErrUsernameReserved
+			}
+		}
+	}
+	return normalized, nil
+}
+
+// SetUsernameProfile sets the rules for usernames, that are used by
+// NormalizeUsername. The default is NewUsernameProfile(), and nil turns off
+// the checks and the normalization.
+func (state *UserState) SetUsernameProfile(profile *UsernameProfile) {
+	state.usernameProfile = profile
+}
+
+// NormalizeUsername checks the given username against the username profile,
+// and returns the normalized username, which is the form that should be
+// stored and looked up. Usernames that are typed in by users, for instance
+// in a form for registering or logging in, should be normalized with this
+// before they are passed to the other functions, like CreateUser, HasUser or
+// CorrectPassword. The handlers in the handlers package do this. Returns the
+// username as it is, if the username profile is nil.
+func (state *UserState) NormalizeUsername(username string) (string, error) {
+	if state.usernameProfile == nil {
+		return username, nil
+	}
+	return state.usernameProfile.Normalize(username)
+}
+
+// checkNewUsername checks that the given username is allowed by the username
+// profile, and that it is normalized already, since it is used as it is.
+// Returns "true" if usernames that look like the usernames of other users
+// must be rejected, for passing to a Lua script, or else "false".
+func (state *UserState) checkNewUsername(username string) (string, error) {
+	profile := state.usernameProfile
+	if profile == nil {
+		return "false", nil
+	}
+	normalized, err := profile.Normalize(username)
+	if err != nil {
+		return "", err
+	}
+	if normalized != username {
+		return "", ErrUsernameNotNormalized
+	}
+	return strconv.FormatBool(!profile.AllowConfusables), nil
+}
+
+// IndexSkeletonsContext adds the skeletons of the usernames of all existing
+// users to the index of skeletons, so that CreateUser and RenameUser also
+// reject usernames that look like the usernames of users that were added by
+// an older version. A skeleton that already is in the index is not changed.
+func (state *UserState) IndexSkeletonsContext(ctx context.Context) error {
+	usernames, err := state.AllUsernamesContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		if _, err := state.do(ctx, "HSETNX", skeletonsKey, skeleton(username), username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
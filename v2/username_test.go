@@ -0,0 +1,202 @@
+package permissions
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestUsernameProfile(t *testing.T) {
+	profile := NewUsernameProfile()
+	for username, expected := range map[string]string{
+		"bob":           "bob",
+		"Bob":           "bob",
+		"ＢＯＢ":           "bob",
+		"bob_2":         "bob_2",
+		"Åse":           "åse",
+		"A\u030ase":     "åse", // a combining ring above is composed with NFC
+		"Ελένη":         "ελένη",
+		"日本語":           "日本語",
+		"ひらがなカタカナ漢字abc": "ひらがなカタカナ漢字abc",
+	} {
+		if normalized, err := profile.Normalize(username); err != nil || normalized != expected {
+			t.Errorf("Error, expected %q to be normalized to %q, got %q and %v", username, expected, normalized, err)
+		}
+	}
+	for username, expected := range map[string]error{
+		"":                      ErrUsernameTooShort,
+		"bob smith":             ErrInvalidUsername,
+		"bob.smith":             ErrInvalidUsername,
+		"bob\x00":               ErrInvalidUsername,
+		"\u0430dmin":            ErrUsernameMixedScripts, // Cyrillic а
+		"bobΔ":                  ErrUsernameMixedScripts,
+		"Admin":                 ErrUsernameReserved,
+		"ROOT":                  ErrUsernameReserved,
+		"ｓｕｐｐｏｒｔ":               ErrUsernameReserved,
+		"adrnin":                ErrUsernameReserved, // looks like "admin"
+		strings.Repeat("a", 65): ErrUsernameTooLong,
+	} {
+		if _, err := profile.Normalize(username); err != expected {
+			t.Errorf("Error, expected %v for %q, got %v", expected, username, err)
+		}
+	}
+
+	// The rules can be changed
+	profile.MinLength = 3
+	profile.Punctuation = "_.-"
+	profile.CasePreserved = true
+	profile.AllowMixedScripts = true
+	profile.Reserved = []string{"billing"}
+	if _, err := profile.Normalize("bo"); err != ErrUsernameTooShort {
+		t.Error("Error, expected ErrUsernameTooShort, got", err)
+	}
+	if _, err := profile.Normalize("Billing"); err != ErrUsernameReserved {
+		t.Error("Error, expected ErrUsernameReserved, got", err)
+	}
+	for _, username := range []string{"Bob.Smith", "admin", "bobΔ"} {
+		if normalized, err := profile.Normalize(username); err != nil || normalized != username {
+			t.Errorf("Error, expected %q to be allowed as it is, got %q and %v", username, normalized, err)
+		}
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	userstate.SetTombstoneLifetime(0)
+
+	// Usernames must be normalized before they are used
+	if err := userstate.CreateUser(ctx, "Bob", "hunter1", "bob@zombo.com"); err != ErrUsernameNotNormalized {
+		t.Error("Error, expected ErrUsernameNotNormalized, got", err)
+	}
+	if userstate.HasUser("Bob") || userstate.HasUser("bob") {
+		t.Error("Error, no user should have been created")
+	}
+	username, err := userstate.NormalizeUsername("Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.CreateUser(ctx, username, "hunter1", "bob@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.DeleteUser(ctx, "bob")
+	if !userstate.HasUser("bob") || !userstate.CorrectPassword("bob", "hunter1") {
+		t.Error("Error, bob should have been created")
+	}
+	for _, username := range []string{"BOB", "ｂｏｂ"} {
+		normalized, err := userstate.NormalizeUsername(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := userstate.CreateUser(ctx, normalized, "hunter2", "bob2@zombo.com"); err != ErrUserExists {
+			t.Errorf("Error, expected ErrUserExists for %q, got %v", username, err)
+		}
+	}
+	if err := userstate.CreateUser(ctx, "root", "hunter2", "root@zombo.com"); err != ErrUsernameReserved {
+		t.Error("Error, expected ErrUsernameReserved, got", err)
+	}
+	if err := userstate.RenameUser(ctx, "bob", "\u0430dmin"); err != ErrUsernameMixedScripts {
+		t.Error("Error, expected ErrUsernameMixedScripts, got", err)
+	}
+	if err := userstate.RenameUser(ctx, "bob", "Robert"); err != ErrUsernameNotNormalized {
+		t.Error("Error, expected ErrUsernameNotNormalized, got", err)
+	}
+
+	// Without a username profile, usernames are stored as they are
+	userstate.SetUsernameProfile(nil)
+	defer userstate.SetUsernameProfile(NewUsernameProfile())
+	if err := userstate.CreateUser(ctx, "Bob", "hunter2", "bob2@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.DeleteUser(ctx, "Bob")
+	if !userstate.HasUser("Bob") {
+		t.Error("Error, Bob should have been stored as it is")
+	}
+}
+
+func TestConfusableUsernames(t *testing.T) {
+	ctx := context.Background()
+	userstate := NewUserStateSimple()
+	userstate.SetTombstoneLifetime(0)
+	userstate.SetAliasLifetime(0)
+	if err := userstate.CreateUser(ctx, "mary", "hunter1", "mary@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.DeleteUser(ctx, "mary")
+	if err := userstate.CreateUser(ctx, "cop", "hunter1", "cop@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.DeleteUser(ctx, "cop")
+
+	// Usernames that look like the username of another user are taken, also in one script
+	for _, username := range []string{"rnary", "\u0441\u043e\u0440"} { // "rnary" and a Cyrillic "сор"
+		if err := userstate.CreateUser(ctx, username, "hunter1", username+"@zombo.com"); err != ErrUsernameConfusable {
+			t.Errorf("Error, expected ErrUsernameConfusable for %q, got %v", username, err)
+		}
+	}
+	if err := userstate.RenameUser(ctx, "cop", "rnary"); err != ErrUsernameConfusable {
+		t.Error("Error, expected ErrUsernameConfusable, got", err)
+	}
+
+	// A user can be renamed to a username that looks like the old one
+	if err := userstate.RenameUser(ctx, "mary", "rnary"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.DeleteUser(ctx, "rnary")
+	if err := userstate.CreateUser(ctx, "mary", "hunter1", "mary2@zombo.com"); err != ErrUsernameConfusable {
+		t.Error("Error, expected ErrUsernameConfusable, got", err)
+	}
+
+	// The username can be used when the other user is gone
+	if err := userstate.DeleteUser(ctx, "rnary"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.CreateUser(ctx, "mary", "hunter1", "mary@zombo.com"); err != nil {
+		t.Error("Error, mary should be available again:", err)
+	}
+
+	// Users that were added with AddUser are found, and so are users that are not in the index
+	userstate.AddUser("paypal", "hunter1", "paypal@zombo.com")
+	defer userstate.DeleteUser(ctx, "paypal")
+	if err := userstate.CreateUser(ctx, "payp\u0430l", "hunter1", "fake@zombo.com"); err != ErrUsernameMixedScripts {
+		t.Error("Error, expected ErrUsernameMixedScripts, got", err)
+	}
+	if err := userstate.CreateUser(ctx, "paypa1", "hunter1", "fake@zombo.com"); err != ErrUsernameConfusable {
+		t.Error("Error, expected ErrUsernameConfusable, got", err)
+	}
+	if _, err := userstate.do(ctx, "HDEL", skeletonsKey, skeleton("paypal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.IndexSkeletonsContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := userstate.CreateUser(ctx, "paypa1", "hunter1", "fake@zombo.com"); err != ErrUsernameConfusable {
+		t.Error("Error, expected ErrUsernameConfusable after indexing, got", err)
+	}
+
+	// Confusable usernames can be allowed
+	profile := NewUsernameProfile()
+	profile.AllowConfusables = true
+	userstate.SetUsernameProfile(profile)
+	defer userstate.SetUsernameProfile(NewUsernameProfile())
+	if err := userstate.CreateUser(ctx, "rnary", "hunter1", "rnary@zombo.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer userstate.DeleteUser(ctx, "rnary")
+}
+
+func TestValidUsernamePassword(t *testing.T) {
+	for _, username := range []string{"åse", "Bob_2", "admin"} {
+		if err := ValidUsernamePassword(username, "hunter1"); err != nil {
+			t.Errorf("Error, expected %q to be a valid username, got %v", username, err)
+		}
+	}
+	for _, username := range []string{"bob smith", "Ελένη"} {
+		if err := ValidUsernamePassword(username, "hunter1"); err != ErrInvalidUsername {
+			t.Errorf("Error, expected ErrInvalidUsername for %q, got %v", username, err)
+		}
+	}
+	if err := ValidUsernamePassword("bob", "bob"); err != ErrSameUsernameAndPassword {
+		t.Error("Error, expected ErrSameUsernameAndPassword, got", err)
+	}
+}
@@ -1,11 +1,14 @@
 package permissions
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xyproto/cookie/v2"
@@ -51,7 +54,7 @@ var (
 	// ErrConfirmationNotUnique is returned if there are issues generating confirmation codes. This should normally not happen.
 	ErrConfirmationNotUnique = errors.New("too many generated confirmation codes are not unique")
 
-	// ErrInvalidUsername is returned if the given username contains characters that the default validator does not accept
+	// ErrInvalidUsername is returned if the given username contains characters that the default validator or the username profile does not accept
 	ErrInvalidUsername = errors.New("only numbers, underscore and some letters are allowed in usernames")
 
 	// ErrSameUsernameAndPassword is returned if the username and password are equal
@@ -64,14 +67,33 @@ var (
 // "bcrypt", but with backwards compatibility for checking sha256 hashes.
 type UserState struct {
 	// see: http://redis.io/topics/data-types
-	users             *simpleredis.HashMap        // Hash map of users, with several different fields per user ("loggedin", "confirmed", "email" etc)
-	usernames         *simpleredis.Set            // A list of all usernames, for easy enumeration
+	users             *userHashMap                // Hash map of users, with several different fields per user ("loggedin", "confirmed", "email" etc)
+	usernames         *usernameSet                // A list of all usernames, for easy enumeration
 	unconfirmed       *simpleredis.Set            // A list of unconfirmed usernames, for easy enumeration
 	pool              *simpleredis.ConnectionPool // A connection pool for Redis
 	dbindex           int                         // Redis database index
 	cookieSecret      string                      // Secret for storing secure cookies
 	cookieTime        int64                       // How long a cookie should last, in seconds
 	passwordAlgorithm string                      // Password hashing algorithm ("sha256", "bcrypt" or "bcrypt+").
+
+	mailer                Mailer          // For sending e-mails to users, may be nil
+	emailTemplates        *EmailTemplates // Templates for the e-mails to users
+	siteName              string          // Site name, used in e-mails
+	siteURL               string          // Base URL of the site, used for links in e-mails
+	passwordResetLifetime time.Duration   // How long a password reset code is valid
+	magicLinkLifetime     time.Duration   // How long a magic link code is valid
+	tombstoneLifetime     time.Duration   // How long the username of a deleted user can not be used again
+	aliasLifetime         time.Duration   // How long the old username of a renamed user keeps working
+
+	usernameProfile *UsernameProfile // The rules for new usernames, may be nil
+
+	pseudonymSecret string     // Secret for pseudonyms and tombstones, read from Redis when first needed
+	pseudonymMut    sync.Mutex // Mutex for the pseudonym secret
+
+	roles   atomic.Pointer[roleSettings] // The role inheritances and the permissions of roles, replaced as a whole when changed
+	roleMut sync.Mutex                   // Mutex for changing the role settings, one change at a time
+
+	userCache atomic.Pointer[userLRU] // In-process cache of users, if enabled with EnableUserCache
 }
 
 // NewUserStateSimple will create a new *UserState that can be used for
@@ -158,10 +180,10 @@ func NewUserState(dbindex int, randomseed bool, redisHostPort string) *UserState
 
 	state := new(UserState)
 
-	state.users = simpleredis.NewHashMap(pool, "users")
+	state.users = &userHashMap{simpleredis.NewHashMap(pool, "users"), state}
 	state.users.SelectDatabase(dbindex)
 
-	state.usernames = simpleredis.NewSet(pool, "usernames")
+	state.usernames = &usernameSet{simpleredis.NewSet(pool, "usernames"), state}
 	state.usernames.SelectDatabase(dbindex)
 
 	state.unconfirmed = simpleredis.NewSet(pool, "unconfirmed")
@@ -187,6 +209,18 @@ func NewUserState(dbindex int, randomseed bool, redisHostPort string) *UserState
 	// "bcrypt", but with backwards compatibility for checking sha256 hashes.
 	state.passwordAlgorithm = "bcrypt+" // "bcrypt+", "bcrypt" or "sha256"
 
+	// E-mail templates, and for how long the codes that are sent by e-mail are valid
+	state.emailTemplates = NewEmailTemplates()
+	state.siteName = "the site"
+	state.passwordResetLifetime = time.Hour
+	state.magicLinkLifetime = 15 * time.Minute
+	state.tombstoneLifetime = 24 * time.Hour
+	state.aliasLifetime = 24 * time.Hour
+	state.usernameProfile = NewUsernameProfile()
+
+	// Administrators inherit the user role
+	state.roles.Store(newRoleSettings())
+
 	if pool.Ping() != nil {
 		defer pool.Close()
 		log.Fatalf("Error, wrong hostname, port or password. (%s does not reply to PING)\n", redisHostPort)
@@ -223,10 +257,10 @@ func NewUserState2(dbindex int, randomseed bool, redisHostPort string) (*UserSta
 
 	state := new(UserState)
 
-	state.users = simpleredis.NewHashMap(pool, "users")
+	state.users = &userHashMap{simpleredis.NewHashMap(pool, "users"), state}
 	state.users.SelectDatabase(dbindex)
 
-	state.usernames = simpleredis.NewSet(pool, "usernames")
+	state.usernames = &usernameSet{simpleredis.NewSet(pool, "usernames"), state}
 	state.usernames.SelectDatabase(dbindex)
 
 	state.unconfirmed = simpleredis.NewSet(pool, "unconfirmed")
@@ -252,6 +286,18 @@ func NewUserState2(dbindex int, randomseed bool, redisHostPort string) (*UserSta
 	// "bcrypt", but with backwards compatibility for checking sha256 hashes.
 	state.passwordAlgorithm = "bcrypt+" // "bcrypt+", "bcrypt" or "sha256"
 
+	// E-mail templates, and for how long the codes that are sent by e-mail are valid
+	state.emailTemplates = NewEmailTemplates()
+	state.siteName = "the site"
+	state.passwordResetLifetime = time.Hour
+	state.magicLinkLifetime = 15 * time.Minute
+	state.tombstoneLifetime = 24 * time.Hour
+	state.aliasLifetime = 24 * time.Hour
+	state.usernameProfile = NewUsernameProfile()
+
+	// Administrators inherit the user role
+	state.roles.Store(newRoleSettings())
+
 	if pool.Ping() != nil {
 		defer pool.Close()
 		return nil, fmt.Errorf("wrong hostname, port or password. (%s does not reply to PING)", redisHostPort)
@@ -280,18 +326,19 @@ func (state *UserState) Close() {
 	state.pool.Close()
 }
 
-// UserRights checks if the current user is logged in and has user rights.
+// UserRights checks if the current user is logged in and has user rights,
+// and has not been locked out, suspended or expired.
 func (state *UserState) UserRights(req *http.Request) bool {
-	username, err := state.UsernameCookie(req)
+	_, u, err := state.cookieUser(req)
 	if err != nil {
 		return false
 	}
-	return state.IsLoggedIn(username)
+	return u.loggedIn() && !u.locked() && !u.disabled() && !u.expired()
 }
 
 // HasUser checks if the given username exists.
 func (state *UserState) HasUser(username string) bool {
-	val, err := state.usernames.Has(username)
+	val, err := state.HasUserContext(context.Background(), username)
 	if err != nil {
 		// This happened at concurrent connections before introducing the connection pool
 		panic(ErrRedisLostConnection.Error())
@@ -301,7 +348,7 @@ func (state *UserState) HasUser(username string) bool {
 
 // HasUser2 checks if the given username exists.
 func (state *UserState) HasUser2(username string) (bool, error) {
-	val, err := state.usernames.Has(username)
+	val, err := state.HasUserContext(context.Background(), username)
 	if err != nil {
 		// This happened at concurrent connections before introducing the connection pool
 		return false, ErrRedisLostConnection
@@ -312,23 +359,7 @@ func (state *UserState) HasUser2(username string) (bool, error) {
 // HasEmail finds the user that has a given e-mail address.
 // Returns the username and nil if found or a blank string and ErrNotFound if not.
 func (state *UserState) HasEmail(email string) (string, error) {
-	if email == "" {
-		return "", ErrNotFound
-	}
-	usernames, err := state.AllUsernames()
-	if err != nil {
-		return "", err
-	}
-	for _, username := range usernames {
-		userEmail, err := state.Email(username)
-		if err != nil {
-			return "", err
-		}
-		if userEmail == email {
-			return username, nil
-		}
-	}
-	return "", ErrNotFound
+	return state.HasEmailContext(context.Background(), email)
 }
 
 // BooleanField returns the boolean value for a given username and field name.
@@ -336,24 +367,13 @@ func (state *UserState) HasEmail(email string) (string, error) {
 // Useful for states where it makes sense that the returned value is not true
 // unless everything is in order.
 func (state *UserState) BooleanField(username, fieldname string) bool {
-	hasUser := state.HasUser(username)
-	if !hasUser {
-		return false
-	}
-	value, err := state.users.Get(username, fieldname)
-	if err != nil {
-		return false
-	}
-	return value == "true"
+	value, _ := state.BooleanFieldContext(context.Background(), username, fieldname)
+	return value
 }
 
 // SetBooleanField can store a boolean value for the given username and custom fieldname.
 func (state *UserState) SetBooleanField(username, fieldname string, val bool) {
-	strval := "false"
-	if val {
-		strval = "true"
-	}
-	state.users.Set(username, fieldname, strval)
+	state.SetBooleanFieldContext(context.Background(), username, fieldname, val)
 }
 
 // IsConfirmed checks if the given username is confirmed.
@@ -361,41 +381,51 @@ func (state *UserState) IsConfirmed(username string) bool {
 	return state.BooleanField(username, "confirmed")
 }
 
+// Lock locks the given user out for the given duration, for instance after
+// too many failed login attempts. Locked users are rejected by the
+// Permissions middleware, even if they are logged in.
+func (state *UserState) Lock(username string, duration time.Duration) {
+	state.LockContext(context.Background(), username, duration)
+}
+
+// Unlock removes the lock for the given user.
+func (state *UserState) Unlock(username string) {
+	state.UnlockContext(context.Background(), username)
+}
+
+// IsLocked checks if the given user is currently locked out.
+func (state *UserState) IsLocked(username string) bool {
+	locked, _ := state.IsLockedContext(context.Background(), username)
+	return locked
+}
+
 // IsLoggedIn checks if the given username is logged in.
 func (state *UserState) IsLoggedIn(username string) bool {
-	if !state.HasUser(username) {
-		return false
-	}
-	status, err := state.users.Get(username, "loggedin")
-	if err != nil {
-		// Returns "no" if the status can not be retrieved
-		return false
-	}
-	return status == "true"
+	// Returns "no" if the status can not be retrieved
+	loggedIn, _ := state.IsLoggedInContext(context.Background(), username)
+	return loggedIn
 }
 
-// AdminRights checks if the current user is logged in and has administrator rights.
+// AdminRights checks if the current user is logged in and has administrator
+// rights, and has not been locked out, suspended or expired.
 func (state *UserState) AdminRights(req *http.Request) bool {
-	username, err := state.UsernameCookie(req)
+	_, u, err := state.cookieUser(req)
 	if err != nil {
 		return false
 	}
-	return state.IsLoggedIn(username) && state.IsAdmin(username)
+	return u.loggedIn() && u.admin() && !u.locked() && !u.disabled() && !u.expired()
 }
 
 // IsAdmin checks if the given username is an administrator.
 func (state *UserState) IsAdmin(username string) bool {
-	if !state.HasUser(username) {
-		return false
-	}
-	status, err := state.users.Get(username, "admin")
-	if err != nil {
-		return false
-	}
-	return status == "true"
+	admin, _ := state.IsAdminContext(context.Background(), username)
+	return admin
 }
 
 // UsernameCookie retrieves the username that is stored in a cookie in the browser, if available.
+// Only the cookie is read, so if the user has been renamed, the old username
+// is returned. The middleware follows the alias to the new username, which
+// can be found in the Decision or the Principal of the request.
 func (state *UserState) UsernameCookie(req *http.Request) (string, error) {
 	username, ok := cookie.SecureCookie(req, "user", state.cookieSecret)
 	if ok && (username != "") {
@@ -452,27 +482,27 @@ func (state *UserState) SetUsernameCookieOnlyHTTPS(w http.ResponseWriter, userna
 
 // AllUsernames retrieves a list of all usernames.
 func (state *UserState) AllUsernames() ([]string, error) {
-	return state.usernames.GetAll()
+	return state.AllUsernamesContext(context.Background())
 }
 
 // Email returns the email address for the given username.
 func (state *UserState) Email(username string) (string, error) {
-	return state.users.Get(username, "email")
+	return state.EmailContext(context.Background(), username)
 }
 
 // PasswordHash returns the password hash for the given username.
 func (state *UserState) PasswordHash(username string) (string, error) {
-	return state.users.Get(username, "password")
+	return state.PasswordHashContext(context.Background(), username)
 }
 
 // AllUnconfirmedUsernames returns a list of all registered users that are not yet confirmed.
 func (state *UserState) AllUnconfirmedUsernames() ([]string, error) {
-	return state.unconfirmed.GetAll()
+	return state.AllUnconfirmedUsernamesContext(context.Background())
 }
 
 // ConfirmationCode gets the confirmation code for a specific user.
 func (state *UserState) ConfirmationCode(username string) (string, error) {
-	return state.users.Get(username, "confirmationCode")
+	return state.ConfirmationCodeContext(context.Background(), username)
 }
 
 // Users gets the users HashMap.
@@ -482,37 +512,33 @@ func (state *UserState) Users() pinterface.IHashMap {
 
 // AddUnconfirmed adds a user that is registered but not confirmed.
 func (state *UserState) AddUnconfirmed(username, confirmationCode string) {
-	state.unconfirmed.Add(username)
-	state.users.Set(username, "confirmationCode", confirmationCode)
+	state.AddUnconfirmedContext(context.Background(), username, confirmationCode)
 }
 
 // RemoveUnconfirmed removes a user that is registered but not confirmed.
 func (state *UserState) RemoveUnconfirmed(username string) {
-	state.unconfirmed.Del(username)
-	state.users.DelKey(username, "confirmationCode")
+	state.RemoveUnconfirmedContext(context.Background(), username)
 }
 
 // MarkConfirmed can mark a user as confirmed.
 func (state *UserState) MarkConfirmed(username string) {
-	state.users.Set(username, "confirmed", "true")
+	state.MarkConfirmedContext(context.Background(), username)
 }
 
 // RemoveUser removes user and login status.
+// Use DeleteUser to also remove all the other fields of the user.
 func (state *UserState) RemoveUser(username string) {
-	state.usernames.Del(username)
-	// Remove additional data as well
-	// TODO: Ideally, remove all keys belonging to the user.
-	state.users.DelKey(username, "loggedin")
+	state.RemoveUserContext(context.Background(), username)
 }
 
 // SetAdminStatus can make a user an administrator.
 func (state *UserState) SetAdminStatus(username string) {
-	state.users.Set(username, "admin", "true")
+	state.SetAdminStatusContext(context.Background(), username)
 }
 
 // RemoveAdminStatus can remove administrator status from a user.
 func (state *UserState) RemoveAdminStatus(username string) {
-	state.users.Set(username, "admin", "false")
+	state.RemoveAdminStatusContext(context.Background(), username)
 }
 
 // SetToken sets a token for a user, for a given expiry time.
@@ -533,40 +559,24 @@ func (state *UserState) RemoveToken(username string) {
 // SetPassword sets the password for a user. The given password string will be hashed.
 // No validation or check of the given password is performed.
 func (state *UserState) SetPassword(username, password string) {
-	state.users.Set(username, "password", state.HashPassword(username, password))
-}
-
-// Creates a user from the username and password hash, does not check for rights.
-func (state *UserState) addUserUnchecked(username, passwordHash, email string) {
-	// Add the user
-	state.usernames.Add(username)
-
-	// Add password and email
-	state.users.Set(username, "password", passwordHash)
-	state.users.Set(username, "email", email)
-
-	// Additional fields
-	additionalfields := []string{"loggedin", "confirmed", "admin"}
-	for _, fieldname := range additionalfields {
-		state.users.Set(username, fieldname, "false")
-	}
+	state.SetPasswordContext(context.Background(), username, password)
 }
 
 // AddUser creates a user and hashes the password, does not check for rights.
-// The given data must be valid.
+// The given data must be valid. An existing user with the same username is
+// overwritten. Use CreateUser to avoid this.
 func (state *UserState) AddUser(username, password, email string) {
-	passwordHash := state.HashPassword(username, password)
-	state.addUserUnchecked(username, passwordHash, email)
+	state.AddUserContext(context.Background(), username, password, email)
 }
 
 // SetLoggedIn will mark the user as logged in. Use the Login function instead, unless cookies are not involved.
 func (state *UserState) SetLoggedIn(username string) {
-	state.users.Set(username, "loggedin", "true")
+	state.SetLoggedInContext(context.Background(), username)
 }
 
 // SetLoggedOut will mark the user as logged out.
 func (state *UserState) SetLoggedOut(username string) {
-	state.users.Set(username, "loggedin", "false")
+	state.SetLoggedOutContext(context.Background(), username)
 }
 
 // Login is a convenience function for logging a user in and storing the username in a cookie.
@@ -652,24 +662,14 @@ func (state *UserState) HashPassword(username, password string) string {
 	return ""
 }
 
-// storedHash returns the stored hash, or an empty byte slice.
-func (state *UserState) storedHash(username string) []byte {
-	hashString, err := state.PasswordHash(username)
-	if err != nil {
-		return []byte{}
-	}
-	return []byte(hashString)
-}
-
 // CorrectPassword checks if a password is correct. username is needed because it is part of the hash.
 func (state *UserState) CorrectPassword(username, password string) bool {
+	correct, _ := state.CorrectPasswordContext(context.Background(), username, password)
+	return correct
+}
 
-	if !state.HasUser(username) {
-		return false
-	}
-
-	// Retrieve the stored password hash
-	hash := state.storedHash(username)
+// correctHash checks if the password matches the given stored password hash
+func (state *UserState) correctHash(hash []byte, username, password string) bool {
 	if len(hash) == 0 {
 		return false
 	}
@@ -747,11 +747,7 @@ func (state *UserState) FindUserByConfirmationCode(confirmationCode string) (str
 
 // Confirm removes the username from the list of unconfirmed users and mark the user as confirmed.
 func (state *UserState) Confirm(username string) {
-	// Remove from the list of unconfirmed usernames
-	state.RemoveUnconfirmed(username)
-
-	// Mark user as confirmed
-	state.MarkConfirmed(username)
+	state.ConfirmContext(context.Background(), username)
 }
 
 // ConfirmUserByConfirmationCode takes a confirmation code and mark the corresponding unconfirmed user as confirmed.
@@ -792,6 +788,7 @@ func (state *UserState) GenerateUniqueConfirmationCode() (string, error) {
 // Also check if the chosen username only contains letters, numbers and/or underscore.
 // Use the "CorrectPassword" function for checking if the password is correct.
 // Don't use this function if you wish to use e-mail addresses as usernames.
+// Use NormalizeUsername for allowing letters from other alphabets too.
 func ValidUsernamePassword(username, password string) error {
 	const allAllowedLetters = "abcdefghijklmnopqrstuvwxyzæøåABCDEFGHIJKLMNOPQRSTUVWXYZÆØÅ_0123456789"
 NEXT:
@@ -817,7 +814,7 @@ func (state *UserState) Creator() pinterface.ICreator {
 // Properties returns a list of user properties.
 // Returns an empty list if the user has no properties, or if there are errors.
 func (state *UserState) Properties(username string) []string {
-	props, err := state.users.Keys(username)
+	props, err := state.PropertiesContext(context.Background(), username)
 	if err != nil {
 		return []string{}
 	}
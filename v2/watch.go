@@ -0,0 +1,123 @@
+package permissions
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultPolicyCheckInterval is how often a watched policy file is checked
+// for changes, if no interval is given to WatchPolicyFile
+const DefaultPolicyCheckInterval = 2 * time.Second
+
+// PolicyWatcher loads a policy file again when it changes, or when the
+// process receives SIGHUP
+type PolicyWatcher struct {
+	perm     *Permissions
+	filename string
+	onError  func(error)
+	modTime  time.Time
+	size     int64
+	mut      sync.Mutex // Mutex for loading the policy file
+	signals  chan os.Signal
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// WatchPolicyFile loads the given policy file, and then checks it for
+// changes at the given interval (or DefaultPolicyCheckInterval, if 0).
+// The policy is also loaded again when the process receives SIGHUP.
+//
+// When the policy is loaded again, all rules are replaced at once, so
+// requests that are being handled use either the old or the new rules.
+// If the changed policy file is not valid, the old rules are kept, and the
+// problems are passed to onError, or logged if onError is nil.
+//
+// Returns an error if the policy file can not be loaded the first time.
+// Call Stop on the returned PolicyWatcher to stop watching.
+func (perm *Permissions) WatchPolicyFile(filename string, interval time.Duration, onError func(error)) (*PolicyWatcher, error) {
+	if interval <= 0 {
+		interval = DefaultPolicyCheckInterval
+	}
+	if onError == nil {
+		onError = func(err error) {
+			log.Printf("permissions: could not reload the policy: %v", err)
+		}
+	}
+	pw := &PolicyWatcher{
+		perm:     perm,
+		filename: filename,
+		onError:  onError,
+		signals:  make(chan os.Signal, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := pw.Reload(); err != nil {
+		return nil, err
+	}
+	signal.Notify(pw.signals, syscall.SIGHUP)
+	go pw.watch(interval)
+	return pw, nil
+}
+
+// watch checks the policy file at the given interval, and listens for SIGHUP
+func (pw *PolicyWatcher) watch(interval time.Duration) {
+	defer close(pw.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pw.stop:
+			return
+		case <-pw.signals:
+			if err := pw.Reload(); err != nil {
+				pw.onError(err)
+			}
+		case <-ticker.C:
+			if !pw.changed() {
+				continue
+			}
+			if err := pw.Reload(); err != nil {
+				pw.onError(err)
+			}
+		}
+	}
+}
+
+// changed checks if the modification time or size of the policy file has
+// changed since it was last loaded
+func (pw *PolicyWatcher) changed() bool {
+	fi, err := os.Stat(pw.filename)
+	if err != nil {
+		// The file may be in the middle of being replaced
+		return false
+	}
+	pw.mut.Lock()
+	defer pw.mut.Unlock()
+	return !fi.ModTime().Equal(pw.modTime) || fi.Size() != pw.size
+}
+
+// Reload loads the policy file now. If it is not valid, the old rules are
+// kept and the problems are returned.
+func (pw *PolicyWatcher) Reload() error {
+	pw.mut.Lock()
+	defer pw.mut.Unlock()
+	// Remember the file, even if it is not valid, so that it is only reported once
+	if fi, err := os.Stat(pw.filename); err == nil {
+		pw.modTime, pw.size = fi.ModTime(), fi.Size()
+	}
+	return pw.perm.LoadPolicyFile(pw.filename)
+}
+
+// Stop stops watching the policy file and listening for SIGHUP
+func (pw *PolicyWatcher) Stop() {
+	signal.Stop(pw.signals)
+	pw.stopOnce.Do(func() {
+		close(pw.stop)
+	})
+	<-pw.done
+}
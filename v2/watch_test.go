@@ -0,0 +1,103 @@
+package permissions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitFor checks the given condition until it is true, or fails after a while
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("Error, timed out waiting for", what)
+}
+
+// writePolicy writes a policy file, and makes sure that the modification
+// time changes, even on filesystems with a coarse resolution
+func writePolicy(t *testing.T, filename, doc string) {
+	t.Helper()
+	modTime := time.Now()
+	if fi, err := os.Stat(filename); err == nil {
+		modTime = fi.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(filename, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchPolicyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "policy.yml")
+	writePolicy(t, filename, "version: 1\npublic: [/]\nrules:\n  - path: /admin\n    role: admin\n")
+
+	perm := New()
+	errs := make(chan error, 10)
+	pw, err := perm.WatchPolicyFile(filename, 10*time.Millisecond, func(err error) { errs <- err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Stop()
+
+	allowed := func(path string) bool {
+		return perm.Decide(httptest.NewRequest(http.MethodGet, path, nil)).Allowed
+	}
+	if allowed("/admin") || !allowed("/secret") {
+		t.Fatal("Error, the policy file should have been loaded")
+	}
+
+	// A changed policy file is loaded again
+	writePolicy(t, filename, "version: 1\npublic: [/]\nrules:\n  - path: /secret\n    role: admin\n")
+	waitFor(t, "the changed policy", func() bool {
+		return allowed("/admin") && !allowed("/secret")
+	})
+
+	// An invalid policy file is reported, and the old rules are kept
+	writePolicy(t, filename, "version: 1\nrules:\n  - path: /admin\n    role: nobody\n")
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Error, expected a problem with the policy")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Error, the invalid policy file should be reported")
+	}
+	if !allowed("/admin") || allowed("/secret") {
+		t.Error("Error, the old rules should be kept")
+	}
+}
+
+func TestWatchPolicyFileSIGHUP(t *testing.T) {
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Skip(err)
+	}
+	filename := filepath.Join(t.TempDir(), "policy.yml")
+	writePolicy(t, filename, "version: 1\npublic: [/]\n")
+
+	perm := New()
+	pw, err := perm.WatchPolicyFile(filename, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Stop()
+
+	// The file is only checked for changes every hour, so only SIGHUP loads it
+	writePolicy(t, filename, "version: 1\npublic: [/]\nrules:\n  - path: /x\n    role: admin\n")
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Skip("SIGHUP is not supported:", err)
+	}
+	waitFor(t, "the policy to be loaded after SIGHUP", func() bool {
+		return !perm.Decide(httptest.NewRequest(http.MethodGet, "/x", nil)).Allowed
+	})
+}